@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"time"
+)
+
+var (
+	boltConfigBucket   = []byte("config")
+	boltSessionBucket  = []byte("sessions")
+	boltLastUsedBucket = []byte("sessions_last_used")
+	boltRevisionBucket = []byte("config_revisions")
+	boltHistoryBucket  = []byte("config_history")
+	boltProfileBucket  = []byte("config_profiles")
+
+	boltProfileDocumentKey   = []byte("document")
+	boltProfileRevisionKey   = []byte("revision")
+	boltProfileHistoryBucket = []byte("history")
+)
+
+func init() {
+	registerStoreDriver("bolt", func() storeDriver { return &boltStore{} })
+}
+
+type boltStoreConfig struct {
+	Path     string   `env:"BOLT_PATH" envDefault:"config-server.db"`
+	Sessions []string `env:"BOLT_SESSIONS"`
+}
+
+type boltStore struct {
+	config boltStoreConfig
+	db     *bbolt.DB
+}
+
+func (b *boltStore) Config() interface{} {
+	return &b.config
+}
+
+func (b *boltStore) Validate() error {
+	if b.config.Path == "" {
+		return errors.New("BOLT_PATH is required")
+	}
+	_, err := parseStaticSessions(b.config.Sessions)
+	return err
+}
+
+func (b *boltStore) Open(logger *zap.Logger) error {
+	db, err := OpenBoltDatabase(b.config.Path)
+	if err != nil {
+		return err
+	}
+	b.db = db
+	logger.Info("Opened bolt database at " + b.config.Path)
+	return nil
+}
+
+func (b *boltStore) Close() error {
+	if b.db == nil {
+		return nil
+	}
+	return b.db.Close()
+}
+
+func (b *boltStore) NewConfigRepository(options RepositoryOptions) (ConfigRepository, error) {
+	return NewBoltConfigRepository(b.db, options), nil
+}
+
+func (b *boltStore) NewSessionRepository() (SessionRepository, error) {
+	return NewBoltSessionRepository(b.db, b.config.Sessions)
+}
+
+// OpenBoltDatabase opens the embedded database at path, every write is fsynced before its transaction returns
+func OpenBoltDatabase(path string) (*bbolt.DB, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{boltConfigBucket, boltSessionBucket, boltLastUsedBucket, boltRevisionBucket, boltHistoryBucket, boltProfileBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func boltUserKey(userId int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(userId))
+	return key
+}
+
+type boltDocumentStore struct {
+	db               *bbolt.DB
+	historyRetention time.Duration
+	codec            valueCodec
+}
+
+// boltConfigRepository is the document repository of a boltDocumentStore, which can re-encrypt its values
+type boltConfigRepository struct {
+	*documentConfigRepository
+	store *boltDocumentStore
+}
+
+// NewBoltConfigRepository stores each user's configDocument as json, updates are applied in a single read-modify-write
+// transaction so a crash can never leave a document half written or out of sync with its history
+func NewBoltConfigRepository(db *bbolt.DB, options RepositoryOptions) ConfigRepository {
+	store := &boltDocumentStore{
+		db:               db,
+		historyRetention: options.HistoryRetention,
+		codec:            newValueCodec(options),
+	}
+	return &boltConfigRepository{documentConfigRepository: newDocumentConfigRepository(store, options), store: store}
+}
+
+// boltProfile locates the document, revision and history of a profile. The default profile keeps the layout from
+// before profiles were introduced, keyed by user in the shared buckets, every named profile has a bucket of its own.
+type boltProfile struct {
+	documents     *bbolt.Bucket
+	documentKey   []byte
+	revisions     *bbolt.Bucket
+	revisionKey   []byte
+	history       *bbolt.Bucket
+	historyPrefix []byte
+}
+
+func boltProfileKey(userId int64, profile string) []byte {
+	return append(boltUserKey(userId), profile...)
+}
+
+// openBoltProfile returns nil for a named profile that doesn't exist, unless create is set
+func openBoltProfile(tx *bbolt.Tx, userId int64, profile string, create bool) (*boltProfile, error) {
+	if profile == DefaultProfile {
+		return &boltProfile{
+			documents:     tx.Bucket(boltConfigBucket),
+			documentKey:   boltUserKey(userId),
+			revisions:     tx.Bucket(boltRevisionBucket),
+			revisionKey:   boltUserKey(userId),
+			history:       tx.Bucket(boltHistoryBucket),
+			historyPrefix: boltUserKey(userId),
+		}, nil
+	}
+	profiles := tx.Bucket(boltProfileBucket)
+	bucket := profiles.Bucket(boltProfileKey(userId, profile))
+	if bucket == nil {
+		if !create {
+			return nil, nil
+		}
+		var err error
+		if bucket, err = profiles.CreateBucket(boltProfileKey(userId, profile)); err != nil {
+			return nil, err
+		}
+		if _, err = bucket.CreateBucket(boltProfileHistoryBucket); err != nil {
+			return nil, err
+		}
+	}
+	return &boltProfile{
+		documents:   bucket,
+		documentKey: boltProfileDocumentKey,
+		revisions:   bucket,
+		revisionKey: boltProfileRevisionKey,
+		history:     bucket.Bucket(boltProfileHistoryBucket),
+	}, nil
+}
+
+// historyKey orders the history by revision, the prefix keeps users apart in the shared bucket and allows scanning it
+func (p *boltProfile) historyKey(revision int64) []byte {
+	key := make([]byte, len(p.historyPrefix)+8)
+	copy(key, p.historyPrefix)
+	binary.BigEndian.PutUint64(key[len(p.historyPrefix):], uint64(revision))
+	return key
+}
+
+// boltValue is a configValue as it's stored, compressed and encrypted values hold their text in Compressed or
+// Encrypted instead of Raw
+type boltValue struct {
+	Type       ValueType `json:"type"`
+	Raw        string    `json:"raw,omitempty"`
+	Compressed []byte    `json:"zraw,omitempty"`
+	Encrypted  []byte    `json:"enc,omitempty"`
+}
+
+func (p *boltProfile) document(codec valueCodec) (configDocument, error) {
+	data := p.documents.Get(p.documentKey)
+	if data == nil {
+		return nil, nil
+	}
+	var stored map[string]map[string]boltValue
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	document := make(configDocument, len(stored))
+	for group, fields := range stored {
+		values := make(map[string]configValue, len(fields))
+		for field, value := range fields {
+			raw, err := codec.decode(group+"."+field, storedValue{Raw: value.Raw, Compressed: value.Compressed, Encrypted: value.Encrypted})
+			if err != nil {
+				return nil, err
+			}
+			values[field] = configValue{Type: value.Type, Raw: raw}
+		}
+		document[group] = values
+	}
+	return document, nil
+}
+
+func (p *boltProfile) revision() int64 {
+	if value := p.revisions.Get(p.revisionKey); value != nil {
+		return int64(binary.BigEndian.Uint64(value))
+	}
+	return 0
+}
+
+// write stores document at revision, recording revision in the history unless it's nil
+func (p *boltProfile) write(document configDocument, codec valueCodec, current int64, revision *ConfigRevision) error {
+	stored := make(map[string]map[string]boltValue, len(document))
+	for group, fields := range document {
+		values := make(map[string]boltValue, len(fields))
+		for field, value := range fields {
+			encoded, err := codec.encode(group+"."+field, value)
+			if err != nil {
+				return err
+			}
+			values[field] = boltValue{Type: value.Type, Raw: encoded.Raw, Compressed: encoded.Compressed, Encrypted: encoded.Encrypted}
+		}
+		stored[group] = values
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err = p.documents.Put(p.documentKey, data); err != nil {
+		return err
+	}
+	if revision != nil {
+		current = revision.Revision
+	}
+	if err = p.revisions.Put(p.revisionKey, boltUserKey(current)); err != nil {
+		return err
+	}
+	if revision == nil {
+		return nil
+	}
+	return p.record(*revision, codec)
+}
+
+// record stores revision in the history with its changes sealed
+func (p *boltProfile) record(revision ConfigRevision, codec valueCodec) error {
+	var err error
+	if revision.Changes, err = codec.sealChanges(revision.Changes); err != nil {
+		return err
+	}
+	data, err := json.Marshal(revision)
+	if err != nil {
+		return err
+	}
+	return p.history.Put(p.historyKey(revision.Revision), data)
+}
+
+// forEachRevision calls fn with the profile's history oldest first until it returns false
+func (p *boltProfile) forEachRevision(fn func(key []byte, revision ConfigRevision) bool) error {
+	cursor := p.history.Cursor()
+	for key, value := cursor.Seek(p.historyPrefix); key != nil && bytes.HasPrefix(key, p.historyPrefix); key, value = cursor.Next() {
+		var revision ConfigRevision
+		if err := json.Unmarshal(value, &revision); err != nil {
+			return err
+		}
+		if !fn(key, revision) {
+			break
+		}
+	}
+	return nil
+}
+
+// prune deletes the revisions older than retention, they're stored oldest first so the scan stops at the first one
+// that's kept
+func (p *boltProfile) prune(retention time.Duration) error {
+	if retention <= 0 {
+		return nil
+	}
+	expiry := time.Now().Add(-retention)
+	expired := make([][]byte, 0)
+	err := p.forEachRevision(func(key []byte, revision ConfigRevision) bool {
+		if !revision.Time.Before(expiry) {
+			return false
+		}
+		expired = append(expired, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	// deleting while iterating makes the cursor skip keys
+	for _, key := range expired {
+		if err := p.history.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltDocumentStore) findDocument(userId int64, profile string) (configDocument, int64, error) {
+	var document configDocument
+	var revision int64
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		stored, err := openBoltProfile(tx, userId, profile, false)
+		if err != nil || stored == nil {
+			return err
+		}
+		document, err = stored.document(b.codec)
+		revision = stored.revision()
+		return err
+	})
+	return document, revision, err
+}
+
+func (b *boltDocumentStore) findRevision(userId int64, profile string) (int64, bool, error) {
+	var revision int64
+	var ok bool
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		stored, err := openBoltProfile(tx, userId, profile, false)
+		if err != nil || stored == nil {
+			return err
+		}
+		ok = stored.documents.Get(stored.documentKey) != nil
+		revision = stored.revision()
+		return nil
+	})
+	return revision, ok, err
+}
+
+func (b *boltDocumentStore) update(userId int64, profile string, update func(document configDocument, revision int64, exists bool) (*ConfigRevision, error)) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		stored, err := openBoltProfile(tx, userId, profile, false)
+		if err != nil {
+			return err
+		}
+		var document configDocument
+		var current int64
+		if stored != nil {
+			if document, err = stored.document(b.codec); err != nil {
+				return err
+			}
+			current = stored.revision()
+		}
+		exists := document != nil
+		if !exists {
+			document = make(configDocument)
+		}
+		revision, err := update(document, current, exists)
+
+		if err != nil || revision == nil {
+			return err
+		}
+		// named profiles are only created once something is written to them
+		if stored == nil {
+			if stored, err = openBoltProfile(tx, userId, profile, true); err != nil {
+				return err
+			}
+		}
+		if err = stored.write(document, b.codec, current, revision); err != nil {
+			return err
+		}
+		return stored.prune(b.historyRetention)
+	})
+}
+
+func (b *boltDocumentStore) findRevisions(userId int64, profile string, filter RevisionFilter) ([]ConfigRevision, error) {
+	revisions := make([]ConfigRevision, 0)
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		stored, err := openBoltProfile(tx, userId, profile, false)
+		if err != nil || stored == nil {
+			return err
+		}
+		return stored.forEachRevision(func(key []byte, revision ConfigRevision) bool {
+			revisions = append(revisions, revision)
+			return true
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	for _, revision := range revisions {
+		if err = b.codec.openChanges(revision.Changes); err != nil {
+			return nil, err
+		}
+	}
+	return filterRevisions(revisions, filter), nil
+}
+
+func (b *boltDocumentStore) listProfiles(userId int64) ([]Profile, error) {
+	profiles := make([]Profile, 0)
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(boltConfigBucket).Get(boltUserKey(userId)) != nil {
+			stored, _ := openBoltProfile(tx, userId, DefaultProfile, false)
+			profiles = append(profiles, Profile{Name: DefaultProfile, Revision: stored.revision()})
+		}
+		prefix := boltUserKey(userId)
+		cursor := tx.Bucket(boltProfileBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			stored, err := openBoltProfile(tx, userId, string(key[len(prefix):]), false)
+			if err != nil {
+				return err
+			}
+			profiles = append(profiles, Profile{Name: string(key[len(prefix):]), Revision: stored.revision()})
+		}
+		return nil
+	})
+	return profiles, err
+}
+
+func (b *boltDocumentStore) createProfile(userId int64, profile string, quotas Quotas) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(boltProfileBucket).Bucket(boltProfileKey(userId, profile)) != nil {
+			return ErrProfileExists
+		}
+		profiles := 0
+		prefix := boltUserKey(userId)
+		cursor := tx.Bucket(boltProfileBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			profiles++
+		}
+		if err := quotas.checkProfiles(profiles); err != nil {
+			return err
+		}
+		stored, err := openBoltProfile(tx, userId, profile, true)
+		if err != nil {
+			return err
+		}
+		return stored.write(make(configDocument), b.codec, 0, nil)
+	})
+}
+
+func (b *boltDocumentStore) renameProfile(userId int64, profile string, name string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		source, err := openBoltProfile(tx, userId, profile, false)
+		if err != nil {
+			return err
+		} else if source == nil {
+			return ErrProfileNotFound
+		}
+		if tx.Bucket(boltProfileBucket).Bucket(boltProfileKey(userId, name)) != nil {
+			return ErrProfileExists
+		}
+		target, err := openBoltProfile(tx, userId, name, true)
+		if err != nil {
+			return err
+		}
+		// named profiles keep everything in their bucket, so moving it over key by key moves the whole profile
+		err = source.documents.ForEach(func(key []byte, value []byte) error {
+			if value == nil {
+				return nil
+			}
+			return target.documents.Put(key, value)
+		})
+		if err != nil {
+			return err
+		}
+		err = source.history.ForEach(func(key []byte, value []byte) error {
+			return target.history.Put(key, value)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltProfileBucket).DeleteBucket(boltProfileKey(userId, profile))
+	})
+}
+
+func (b *boltDocumentStore) deleteProfile(userId int64, profile string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := tx.Bucket(boltProfileBucket).DeleteBucket(boltProfileKey(userId, profile))
+		if err == bbolt.ErrBucketNotFound {
+			return ErrProfileNotFound
+		}
+		return err
+	})
+}
+
+type boltSessionRepository struct {
+	db *bbolt.DB
+}
+
+// NewBoltSessionRepository looks sessions up in the embedded database, the given uuid:userId sessions are imported
+// into it first so single node deployments can provision sessions through configuration
+func NewBoltSessionRepository(db *bbolt.DB, sessions []string) (SessionRepository, error) {
+	imported, err := parseStaticSessions(sessions)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltSessionBucket)
+		for uuid, userId := range imported {
+			if err := bucket.Put([]byte(uuid), boltUserKey(userId)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return boltSessionRepository{db: db}, nil
+}
+
+func (b boltSessionRepository) FindUserIdByUuid(ctx context.Context, uuid string) (int64, error) {
+	userId := int64(-1)
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(boltSessionBucket).Get([]byte(uuid))
+		if value == nil {
+			return sql.ErrNoRows
+		}
+		userId = int64(binary.BigEndian.Uint64(value))
+		return nil
+	})
+	return userId, err
+}
+
+func (b boltSessionRepository) UpdateLastUsedByUserId(userId int64) error {
+	lastUsed := make([]byte, 8)
+	binary.BigEndian.PutUint64(lastUsed, uint64(time.Now().Unix()))
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltLastUsedBucket).Put(boltUserKey(userId), lastUsed)
+	})
+}
+
+// ReencryptValues re-encrypts the profiles one transaction at a time
+func (r *boltConfigRepository) ReencryptValues(ctx context.Context) (int, error) {
+	type profileKey struct {
+		userId  int64
+		profile string
+	}
+	var profiles []profileKey
+	err := r.store.db.View(func(tx *bbolt.Tx) error {
+		err := tx.Bucket(boltConfigBucket).ForEach(func(key []byte, value []byte) error {
+			profiles = append(profiles, profileKey{userId: int64(binary.BigEndian.Uint64(key)), profile: DefaultProfile})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltProfileBucket).ForEach(func(key []byte, value []byte) error {
+			if value == nil {
+				profiles = append(profiles, profileKey{userId: int64(binary.BigEndian.Uint64(key)), profile: string(key[8:])})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, key := range profiles {
+		if err = ctx.Err(); err != nil {
+			return rewritten, err
+		}
+		err = r.store.db.Update(func(tx *bbolt.Tx) error {
+			stored, err := openBoltProfile(tx, key.userId, key.profile, false)
+			if err != nil || stored == nil {
+				return err
+			}
+			count, err := stored.reencrypt(r.store.codec)
+			if err == nil {
+				rewritten += count
+			}
+			return err
+		})
+		if err != nil {
+			return rewritten, err
+		}
+	}
+	return rewritten, nil
+}
+
+// reencrypt rewrites the profile's document when any of its values is stale, along with its stale revisions. It
+// returns the number of values and revisions that were.
+func (p *boltProfile) reencrypt(codec valueCodec) (int, error) {
+	rewritten := 0
+	if data := p.documents.Get(p.documentKey); data != nil {
+		var stored map[string]map[string]boltValue
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return 0, err
+		}
+		for group, fields := range stored {
+			for field, value := range fields {
+				if codec.stale(group+"."+field, storedValue{Raw: value.Raw, Compressed: value.Compressed, Encrypted: value.Encrypted}) {
+					rewritten++
+				}
+			}
+		}
+		if rewritten > 0 {
+			document, err := p.document(codec)
+			if err != nil {
+				return 0, err
+			}
+			if err = p.write(document, codec, p.revision(), nil); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	var stale []ConfigRevision
+	err := p.forEachRevision(func(key []byte, revision ConfigRevision) bool {
+		if codec.staleChanges(revision.Changes) {
+			stale = append(stale, revision)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, revision := range stale {
+		if err = codec.openChanges(revision.Changes); err != nil {
+			return 0, err
+		}
+		if err = p.record(revision, codec); err != nil {
+			return 0, err
+		}
+	}
+	return rewritten + len(stale), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"go.etcd.io/bbolt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBoltConfigRepositoryContract(t *testing.T) {
+	testConfigRepositoryContract(t, func(t *testing.T) ConfigRepository {
+		db, err := OpenBoltDatabase(filepath.Join(t.TempDir(), "config.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return NewBoltConfigRepository(db, contractOptions)
+	})
+}
+
+func TestBoltRepositoriesPersistAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.db")
+	ctx := context.Background()
+
+	db, err := OpenBoltDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewBoltSessionRepository(db, []string{"f1b7d3c4-uuid:1000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = NewBoltConfigRepository(db, contractOptions).Save(ctx, 1000, DefaultProfile, &ConfigEntry{Key: "group.key", Value: "value"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = OpenBoltDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	sessions, err := NewBoltSessionRepository(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userId, err := sessions.FindUserIdByUuid(ctx, "f1b7d3c4-uuid"); err != nil || userId != 1000 {
+		t.Errorf("Got user id %d but expected %d", userId, 1000)
+	}
+	if _, err := sessions.FindUserIdByUuid(ctx, "missing"); err == nil {
+		t.Errorf("Found user id for a missing session")
+	}
+	assertConfiguration(t, NewBoltConfigRepository(db, contractOptions), 1000, []ConfigEntry{{Key: "group.key", Value: "value"}})
+}
+
+func TestBoltCompressesLargeValues(t *testing.T) {
+	db, err := OpenBoltDatabase(filepath.Join(t.TempDir(), "config.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	large := strings.Repeat("Abyssal whip,", 40)
+	entries := []ConfigEntry{{Key: "group.large", Value: large}, {Key: "group.small", Value: "small"}}
+	if _, err = NewBoltConfigRepository(db, contractOptions).SaveBatch(context.Background(), 1, DefaultProfile, &Configuration{Config: entries}); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored map[string]map[string]boltValue
+	err = db.View(func(tx *bbolt.Tx) error {
+		return json.Unmarshal(tx.Bucket(boltConfigBucket).Get(boltUserKey(1)), &stored)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := stored["group"]["large"]; value.Raw != "" || value.Compressed == nil || len(value.Compressed) >= len(large) {
+		t.Errorf("Got stored value %+v but expected it compressed", value)
+	}
+	if value := stored["group"]["small"]; value.Raw != "small" || value.Compressed != nil {
+		t.Errorf("Got stored value %+v but expected it as is", value)
+	}
+	assertConfiguration(t, NewBoltConfigRepository(db, contractOptions), 1, entries)
+}
+
+func TestBoltEncryptsValues(t *testing.T) {
+	db, err := OpenBoltDatabase(filepath.Join(t.TempDir(), "config.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	repository := NewBoltConfigRepository(db, contractOptions)
+	for _, value := range []string{"https://discord.com/api/webhooks/1/secret", "https://discord.com/api/webhooks/2/secret"} {
+		if err = repository.Save(context.Background(), 1, DefaultProfile, &ConfigEntry{Key: "discord.webhookUrl", Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// neither the document nor the history may hold the secret
+	err = db.View(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{boltConfigBucket, boltHistoryBucket} {
+			err := tx.Bucket(bucket).ForEach(func(key []byte, value []byte) error {
+				if bytes.Contains(value, []byte("secret")) {
+					t.Errorf("Got %s stored in %s", value, bucket)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{{Key: "discord.webhookUrl", Value: "https://discord.com/api/webhooks/2/secret"}})
+}
+
+func TestBoltReencryptsValues(t *testing.T) {
+	db, err := OpenBoltDatabase(filepath.Join(t.TempDir(), "config.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testValueReencryption(t, func(options RepositoryOptions) ConfigRepository {
+		return NewBoltConfigRepository(db, options)
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// ConfigEvent announces a revision written to a user's configuration
+type ConfigEvent struct {
+	UserId   int64
+	Profile  string
+	Revision ConfigRevision
+	// Origin is the auth token of the session that made the change, so it can skip its own events
+	Origin string
+}
+
+// ChangeBroker fans config events out to the sessions subscribed to a user. The in-process broker only reaches
+// sessions connected to the same instance, brokers backed by change streams or a message queue can replace it.
+type ChangeBroker interface {
+	Publish(event ConfigEvent)
+	// Subscribe returns the user's events until cancel is called. The channel is closed when the subscriber falls too
+	// far behind, it then has to resync and subscribe again.
+	Subscribe(userId int64) (events <-chan ConfigEvent, cancel func())
+}
+
+const subscriptionBuffer = 64
+
+type memorySubscription struct {
+	events chan ConfigEvent
+}
+
+type memoryChangeBroker struct {
+	lock          sync.Mutex
+	subscriptions map[int64]map[*memorySubscription]struct{}
+}
+
+func NewMemoryChangeBroker() ChangeBroker {
+	return &memoryChangeBroker{subscriptions: make(map[int64]map[*memorySubscription]struct{})}
+}
+
+func (b *memoryChangeBroker) Publish(event ConfigEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for subscription := range b.subscriptions[event.UserId] {
+		select {
+		case subscription.events <- event:
+		default:
+			// never block writers on a slow subscriber, dropping it makes it resync instead of silently missing events
+			b.remove(event.UserId, subscription)
+		}
+	}
+}
+
+func (b *memoryChangeBroker) Subscribe(userId int64) (<-chan ConfigEvent, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	subscription := &memorySubscription{events: make(chan ConfigEvent, subscriptionBuffer)}
+	if b.subscriptions[userId] == nil {
+		b.subscriptions[userId] = make(map[*memorySubscription]struct{})
+	}
+	b.subscriptions[userId][subscription] = struct{}{}
+
+	return subscription.events, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.remove(userId, subscription)
+	}
+}
+
+func (b *memoryChangeBroker) remove(userId int64, subscription *memorySubscription) {
+	if _, ok := b.subscriptions[userId][subscription]; !ok {
+		return
+	}
+	delete(b.subscriptions[userId], subscription)
+	if len(b.subscriptions[userId]) == 0 {
+		delete(b.subscriptions, userId)
+	}
+	close(subscription.events)
+}
+
+// publishingConfigRepository publishes every revision that changed something to broker. All writes go through the
+// wrapped repository's Apply since it's the only write method reporting the revision. A user's writes are serialized
+// so their events are published in revision order, subscribers apply them in the order they arrive.
+type publishingConfigRepository struct {
+	ConfigRepository
+	broker ChangeBroker
+
+	lock    sync.Mutex
+	writing map[int64]*userWriteLock
+}
+
+// userWriteLock serializes the writes of a user, it's dropped once no write holds or waits on it
+type userWriteLock struct {
+	sync.Mutex
+	writers int
+}
+
+func NewPublishingConfigRepository(repository ConfigRepository, broker ChangeBroker) ConfigRepository {
+	return &publishingConfigRepository{ConfigRepository: repository, broker: broker, writing: make(map[int64]*userWriteLock)}
+}
+
+// lockUser waits for the user's other writes and returns the function releasing the user to the next one
+func (p *publishingConfigRepository) lockUser(userId int64) func() {
+	p.lock.Lock()
+	userLock := p.writing[userId]
+	if userLock == nil {
+		userLock = &userWriteLock{}
+		p.writing[userId] = userLock
+	}
+	userLock.writers++
+	p.lock.Unlock()
+
+	userLock.Lock()
+	return func() {
+		userLock.Unlock()
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if userLock.writers--; userLock.writers == 0 {
+			delete(p.writing, userId)
+		}
+	}
+}
+
+func (p *publishingConfigRepository) Save(ctx context.Context, userId int64, profile string, entry *ConfigEntry) error {
+	_, failedKeys, err := p.Apply(ctx, userId, profile, []ConfigMutation{{Key: entry.Key, Value: &entry.Value, Type: entry.Type}}, Precondition{})
+
+	if err == nil && len(failedKeys) > 0 {
+		err = errInvalidConfigEntry
+	}
+	return err
+}
+
+func (p *publishingConfigRepository) SaveBatch(ctx context.Context, userId int64, profile string, configuration *Configuration) ([]string, error) {
+	mutations := make([]ConfigMutation, len(configuration.Config))
+	for i := range configuration.Config {
+		mutations[i] = ConfigMutation{Key: configuration.Config[i].Key, Value: &configuration.Config[i].Value, Type: configuration.Config[i].Type}
+	}
+	_, failedKeys, err := p.Apply(ctx, userId, profile, mutations, Precondition{})
+	return failedKeys, err
+}
+
+func (p *publishingConfigRepository) DeleteKey(ctx context.Context, userId int64, profile string, key string) error {
+	_, failedKeys, err := p.Apply(ctx, userId, profile, []ConfigMutation{{Key: key}}, Precondition{})
+
+	if err == nil && len(failedKeys) > 0 {
+		err = errInvalidConfigEntry
+	}
+	return err
+}
+
+func (p *publishingConfigRepository) Apply(ctx context.Context, userId int64, profile string, mutations []ConfigMutation, precondition Precondition) (*ConfigRevision, []string, error) {
+	defer p.lockUser(userId)()
+	revision, failedKeys, err := p.ConfigRepository.Apply(ctx, userId, profile, mutations, precondition)
+
+	if err == nil && revision != nil && len(revision.Changes) > 0 {
+		origin, _ := ctx.Value(ctxToken).(string)
+		p.broker.Publish(ConfigEvent{UserId: userId, Profile: profile, Revision: *revision, Origin: origin})
+	}
+	return revision, failedKeys, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublishingConfigRepository(t *testing.T) {
+	broker := NewMemoryChangeBroker()
+	repository := NewPublishingConfigRepository(NewMemoryConfigRepository(contractOptions), broker)
+	events, cancel := broker.Subscribe(1)
+	defer cancel()
+
+	ctx := context.WithValue(context.Background(), ctxToken, "session")
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "group.key", Value: "value"}); err != nil {
+		t.Fatal(err)
+	}
+	// neither unchanged values nor other users are published
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "group.key", Value: "value"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.Save(ctx, 2, DefaultProfile, &ConfigEntry{Key: "group.key", Value: "value"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.DeleteKey(ctx, 1, DefaultProfile, "group.key"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []*string{stringPtr("value"), nil} {
+		event := <-events
+		if event.UserId != 1 || event.Origin != "session" || len(event.Revision.Changes) != 1 {
+			t.Fatalf("Got event %+v but expected a single change by session", event)
+		}
+		if value := event.Revision.Changes[0].Value; (value == nil) != (expected == nil) || value != nil && *value != *expected {
+			t.Errorf("Got change %+v but expected value %v", event.Revision.Changes[0], expected)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Got unexpected event %+v", event)
+	default:
+	}
+}
+
+// laggingRepository returns from odd revisions late, as writes do whose response takes a while to come back
+type laggingRepository struct {
+	ConfigRepository
+}
+
+func (r laggingRepository) Apply(ctx context.Context, userId int64, profile string, mutations []ConfigMutation, precondition Precondition) (*ConfigRevision, []string, error) {
+	revision, failedKeys, err := r.ConfigRepository.Apply(ctx, userId, profile, mutations, precondition)
+	if revision != nil && revision.Revision%2 == 1 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return revision, failedKeys, err
+}
+
+func TestPublishingConfigRepositoryOrdersEvents(t *testing.T) {
+	broker := NewMemoryChangeBroker()
+	repository := NewPublishingConfigRepository(laggingRepository{NewMemoryConfigRepository(contractOptions)}, broker)
+	events, cancel := broker.Subscribe(1)
+	defer cancel()
+
+	const writers, writes = 8, 6
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				entry := &ConfigEntry{Key: "group.key" + strconv.Itoa(writer), Value: strconv.Itoa(j)}
+				if err := repository.Save(context.Background(), 1, DefaultProfile, entry); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for revision := int64(1); revision <= writers*writes; revision++ {
+		if event := <-events; event.Revision.Revision != revision {
+			t.Fatalf("Got revision %d but expected the events in revision order at %d", event.Revision.Revision, revision)
+		}
+	}
+}
+
+func TestMemoryChangeBrokerDropsSlowSubscribers(t *testing.T) {
+	broker := NewMemoryChangeBroker()
+	events, cancel := broker.Subscribe(1)
+
+	for i := 0; i <= subscriptionBuffer; i++ {
+		broker.Publish(ConfigEvent{UserId: 1, Revision: ConfigRevision{Revision: int64(i + 1)}})
+	}
+	received := 0
+	for range events {
+		received++
+	}
+	if received != subscriptionBuffer {
+		t.Errorf("Got %d events but expected the %d buffered ones before the subscription was closed", received, subscriptionBuffer)
+	}
+	// cancelling a dropped subscription is a no-op
+	cancel()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"expvar"
+	"github.com/klauspost/compress/zstd"
+	"sync"
+)
+
+// maxDecompressedValueLength bounds the memory decompressing a stored value may take, far past any value that can be
+// written
+const maxDecompressedValueLength = 64 << 20
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedValueLength))
+
+// valueCompression compresses the text of stored values of at least threshold bytes with zstd, a zero threshold
+// disables it. Values are only stored compressed when that makes them smaller.
+type valueCompression struct {
+	threshold int64
+}
+
+// compress returns the compressed text of value, nil when it's stored as is
+func (c valueCompression) compress(value configValue) []byte {
+	if c.threshold <= 0 || int64(len(value.Raw)) < c.threshold {
+		return nil
+	}
+	compressed := zstdEncoder.EncodeAll([]byte(value.Raw), nil)
+	if len(compressed) >= len(value.Raw) {
+		compressed = nil
+	}
+	compressionStats.record(len(value.Raw), compressed)
+	return compressed
+}
+
+// decompressValue returns the text of a value stored compressed
+func decompressValue(compressed []byte) (string, error) {
+	raw, err := zstdDecoder.DecodeAll(compressed, nil)
+	return string(raw), err
+}
+
+// CompressionStats count the values stored since startup that were long enough to be compressed, Bytes being their
+// length and StoredBytes what they took up once stored. Ratio is StoredBytes over Bytes. The bolt store rewrites a
+// profile's whole document on each write, so its values are counted each time.
+type CompressionStats struct {
+	Values      int64   `json:"values"`
+	Compressed  int64   `json:"compressed"`
+	Bytes       int64   `json:"bytes"`
+	StoredBytes int64   `json:"storedBytes"`
+	Ratio       float64 `json:"ratio"`
+}
+
+type compressionCounter struct {
+	mutex sync.Mutex
+	stats CompressionStats
+}
+
+var compressionStats = &compressionCounter{}
+
+func init() {
+	expvar.Publish("compression", expvar.Func(func() interface{} {
+		return compressionStats.get()
+	}))
+}
+
+func (c *compressionCounter) record(length int, compressed []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stats.Values++
+	c.stats.Bytes += int64(length)
+	if compressed != nil {
+		c.stats.Compressed++
+		c.stats.StoredBytes += int64(len(compressed))
+	} else {
+		c.stats.StoredBytes += int64(length)
+	}
+}
+
+func (c *compressionCounter) get() CompressionStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	if stats.Bytes > 0 {
+		stats.Ratio = float64(stats.StoredBytes) / float64(stats.Bytes)
+	}
+	return stats
+}
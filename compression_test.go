@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestValueCompression(t *testing.T) {
+	random := make([]byte, 512)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name       string
+		threshold  int64
+		raw        string
+		compressed bool
+	}{
+		{name: "Repetitive", threshold: 64, raw: strings.Repeat("Abyssal whip,", 40), compressed: true},
+		{name: "AtThreshold", threshold: 64, raw: strings.Repeat("a", 64), compressed: true},
+		{name: "BelowThreshold", threshold: 64, raw: strings.Repeat("a", 63)},
+		{name: "Disabled", raw: strings.Repeat("a", 4096)},
+		{name: "Incompressible", threshold: 64, raw: string(random)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := compressionStats.get()
+			compressed := valueCompression{threshold: test.threshold}.compress(configValue{Type: ValueString, Raw: test.raw})
+
+			if (compressed != nil) != test.compressed {
+				t.Fatalf("Got compressed %v but expected %v", compressed != nil, test.compressed)
+			}
+			if compressed != nil {
+				if len(compressed) >= len(test.raw) {
+					t.Errorf("Got %d compressed bytes for %d bytes", len(compressed), len(test.raw))
+				}
+				if raw, err := decompressValue(compressed); err != nil || raw != test.raw {
+					t.Errorf("Got decompressed %q, %v but expected %q", raw, err, test.raw)
+				}
+			}
+
+			after := compressionStats.get()
+			if test.threshold == 0 || int64(len(test.raw)) < test.threshold {
+				if after.Values != before.Values {
+					t.Errorf("Counted a value below the threshold")
+				}
+				return
+			}
+			stored := int64(len(test.raw))
+			if compressed != nil {
+				stored = int64(len(compressed))
+			}
+			if after.Values != before.Values+1 || after.Bytes != before.Bytes+int64(len(test.raw)) || after.StoredBytes != before.StoredBytes+stored {
+				t.Errorf("Got stats %+v after %+v but expected %d bytes stored as %d", after, before, len(test.raw), stored)
+			}
+		})
+	}
+}
+
+func TestDecompressInvalidValue(t *testing.T) {
+	if _, err := decompressValue([]byte("not zstd")); err == nil {
+		t.Errorf("Decompressed a value that isn't zstd")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+	"unicode/utf8"
+)
+
+var errInvalidConfigKey = errors.New("invalid config key")
+var errInvalidConfigEntry = errors.New("invalid config entry")
+
+// preparedMutation is a validated ConfigMutation addressed by the group and field it's stored under
+type preparedMutation struct {
+	Key    string
+	Group  string
+	Field  string
+	Value  configValue
+	Delete bool
+}
+
+func (p preparedMutation) path() string {
+	return p.Group + "." + p.Field
+}
+
+// applyFunc atomically applies already validated mutations if precondition holds and they keep the configuration within
+// its quotas, it's the only write primitive a backend has to implement. See ConfigRepository.Apply for the revision it
+// returns.
+type applyFunc func(ctx context.Context, userId int64, profile string, mutations []preparedMutation, precondition Precondition) (*ConfigRevision, error)
+
+// configWriter implements the ConfigRepository write methods on top of a backend's applyFunc so validation and
+// partial failures behave the same everywhere
+type configWriter struct {
+	apply applyFunc
+	// find reads the configuration FindUsage sizes up, unless the backend keeps its usage on its own
+	find                 func(ctx context.Context, userId int64, profile string) (*Configuration, error)
+	maxConfigValueLength int64
+	// maxKeyLength limits the length of a key's group and field, 0 leaves them unbounded
+	maxKeyLength int
+	quotas       Quotas
+}
+
+func (w configWriter) prepare(mutation ConfigMutation) (preparedMutation, error) {
+	if !utf8.ValidString(mutation.Key) {
+		return preparedMutation{}, errInvalidConfigKey
+	}
+	prepared := preparedMutation{Key: mutation.Key, Delete: mutation.Value == nil}
+
+	if !prepared.Delete {
+		value, err := typedConfigValue(*mutation.Value, mutation.Type, w.maxConfigValueLength)
+
+		if err != nil {
+			return preparedMutation{}, err
+		}
+		prepared.Value = value
+	}
+	group, field, err := splitConfigPath(mutation.Key)
+
+	if err != nil {
+		return preparedMutation{}, err
+	}
+	if w.maxKeyLength > 0 && (utf8.RuneCountInString(group) > w.maxKeyLength || utf8.RuneCountInString(field) > w.maxKeyLength) {
+		return preparedMutation{}, errors.New("config key exceeds max length")
+	}
+	prepared.Group = group
+	prepared.Field = field
+	return prepared, nil
+}
+
+// prepareAll validates every mutation, invalid ones are returned as failed keys except for keys without a group which
+// fail the whole batch. When a key is mutated more than once the last mutation wins.
+func (w configWriter) prepareAll(mutations []ConfigMutation) ([]preparedMutation, []string, error) {
+	prepared := make([]preparedMutation, 0, len(mutations))
+	positions := make(map[string]int, len(mutations))
+	failedKeys := make([]string, 0)
+	var updateErr error
+	for _, mutation := range mutations {
+		p, err := w.prepare(mutation)
+
+		if err == errEmptyUpdatePath {
+			updateErr = err
+		} else if err != nil {
+			failedKeys = append(failedKeys, mutation.Key)
+		} else if position, ok := positions[p.path()]; ok {
+			prepared[position] = p
+		} else {
+			positions[p.path()] = len(prepared)
+			prepared = append(prepared, p)
+		}
+	}
+	return prepared, failedKeys, updateErr
+}
+
+func (w configWriter) Save(ctx context.Context, userId int64, profile string, entry *ConfigEntry) error {
+	mutation, err := w.prepare(ConfigMutation{Key: entry.Key, Value: &entry.Value, Type: entry.Type})
+
+	if err != nil {
+		return err
+	}
+	_, err = w.apply(ctx, userId, profile, []preparedMutation{mutation}, Precondition{})
+	return err
+}
+
+func (w configWriter) SaveBatch(ctx context.Context, userId int64, profile string, configuration *Configuration) ([]string, error) {
+	mutations := make([]ConfigMutation, len(configuration.Config))
+	for i := range configuration.Config {
+		mutations[i] = ConfigMutation{Key: configuration.Config[i].Key, Value: &configuration.Config[i].Value, Type: configuration.Config[i].Type}
+	}
+	_, failedKeys, err := w.Apply(ctx, userId, profile, mutations, Precondition{})
+	return failedKeys, err
+}
+
+func (w configWriter) DeleteKey(ctx context.Context, userId int64, profile string, key string) error {
+	mutation, err := w.prepare(ConfigMutation{Key: key})
+
+	if err != nil {
+		return err
+	}
+	_, err = w.apply(ctx, userId, profile, []preparedMutation{mutation}, Precondition{})
+	return err
+}
+
+func (w configWriter) Apply(ctx context.Context, userId int64, profile string, mutations []ConfigMutation, precondition Precondition) (*ConfigRevision, []string, error) {
+	prepared, failedKeys, err := w.prepareAll(mutations)
+
+	if err != nil || len(prepared) == 0 {
+		return nil, failedKeys, err
+	}
+	revision, err := w.apply(ctx, userId, profile, prepared, precondition)
+	return revision, failedKeys, err
+}
+
+// recordChange describes a mutation of a key that previously held previous, nil when it didn't exist. ok is false when
+// the mutation didn't change anything worth recording.
+func recordChange(mutation preparedMutation, previous *configValue) (ConfigChange, bool) {
+	change := ConfigChange{Key: mutation.path()}
+
+	if previous != nil {
+		change.Previous = &previous.Raw
+		change.PreviousType = previous.Type
+	}
+	if !mutation.Delete {
+		change.Value = &mutation.Value.Raw
+		change.Type = mutation.Value.Type
+	}
+
+	if change.Value == nil && change.Previous == nil {
+		return change, false
+	}
+	if change.Value != nil && change.Previous != nil && *change.Value == *change.Previous && change.Type == change.PreviousType {
+		return change, false
+	}
+	return change, true
+}
+
+func newRevision(revision int64, changes []ConfigChange) *ConfigRevision {
+	return &ConfigRevision{
+		Revision: revision,
+		Time:     time.Now().UTC().Truncate(time.Millisecond),
+		Changes:  changes,
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// minCompressedResponseLength is the length from which responses are compressed, shorter ones aren't worth it
+const minCompressedResponseLength = 1024
+
+// maxZstdWindow bounds the memory decoding a zstd request body may take, it's the window zstd encoders default to
+const maxZstdWindow = 8 << 20
+
+// requestEncodings are the content codings request bodies can be sent with, advertised when another one is used
+const requestEncodings = "gzip, zstd"
+
+// responseEncodings are the content codings responses can be compressed with, preferred in this order when a client
+// accepts several of them equally
+var responseEncodings = []string{"zstd", "br", "gzip"}
+
+// responseEncoder is implemented by the writers of every response encoding, they're pooled and reset for each response
+type responseEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(writer io.Writer)
+}
+
+var responseEncoders = map[string]*sync.Pool{
+	"zstd": {New: func() interface{} {
+		encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return encoder
+	}},
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, 5)
+	}},
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+// negotiateEncoding returns the response encoding an Accept-Encoding header prefers, "" when it's identity
+func negotiateEncoding(header string) string {
+	qualities := make(map[string]float64)
+	for _, accepted := range strings.Split(header, ",") {
+		params := strings.Split(accepted, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(parts) == 2 && strings.EqualFold(parts[0], "q") {
+				if q, err := strconv.ParseFloat(parts[1], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		qualities[coding] = quality
+	}
+
+	best, bestQuality := "", 0.0
+	for _, encoding := range responseEncodings {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality = qualities["*"]
+		}
+		if quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// decodeRequestBody returns the decompressed body of a request sent with a Content-Encoding
+func decodeRequestBody(encoding string, body io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "zstd":
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxZstdWindow))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
+// compressingHandler compresses responses with the encoding the request prefers
+type compressingHandler struct {
+	handler http.Handler
+}
+
+func (h *compressingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// websocket upgrades hijack the connection
+	if r.Header.Get("Upgrade") != "" {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" || r.Method == http.MethodHead {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	writer := &compressingResponseWriter{ResponseWriter: w, encoding: encoding}
+	defer writer.close()
+	h.handler.ServeHTTP(writer, r)
+}
+
+// encodedETag suffixes a strong entity tag with the encoding of the response it's sent with, every encoding is a
+// representation of its own and must not share its strong tag with the others. Weak tags are left as they are.
+func encodedETag(etag string, encoding string) string {
+	if len(etag) < 2 || !strings.HasPrefix(etag, "\"") || !strings.HasSuffix(etag, "\"") {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + encoding + "\""
+}
+
+// compressingResponseWriter holds back the status and the start of the body until it's clear whether the response is
+// worth compressing. Responses shorter than minCompressedResponseLength, flushed before they're that long or already
+// encoded by the handler are written as they are.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buffer   []byte
+	started  bool
+	encoder  responseEncoder
+	// err is the first error writing the response, Flush can't return it so it fails every later write instead
+	err error
+}
+
+func (w *compressingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressingResponseWriter) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	} else if w.started {
+		return w.write(data)
+	}
+	w.buffer = append(w.buffer, data...)
+	if len(w.buffer) < minCompressedResponseLength {
+		return len(data), nil
+	}
+	if err := w.start(true); err != nil {
+		// nothing of data is known to have been written
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *compressingResponseWriter) Flush() {
+	if !w.started {
+		w.start(false)
+	}
+	if w.encoder != nil && w.err == nil {
+		w.err = w.encoder.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && w.err == nil {
+		flusher.Flush()
+	}
+}
+
+// start writes the status and what's been held back, compressing the rest of the response if compress is set
+func (w *compressingResponseWriter) start(compress bool) error {
+	w.started = true
+	header := w.Header()
+	if compress && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", w.encoding)
+		header.Del("Content-Length")
+		if etag := header.Get("ETag"); etag != "" {
+			header.Set("ETag", encodedETag(etag, w.encoding))
+		}
+		w.encoder = responseEncoders[w.encoding].Get().(responseEncoder)
+		w.encoder.Reset(w.ResponseWriter)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buffered := w.buffer
+	w.buffer = nil
+	if len(buffered) == 0 {
+		return nil
+	}
+	_, err := w.write(buffered)
+	return err
+}
+
+func (w *compressingResponseWriter) write(data []byte) (int, error) {
+	var written int
+	if w.encoder != nil {
+		written, w.err = w.encoder.Write(data)
+	} else {
+		written, w.err = w.ResponseWriter.Write(data)
+	}
+	return written, w.err
+}
+
+// close writes out the rest of the response once the handler returned
+func (w *compressingResponseWriter) close() error {
+	if !w.started {
+		if w.status == 0 && len(w.buffer) == 0 {
+			// nothing was written, the server answers 200 as usual
+			return nil
+		}
+		return w.start(false)
+	}
+	if w.encoder == nil {
+		return nil
+	}
+	err := w.encoder.Close()
+	w.encoder.Reset(nil)
+	responseEncoders[w.encoding].Put(w.encoder)
+	w.encoder = nil
+	return err
+}
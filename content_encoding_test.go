@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		encoding string
+	}{
+		{header: "", encoding: ""},
+		{header: "identity", encoding: ""},
+		{header: "gzip", encoding: "gzip"},
+		{header: "gzip, deflate, br", encoding: "br"},
+		{header: "gzip, deflate, br, zstd", encoding: "zstd"},
+		{header: "GZIP;q=0.5, br;q=0.8", encoding: "br"},
+		{header: "zstd;q=0, gzip", encoding: "gzip"},
+		{header: "*", encoding: "zstd"},
+		{header: "*;q=0.5, gzip", encoding: "gzip"},
+		{header: "*, zstd;q=0, br;q=0", encoding: "gzip"},
+		{header: "deflate", encoding: ""},
+	}
+	for _, test := range tests {
+		if encoding := negotiateEncoding(test.header); encoding != test.encoding {
+			t.Errorf("Got encoding %q for %q but expected %q", encoding, test.header, test.encoding)
+		}
+	}
+}
+
+func decodeResponse(t *testing.T, encoding string, body io.Reader) string {
+	var reader io.Reader
+	switch encoding {
+	case "gzip":
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = gzipReader
+	case "br":
+		reader = brotli.NewReader(body)
+	case "zstd":
+		decoder, err := zstd.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+		reader = decoder
+	default:
+		reader = body
+	}
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(decoded)
+}
+
+func TestCompressingHandler(t *testing.T) {
+	long := "[" + strings.Repeat(`{"key":"runelite.theme","value":"dark mode"},`, 100) + `{"key":"runelite.end"}]`
+	handler := &compressingHandler{handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/long":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"1"`)
+			w.WriteHeader(http.StatusCreated)
+			for i := 0; i < len(long); i += 100 {
+				end := i + 100
+				if end > len(long) {
+					end = len(long)
+				}
+				w.Write([]byte(long[i:end]))
+			}
+		case "/short":
+			w.Header().Set("ETag", `"1"`)
+			w.Write([]byte("{}"))
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte(long))
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			w.Write([]byte(long))
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})}
+
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		request := httptest.NewRequest(http.MethodGet, "/long", nil)
+		request.Header.Set("Accept-Encoding", encoding)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusCreated || recorder.Header().Get("Content-Encoding") != encoding || recorder.Header().Get("ETag") != `"1-`+encoding+`"` {
+			t.Errorf("Got status %d and headers %v but expected a %s response", recorder.Code, recorder.Header(), encoding)
+		}
+		if recorder.Body.Len() >= len(long) {
+			t.Errorf("Got %d bytes for %s but expected fewer than %d", recorder.Body.Len(), encoding, len(long))
+		}
+		if body := decodeResponse(t, encoding, recorder.Body); body != long {
+			t.Errorf("Got body %q decoding %s but expected %q", body, encoding, long)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		accept   string
+		encoding string
+		status   int
+		body     string
+	}{
+		{path: "/long", accept: "", encoding: "", status: http.StatusCreated, body: long},
+		{path: "/short", accept: "gzip", encoding: "", status: http.StatusOK, body: "{}"},
+		{path: "/encoded", accept: "zstd", encoding: "gzip", status: http.StatusOK, body: long},
+		{path: "/events", accept: "gzip", encoding: "", status: http.StatusOK, body: long},
+		{path: "/empty", accept: "gzip", encoding: "", status: http.StatusNoContent, body: ""},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, test.path, nil)
+		request.Header.Set("Accept-Encoding", test.accept)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.status || recorder.Header().Get("Content-Encoding") != test.encoding || recorder.Body.String() != test.body {
+			t.Errorf("Got status %d, encoding %q and %d bytes for %s but expected %d, %q and %d bytes", recorder.Code,
+				recorder.Header().Get("Content-Encoding"), recorder.Body.Len(), test.path, test.status, test.encoding, len(test.body))
+		}
+		if test.path == "/short" && recorder.Header().Get("ETag") != `"1"` {
+			t.Errorf("Got ETag %s for an uncompressed response but expected it as it was", recorder.Header().Get("ETag"))
+		}
+		if vary := recorder.Header().Get("Vary"); vary != "Accept-Encoding" {
+			t.Errorf("Got Vary %q for %s but expected Accept-Encoding", vary, test.path)
+		}
+	}
+}
+
+// failingResponseWriter fails every write of the body, as writes to a connection the client went away from do
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+	flushed bool
+}
+
+var errClientGone = errors.New("client went away")
+
+func (w *failingResponseWriter) Write([]byte) (int, error) {
+	return 0, errClientGone
+}
+
+func (w *failingResponseWriter) Flush() {
+	w.flushed = true
+}
+
+func TestCompressingResponseWriterErrors(t *testing.T) {
+	long := []byte(strings.Repeat("dark mode ", 200))
+
+	// the response isn't compressed as the handler encoded it already, so the held back start is written as it is
+	failing := &failingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	writer := &compressingResponseWriter{ResponseWriter: failing, encoding: "gzip"}
+	writer.Header().Set("Content-Encoding", "br")
+	if written, err := writer.Write(long); written != 0 || err != errClientGone {
+		t.Errorf("Got %d, %v writing the start of the response but expected 0, %v", written, err, errClientGone)
+	}
+	if written, err := writer.Write(long); written != 0 || err != errClientGone {
+		t.Errorf("Got %d, %v writing after a failed write but expected 0, %v", written, err, errClientGone)
+	}
+
+	// flushing a response that's still held back writes its start
+	failing = &failingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	writer = &compressingResponseWriter{ResponseWriter: failing, encoding: "zstd"}
+	writer.Write([]byte("{}"))
+	writer.Flush()
+	if written, err := writer.Write(long); failing.flushed || written != 0 || err != errClientGone {
+		t.Errorf("Got %d, %v writing after a failed flush but expected 0, %v and nothing flushed", written, err, errClientGone)
+	}
+
+	// the zstd encoder only writes what it compressed once it's flushed
+	failing = &failingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	writer = &compressingResponseWriter{ResponseWriter: failing, encoding: "zstd"}
+	if written, err := writer.Write(long); written != len(long) || err != nil {
+		t.Fatalf("Got %d, %v writing the start of the response but expected %d, nil", written, err, len(long))
+	}
+	writer.Flush()
+	if failing.flushed {
+		t.Error("Expected the response not to be flushed after the encoder failed to write it")
+	}
+	if written, err := writer.Write(long); written != 0 || err != errClientGone {
+		t.Errorf("Got %d, %v writing after a failed flush but expected 0, %v", written, err, errClientGone)
+	}
+	writer.close()
+}
+
+func TestMaxBytesHandlerEncodedBodies(t *testing.T) {
+	handler := &maxBytesHandler{maxBytes: 1024, handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		w.Write(body)
+	})}
+	encode := func(encoding string, body string) []byte {
+		var buffer bytes.Buffer
+		var writer io.WriteCloser
+		if encoding == "gzip" {
+			writer = gzip.NewWriter(&buffer)
+		} else {
+			writer, _ = zstd.NewWriter(&buffer)
+		}
+		writer.Write([]byte(body))
+		writer.Close()
+		return buffer.Bytes()
+	}
+
+	small, bomb := strings.Repeat("a", 1000), strings.Repeat("a", 1<<20)
+	tests := []struct {
+		encoding string
+		body     []byte
+		status   int
+		response string
+	}{
+		{encoding: "", body: []byte(small), status: http.StatusOK, response: small},
+		{encoding: "identity", body: []byte(small), status: http.StatusOK, response: small},
+		{encoding: "gzip", body: encode("gzip", small), status: http.StatusOK, response: small},
+		{encoding: "zstd", body: encode("zstd", small), status: http.StatusOK, response: small},
+		// both expand past the limit from well under it
+		{encoding: "gzip", body: encode("gzip", bomb), status: http.StatusBadRequest},
+		{encoding: "zstd", body: encode("zstd", bomb), status: http.StatusBadRequest},
+		{encoding: "gzip", body: []byte(small), status: http.StatusBadRequest},
+		{encoding: "zstd", body: []byte(small), status: http.StatusBadRequest},
+		{encoding: "deflate", body: []byte(small), status: http.StatusUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPatch, "/config", bytes.NewReader(test.body))
+		if test.encoding != "" {
+			request.Header.Set("Content-Encoding", test.encoding)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.status || test.status == http.StatusOK && recorder.Body.String() != test.response {
+			t.Errorf("Got status %d and %d bytes for %q but expected %d and %d bytes", recorder.Code, recorder.Body.Len(),
+				test.encoding, test.status, len(test.response))
+		}
+		if test.status == http.StatusUnsupportedMediaType && recorder.Header().Get("Accept-Encoding") != requestEncodings {
+			t.Errorf("Got Accept-Encoding %q but expected %q", recorder.Header().Get("Accept-Encoding"), requestEncodings)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var errInvalidRevision = errors.New("invalid revision")
+
+// ConfigSource is a profile's configuration as it is now, or as it was right after Revision when it's set
+type ConfigSource struct {
+	Profile  string `json:"profile"`
+	Revision int64  `json:"revision,omitempty"`
+}
+
+// ConfigDiff lists the differences turning one configuration into another. Added entries hold the values of the
+// target, removed entries the values of the source and changed entries both, the source's being the previous value.
+type ConfigDiff struct {
+	Added   []ConfigEntry  `json:"added"`
+	Removed []ConfigEntry  `json:"removed"`
+	Changed []ConfigChange `json:"changed"`
+}
+
+// mutations returns the mutations applying the diff to its source configuration
+func (d *ConfigDiff) mutations() []ConfigMutation {
+	mutations := make([]ConfigMutation, 0, len(d.Added)+len(d.Removed)+len(d.Changed))
+	for i := range d.Added {
+		mutations = append(mutations, ConfigMutation{Key: d.Added[i].Key, Value: &d.Added[i].Value, Type: d.Added[i].Type})
+	}
+	for _, change := range d.Changed {
+		mutations = append(mutations, ConfigMutation{Key: change.Key, Value: change.Value, Type: change.Type})
+	}
+	for _, entry := range d.Removed {
+		mutations = append(mutations, ConfigMutation{Key: entry.Key})
+	}
+	return mutations
+}
+
+// FindConfigAt returns the configuration of source restricted to the keys of groups, or every key when groups is
+// empty, keyed by config key. Earlier revisions are rebuilt by undoing the changes made after them, so they must still
+// be in the history.
+func FindConfigAt(ctx context.Context, repository ConfigRepository, userId int64, source ConfigSource, groups []string) (map[string]configValue, error) {
+	configuration, err := repository.FindByUserId(ctx, userId, source.Profile)
+
+	if err != nil {
+		return nil, err
+	}
+	if configuration == nil && source.Profile != DefaultProfile {
+		return nil, ErrProfileNotFound
+	}
+	values := make(map[string]configValue)
+	if configuration != nil {
+		for _, entry := range configuration.Config {
+			if inGroups(entry.Key, groups) {
+				values[entry.Key] = configValue{Type: entry.Type, Raw: entry.Value}
+			}
+		}
+	}
+	if source.Revision == 0 || configuration != nil && source.Revision == configuration.Revision {
+		return values, nil
+	}
+
+	// revision itself is included to tell apart a missing revision from one without later changes
+	revisions, err := repository.FindRevisions(ctx, userId, source.Profile, RevisionFilter{After: source.Revision - 1})
+	if err != nil {
+		return nil, err
+	}
+	if configuration == nil || len(revisions) == 0 || revisions[len(revisions)-1].Revision != source.Revision {
+		return nil, ErrRevisionNotFound
+	}
+	for _, later := range revisions[:len(revisions)-1] {
+		// revisions written after the configuration was read aren't part of it to begin with
+		if later.Revision > configuration.Revision {
+			continue
+		}
+		for _, change := range later.Changes {
+			if !inGroups(change.Key, groups) {
+				continue
+			}
+			if change.Previous == nil {
+				delete(values, change.Key)
+			} else {
+				values[change.Key] = recordedConfigValue(*change.Previous, change.PreviousType)
+			}
+		}
+	}
+	return values, nil
+}
+
+// DiffConfigs returns the differences turning the configuration of from into the one of to, restricted to groups
+func DiffConfigs(ctx context.Context, repository ConfigRepository, userId int64, from ConfigSource, to ConfigSource, groups []string) (*ConfigDiff, error) {
+	fromValues, err := FindConfigAt(ctx, repository, userId, from, groups)
+
+	if err != nil {
+		return nil, err
+	}
+	toValues, err := FindConfigAt(ctx, repository, userId, to, groups)
+	if err != nil {
+		return nil, err
+	}
+	return diffValues(fromValues, toValues), nil
+}
+
+// CopyConfig makes the configuration of profile match the one of source, restricted to the keys of groups or entirely
+// when groups is empty. Keys of the copied groups missing from source are deleted, the copy is a single revision
+// conditioned on the revision the profile was compared at so it's retried when another write gets in between.
+func CopyConfig(ctx context.Context, repository ConfigRepository, userId int64, source ConfigSource, profile string, groups []string) (*ConfigRevision, []string, error) {
+	sourceValues, err := FindConfigAt(ctx, repository, userId, source, groups)
+
+	if err != nil {
+		return nil, nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		configuration, err := repository.FindByUserId(ctx, userId, profile)
+
+		if err != nil {
+			return nil, nil, err
+		}
+		precondition := Precondition{}
+		values := make(map[string]configValue)
+		if configuration != nil {
+			precondition.Revision = &configuration.Revision
+			for _, entry := range configuration.Config {
+				if inGroups(entry.Key, groups) {
+					values[entry.Key] = configValue{Type: entry.Type, Raw: entry.Value}
+				}
+			}
+		} else if profile != DefaultProfile {
+			return nil, nil, ErrProfileNotFound
+		}
+
+		revision, failedKeys, err := repository.Apply(ctx, userId, profile, diffValues(values, sourceValues).mutations(), precondition)
+		if err == ErrPreconditionFailed && attempt < maxUpdateAttempts {
+			continue
+		}
+		return revision, failedKeys, err
+	}
+}
+
+// CloneProfile creates profile holding the configuration of source, restricted to the keys of groups or entirely when
+// groups is empty. Nothing is left behind when source can't be read or its configuration can't be written to profile,
+// so that a failed clone can be retried.
+func CloneProfile(ctx context.Context, repository ConfigRepository, userId int64, source ConfigSource, profile string, groups []string) (*ConfigRevision, []string, error) {
+	values, err := FindConfigAt(ctx, repository, userId, source, groups)
+
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = repository.CreateProfile(ctx, userId, profile); err != nil {
+		return nil, nil, err
+	}
+	revision, failedKeys, err := repository.Apply(ctx, userId, profile, diffValues(nil, values).mutations(), Precondition{Exists: true})
+
+	if err != nil {
+		// the write error is the one worth reporting, a profile that couldn't be removed is only empty
+		_ = repository.DeleteProfile(ctx, userId, profile)
+		return nil, nil, err
+	}
+	return revision, failedKeys, nil
+}
+
+// diffValues compares two configurations keyed by config key, the entries of the diff are sorted by key. Values with
+// the same text are changed when their types differ.
+func diffValues(from map[string]configValue, to map[string]configValue) *ConfigDiff {
+	diff := &ConfigDiff{
+		Added:   make([]ConfigEntry, 0),
+		Removed: make([]ConfigEntry, 0),
+		Changed: make([]ConfigChange, 0),
+	}
+	for key, value := range to {
+		previous, ok := from[key]
+		if !ok {
+			diff.Added = append(diff.Added, ConfigEntry{Key: key, Value: value.Raw, Type: value.Type})
+		} else if previous != value {
+			value, previous := value, previous
+			diff.Changed = append(diff.Changed, ConfigChange{Key: key, Value: &value.Raw, Previous: &previous.Raw, Type: value.Type, PreviousType: previous.Type})
+		}
+	}
+	for key, value := range from {
+		if _, ok := to[key]; !ok {
+			diff.Removed = append(diff.Removed, ConfigEntry{Key: key, Value: value.Raw, Type: value.Type})
+		}
+	}
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Key < diff.Added[j].Key })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Key < diff.Removed[j].Key })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Key < diff.Changed[j].Key })
+	return diff
+}
+
+// inGroups reports whether key belongs to one of groups, every key does when groups is empty
+func inGroups(key string, groups []string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		if strings.HasPrefix(key, group+".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"sort"
+)
+
+// configDocument is the configuration of a user profile as the in-memory and bolt backends keep it, entries are
+// grouped by the prefix before the first dot of their key
+type configDocument map[string]map[string]configValue
+
+// documentStore persists the config documents and revision history of the embedded backends, a document is kept per
+// user profile
+type documentStore interface {
+	// findDocument returns the profile's document along with its revision, nil when the profile doesn't exist
+	findDocument(userId int64, profile string) (configDocument, int64, error)
+	// findRevision returns the revision of the profile's document without reading it, ok is false when it's missing
+	findRevision(userId int64, profile string) (revision int64, ok bool, err error)
+	// update atomically mutates the profile's document, update receives the current revision along with the document,
+	// which is empty when missing, and returns the revision to record or nil to leave the storage untouched. An error
+	// returned by update aborts it and is passed through.
+	update(userId int64, profile string, update func(document configDocument, revision int64, exists bool) (*ConfigRevision, error)) error
+	findRevisions(userId int64, profile string, filter RevisionFilter) ([]ConfigRevision, error)
+	// listProfiles returns the user's existing profiles in any order
+	listProfiles(userId int64) ([]Profile, error)
+	// createProfile stores an empty document at revision 0 unless the user already has as many named profiles as quotas
+	// allow, the profile names given to the profile methods are valid
+	createProfile(userId int64, profile string, quotas Quotas) error
+	renameProfile(userId int64, profile string, name string) error
+	deleteProfile(userId int64, profile string) error
+}
+
+// documentConfigRepository implements ConfigRepository for stores that keep a whole configDocument per user
+type documentConfigRepository struct {
+	configWriter
+	store documentStore
+}
+
+func newDocumentConfigRepository(store documentStore, options RepositoryOptions) *documentConfigRepository {
+	repository := &documentConfigRepository{store: store}
+	repository.configWriter = configWriter{
+		apply:                repository.apply,
+		find:                 repository.FindByUserId,
+		maxConfigValueLength: options.MaxConfigValueLength,
+		quotas:               options.Quotas,
+	}
+	return repository
+}
+
+func (d configDocument) set(group string, field string, value configValue) {
+	groupMap, ok := d[group]
+	if !ok {
+		groupMap = make(map[string]configValue)
+		d[group] = groupMap
+	}
+	groupMap[field] = value
+}
+
+// clone returns a copy of the document sharing none of its maps
+func (d configDocument) clone() configDocument {
+	clone := make(configDocument, len(d))
+	for group, fields := range d {
+		clonedFields := make(map[string]configValue, len(fields))
+		for field, value := range fields {
+			clonedFields[field] = value
+		}
+		clone[group] = clonedFields
+	}
+	return clone
+}
+
+// applyMutations applies mutations like the equivalent mongodb $set and $unset would, returning the changes made
+func (d configDocument) applyMutations(mutations []preparedMutation) []ConfigChange {
+	changes := make([]ConfigChange, 0, len(mutations))
+	for _, mutation := range mutations {
+		var previous *configValue
+		if value, existed := d[mutation.Group][mutation.Field]; existed {
+			previous = &value
+		}
+		if change, ok := recordChange(mutation, previous); ok {
+			changes = append(changes, change)
+		}
+		if mutation.Delete {
+			// like $unset, an emptied group is kept around
+			delete(d[mutation.Group], mutation.Field)
+		} else {
+			d.set(mutation.Group, mutation.Field, mutation.Value)
+		}
+	}
+	return changes
+}
+
+// usage sizes up the document, the store holds it whole anyway so there are no running totals to keep
+func (d configDocument) usage(quotas Quotas) *ConfigUsage {
+	sizes := make(map[string]int64)
+	for group, fields := range d {
+		for field, value := range fields {
+			key := group + "." + field
+			sizes[key] = entrySize(key, value.Raw)
+		}
+	}
+	return sizedUsage(sizes, quotas)
+}
+
+func (d configDocument) configuration() *Configuration {
+	groupKeys := make([]string, 0, len(d))
+	for groupKey := range d {
+		groupKeys = append(groupKeys, groupKey)
+	}
+	sort.Strings(groupKeys)
+
+	entries := make([]ConfigEntry, 0)
+	for _, groupKey := range groupKeys {
+		for field, value := range d[groupKey] {
+			entries = append(entries, ConfigEntry{Key: groupKey + "." + field, Value: value.Raw, Type: value.Type})
+		}
+	}
+	return &Configuration{
+		Config: entries,
+	}
+}
+
+func (r *documentConfigRepository) FindByUserId(ctx context.Context, userId int64, profile string) (*Configuration, error) {
+	document, revision, err := r.store.findDocument(userId, profile)
+
+	if err != nil || document == nil {
+		return nil, err
+	}
+	configuration := document.configuration()
+	configuration.Revision = revision
+	return configuration, nil
+}
+
+func (r *documentConfigRepository) FindKey(ctx context.Context, userId int64, profile string, key string) (*ConfigEntry, error) {
+	group, field, ok := configPath(key)
+	if !ok {
+		return nil, nil
+	}
+	// the embedded stores keep whole documents, so there's nothing to project
+	document, _, err := r.store.findDocument(userId, profile)
+
+	if err != nil {
+		return nil, err
+	}
+	value, ok := document[group][field]
+	if !ok {
+		return nil, nil
+	}
+	return &ConfigEntry{Key: group + "." + field, Value: value.Raw, Type: value.Type}, nil
+}
+
+func (r *documentConfigRepository) FindGroup(ctx context.Context, userId int64, profile string, group string) (*Configuration, error) {
+	document, revision, err := r.store.findDocument(userId, profile)
+
+	if err != nil || document == nil {
+		return nil, err
+	}
+	entries := make([]ConfigEntry, 0, len(document[group]))
+	for field, value := range document[group] {
+		entries = append(entries, ConfigEntry{Key: group + "." + field, Value: value.Raw, Type: value.Type})
+	}
+	return &Configuration{Config: entries, Revision: revision}, nil
+}
+
+func (r *documentConfigRepository) FindCurrentRevision(ctx context.Context, userId int64, profile string) (int64, bool, error) {
+	return r.store.findRevision(userId, profile)
+}
+
+func (r *documentConfigRepository) FindRevisions(ctx context.Context, userId int64, profile string, filter RevisionFilter) ([]ConfigRevision, error) {
+	return r.store.findRevisions(userId, profile, filter)
+}
+
+func (r *documentConfigRepository) ListProfiles(ctx context.Context, userId int64) ([]Profile, error) {
+	profiles, err := r.store.listProfiles(userId)
+
+	if err != nil {
+		return nil, err
+	}
+	return withDefaultProfile(profiles), nil
+}
+
+func (r *documentConfigRepository) CreateProfile(ctx context.Context, userId int64, profile string) error {
+	if err := validateProfile(profile); err != nil {
+		return err
+	}
+	return r.store.createProfile(userId, profile, r.quotas)
+}
+
+func (r *documentConfigRepository) RenameProfile(ctx context.Context, userId int64, profile string, name string) error {
+	if err := validateExistingProfile(profile); err != nil {
+		return err
+	}
+	if err := validateProfile(name); err != nil {
+		return err
+	}
+	return r.store.renameProfile(userId, profile, name)
+}
+
+func (r *documentConfigRepository) DeleteProfile(ctx context.Context, userId int64, profile string) error {
+	if err := validateExistingProfile(profile); err != nil {
+		return err
+	}
+	return r.store.deleteProfile(userId, profile)
+}
+
+func (r *documentConfigRepository) apply(ctx context.Context, userId int64, profile string, mutations []preparedMutation, precondition Precondition) (*ConfigRevision, error) {
+	var applied *ConfigRevision
+	err := r.store.update(userId, profile, func(document configDocument, revision int64, exists bool) (*ConfigRevision, error) {
+		if !precondition.holds(exists, revision) {
+			return nil, ErrPreconditionFailed
+		}
+		var usage *ConfigUsage
+		if r.quotas.enabled() {
+			usage = document.usage(r.quotas)
+		}
+		changes := document.applyMutations(mutations)
+
+		if usage != nil {
+			if err := r.quotas.check(usage, usage.withChanges(changes)); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(changes) == 0 {
+			if exists {
+				applied = &ConfigRevision{Revision: revision, Changes: changes}
+			}
+			return nil, nil
+		}
+		applied = newRevision(revision+1, changes)
+		return applied, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// filterRevisions applies filter to revisions sorted oldest first, returning the matches newest first
+func filterRevisions(revisions []ConfigRevision, filter RevisionFilter) []ConfigRevision {
+	filtered := make([]ConfigRevision, 0)
+	for i := len(revisions) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(filtered) == filter.Limit {
+			break
+		}
+		revision := revisions[i]
+		if revision.Revision <= filter.After {
+			break
+		}
+		if filter.Before > 0 && revision.Revision >= filter.Before {
+			continue
+		}
+		filtered = append(filtered, revision)
+	}
+	return filtered
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+var errUnknownEncryptionKey = errors.New("value is encrypted with an unknown key")
+var errInvalidEnvelope = errors.New("invalid encrypted value")
+
+// EncryptionKey is a key encryption key, configured as its id and the base64 of its 32 bytes separated by a colon.
+// The id is stored along with every value the key encrypts, so it must never be reused for another key.
+type EncryptionKey struct {
+	Id  string
+	Key []byte
+}
+
+func (k *EncryptionKey) UnmarshalText(text []byte) error {
+	parts := strings.SplitN(strings.TrimSpace(string(text)), ":", 2)
+	if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 255 {
+		return errors.New("encryption keys must be configured as id:base64")
+	}
+	key, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(key) != 32 {
+		return errors.New("encryption key " + parts[0] + " must be 32 base64 encoded bytes")
+	}
+	k.Id, k.Key = parts[0], key
+	return nil
+}
+
+// EncryptionOptions configure the envelope encryption of sensitive values at rest, it's enabled by configuring keys.
+// Values of keys matching one of Patterns are encrypted with a data key of their own, which is stored wrapped by the
+// first of Keys. The other keys only decrypt values written before they were rotated out, see ValueReencrypter.
+type EncryptionOptions struct {
+	Keys []EncryptionKey `env:"ENCRYPTION_KEYS"`
+	// Patterns match config keys ignoring case, * matching any run of characters
+	Patterns []string `env:"ENCRYPTED_KEY_PATTERNS" envDefault:"*webhook*,*token*"`
+}
+
+// ValueReencrypter is implemented by the repositories encrypting values at rest
+type ValueReencrypter interface {
+	// ReencryptValues rewrites the stored values and revisions whose encryption doesn't match the current options:
+	// those encrypted with a key other than the first, and those of keys that stopped or started matching the patterns.
+	// Values are left as they are, so no revision is recorded. It returns the number of values and revisions rewritten.
+	ReencryptValues(ctx context.Context) (int, error)
+}
+
+// encrypts reports whether the values of key are encrypted
+func (o EncryptionOptions) encrypts(key string) bool {
+	if len(o.Keys) == 0 {
+		return false
+	}
+	key = strings.ToLower(key)
+	for _, pattern := range o.Patterns {
+		if matchKeyPattern(strings.ToLower(pattern), key) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchKeyPattern reports whether text matches pattern, in which * matches any run of characters
+func matchKeyPattern(pattern string, text string) bool {
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(text, parts[0]) {
+		return false
+	}
+	text = text[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if i == len(parts)-2 {
+			return strings.HasSuffix(text, part)
+		}
+		index := strings.Index(text, part)
+		if index < 0 {
+			return false
+		}
+		text = text[index+len(part):]
+	}
+	return text == ""
+}
+
+// envelopeVersion is the first byte of every envelope, followed by its flags, the length of the key id, the key id,
+// the wrapped data key and the encrypted text. The data key and the text are each sealed with AES-256-GCM behind a
+// nonce of their own, the text additionally authenticates the config key so envelopes can't be swapped between keys.
+const envelopeVersion = 1
+
+// envelopeCompressed is set in the flags of envelopes whose text was compressed before it was encrypted
+const envelopeCompressed = 1
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// gcmSeal appends the nonce and the sealed plaintext to dst
+func gcmSeal(dst []byte, key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(append(dst, nonce...), nonce, plaintext, additionalData), nil
+}
+
+// gcmOpen opens the nonce and sealed text gcmSeal appended
+func gcmOpen(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errInvalidEnvelope
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
+
+// wrappedDataKeyLength is the length of a data key sealed by gcmSeal, its nonce, the key and the tag
+const wrappedDataKeyLength = 12 + 32 + 16
+
+// seal encrypts the text of key's value with a new data key wrapped by the first key
+func (o EncryptionOptions) seal(key string, text []byte, flags byte) ([]byte, error) {
+	if len(o.Keys) == 0 {
+		return nil, errUnknownEncryptionKey
+	}
+	active := o.Keys[0]
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	envelope := append([]byte{envelopeVersion, flags, byte(len(active.Id))}, active.Id...)
+	envelope, err := gcmSeal(envelope, active.Key, dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	return gcmSeal(envelope, dataKey, text, []byte(key))
+}
+
+// open decrypts the text of key's value sealed in envelope, returning it along with the envelope's flags
+func (o EncryptionOptions) open(key string, envelope []byte) ([]byte, byte, error) {
+	id, ok := envelopeKeyId(envelope)
+	if !ok {
+		return nil, 0, errInvalidEnvelope
+	}
+	var keyEncryptionKey []byte
+	for _, candidate := range o.Keys {
+		if candidate.Id == id {
+			keyEncryptionKey = candidate.Key
+			break
+		}
+	}
+	if keyEncryptionKey == nil {
+		return nil, 0, errUnknownEncryptionKey
+	}
+	wrapped := envelope[3+len(id):]
+	if len(wrapped) < wrappedDataKeyLength {
+		return nil, 0, errInvalidEnvelope
+	}
+	dataKey, err := gcmOpen(keyEncryptionKey, wrapped[:wrappedDataKeyLength], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	text, err := gcmOpen(dataKey, wrapped[wrappedDataKeyLength:], []byte(key))
+	return text, envelope[1], err
+}
+
+// envelopeKeyId returns the id of the key that wrapped an envelope's data key
+func envelopeKeyId(envelope []byte) (string, bool) {
+	if len(envelope) < 3 || envelope[0] != envelopeVersion || len(envelope) < 3+int(envelope[2]) {
+		return "", false
+	}
+	return string(envelope[3 : 3+int(envelope[2])]), true
+}
+
+// valueCodec encodes values the way they're stored at rest, compressing long ones and encrypting those of sensitive
+// keys. Encrypted values are compressed before they're encrypted.
+type valueCodec struct {
+	compression valueCompression
+	encryption  EncryptionOptions
+}
+
+func newValueCodec(options RepositoryOptions) valueCodec {
+	return valueCodec{
+		compression: valueCompression{threshold: options.CompressionThreshold},
+		encryption:  options.Encryption,
+	}
+}
+
+// storedValue is the text of a value as it's stored, as is, compressed or encrypted. Only one of its fields is set.
+type storedValue struct {
+	Raw        string
+	Compressed []byte
+	Encrypted  []byte
+}
+
+func (c valueCodec) encode(key string, value configValue) (storedValue, error) {
+	compressed := c.compression.compress(value)
+	if !c.encryption.encrypts(key) {
+		if compressed != nil {
+			return storedValue{Compressed: compressed}, nil
+		}
+		return storedValue{Raw: value.Raw}, nil
+	}
+	text, flags := []byte(value.Raw), byte(0)
+	if compressed != nil {
+		text, flags = compressed, envelopeCompressed
+	}
+	encrypted, err := c.encryption.seal(key, text, flags)
+	return storedValue{Encrypted: encrypted}, err
+}
+
+// decode returns the text of key's stored value
+func (c valueCodec) decode(key string, stored storedValue) (string, error) {
+	if stored.Encrypted != nil {
+		text, flags, err := c.encryption.open(key, stored.Encrypted)
+		if err != nil || flags&envelopeCompressed == 0 {
+			return string(text), err
+		}
+		return decompressValue(text)
+	}
+	if stored.Compressed != nil {
+		return decompressValue(stored.Compressed)
+	}
+	return stored.Raw, nil
+}
+
+// stale reports whether key's stored value has to be re-encrypted to match the encryption options
+func (c valueCodec) stale(key string, stored storedValue) bool {
+	if stored.Encrypted == nil {
+		return c.encryption.encrypts(key)
+	}
+	id, _ := envelopeKeyId(stored.Encrypted)
+	return !c.encryption.encrypts(key) || id != c.encryption.Keys[0].Id
+}
+
+// reencode decodes key's stored value and encodes it again with the current options
+func (c valueCodec) reencode(key string, valueType ValueType, stored storedValue) (storedValue, error) {
+	raw, err := c.decode(key, stored)
+	if err != nil {
+		return storedValue{}, err
+	}
+	return c.encode(key, configValue{Type: valueType, Raw: raw})
+}
+
+// sealChanges returns changes as they're recorded in the history, the values of encrypted keys sealed as base64
+// envelopes
+func (c valueCodec) sealChanges(changes []ConfigChange) ([]ConfigChange, error) {
+	sealed := make([]ConfigChange, len(changes))
+	for i, change := range changes {
+		sealed[i] = change
+		if !c.encryption.encrypts(change.Key) {
+			continue
+		}
+		for _, value := range []**string{&sealed[i].Value, &sealed[i].Previous} {
+			if *value == nil {
+				continue
+			}
+			envelope, err := c.encryption.seal(change.Key, []byte(**value), 0)
+			if err != nil {
+				return nil, err
+			}
+			text := base64.StdEncoding.EncodeToString(envelope)
+			*value = &text
+		}
+		sealed[i].Sealed = true
+	}
+	return sealed, nil
+}
+
+// openChanges opens the values of changes read from the history in place
+func (c valueCodec) openChanges(changes []ConfigChange) error {
+	for i := range changes {
+		if !changes[i].Sealed {
+			continue
+		}
+		for _, value := range []**string{&changes[i].Value, &changes[i].Previous} {
+			if *value == nil {
+				continue
+			}
+			envelope, err := base64.StdEncoding.DecodeString(**value)
+			if err != nil {
+				return errInvalidEnvelope
+			}
+			text, _, err := c.encryption.open(changes[i].Key, envelope)
+			if err != nil {
+				return err
+			}
+			opened := string(text)
+			*value = &opened
+		}
+		changes[i].Sealed = false
+	}
+	return nil
+}
+
+// staleChanges reports whether changes read from the history have to be sealed again to match the encryption options
+func (c valueCodec) staleChanges(changes []ConfigChange) bool {
+	for _, change := range changes {
+		if change.Sealed != c.encryption.encrypts(change.Key) {
+			return true
+		}
+		if !change.Sealed {
+			continue
+		}
+		for _, value := range []*string{change.Value, change.Previous} {
+			if value == nil {
+				continue
+			}
+			envelope, _ := base64.StdEncoding.DecodeString(*value)
+			if id, _ := envelopeKeyId(envelope); id != c.encryption.Keys[0].Id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resealChanges opens changes read from the history and seals them again with the current options
+func (c valueCodec) resealChanges(changes []ConfigChange) ([]ConfigChange, error) {
+	opened := make([]ConfigChange, len(changes))
+	copy(opened, changes)
+	if err := c.openChanges(opened); err != nil {
+		return nil, err
+	}
+	return c.sealChanges(opened)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestEncryptionKeyUnmarshalText(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	tests := []struct {
+		text  string
+		valid bool
+	}{
+		{text: "2022-06:" + encoded, valid: true},
+		{text: " 2022-06:" + encoded + " ", valid: true},
+		{text: encoded},
+		{text: ":" + encoded},
+		{text: "2022-06:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 16))},
+		{text: "2022-06:not base64"},
+	}
+	for _, test := range tests {
+		var key EncryptionKey
+		err := key.UnmarshalText([]byte(test.text))
+		if (err == nil) != test.valid {
+			t.Errorf("Got error %v for %q but expected it to be valid %v", err, test.text, test.valid)
+		}
+		if err == nil && (key.Id != "2022-06" || !bytes.Equal(key.Key, bytes.Repeat([]byte{7}, 32))) {
+			t.Errorf("Got key %v for %q", key, test.text)
+		}
+	}
+}
+
+func TestEncryptsKeys(t *testing.T) {
+	options := EncryptionOptions{Keys: []EncryptionKey{contractEncryptionKey}, Patterns: []string{"*webhook*", "*TOKEN", "runelite.*.secret", "exact"}}
+	tests := []struct {
+		key       string
+		encrypted bool
+	}{
+		{key: "discord.webhookUrl", encrypted: true},
+		{key: "discord.WebHook", encrypted: true},
+		{key: "raids.apiToken", encrypted: true},
+		{key: "raids.apiTokenExpiry"},
+		{key: "runelite.plugin.secret", encrypted: true},
+		{key: "runelite.secret"},
+		{key: "exact", encrypted: true},
+		{key: "exactly"},
+		{key: "runelite.theme"},
+	}
+	for _, test := range tests {
+		if encrypted := options.encrypts(test.key); encrypted != test.encrypted {
+			t.Errorf("Got encrypted %v for %s but expected %v", encrypted, test.key, test.encrypted)
+		}
+	}
+	options.Keys = nil
+	if options.encrypts("discord.webhookUrl") {
+		t.Errorf("Encrypted values without keys")
+	}
+}
+
+func TestValueCodecEncryption(t *testing.T) {
+	old := valueCodec{encryption: contractOptions.Encryption}
+	codec := valueCodec{
+		compression: valueCompression{threshold: 64},
+		encryption: EncryptionOptions{
+			Keys:     []EncryptionKey{{Id: "contract-2", Key: bytes.Repeat([]byte{2}, 32)}, contractEncryptionKey},
+			Patterns: contractOptions.Encryption.Patterns,
+		},
+	}
+	values := []configValue{
+		{Type: ValueString, Raw: "https://discord.com/api/webhooks/1/secret"},
+		{Type: ValueString, Raw: strings.Repeat("https://discord.com/api/webhooks/1/secret,", 10)},
+		{Type: ValueString, Raw: ""},
+	}
+	for _, value := range values {
+		stored, err := codec.encode("discord.webhookUrl", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Encrypted == nil || stored.Raw != "" || stored.Compressed != nil || bytes.Contains(stored.Encrypted, []byte("secret")) {
+			t.Errorf("Got stored value %v but expected it encrypted", stored)
+		}
+		if raw, err := codec.decode("discord.webhookUrl", stored); err != nil || raw != value.Raw {
+			t.Errorf("Got decoded %q, %v but expected %q", raw, err, value.Raw)
+		}
+		if _, err := codec.decode("discord.otherWebhook", stored); err == nil {
+			t.Errorf("Decoded a value encrypted for another key")
+		}
+		if _, err := old.decode("discord.webhookUrl", stored); err != errUnknownEncryptionKey {
+			t.Errorf("Got error %v decoding with the retired keys only but expected %v", err, errUnknownEncryptionKey)
+		}
+		if codec.stale("discord.webhookUrl", stored) {
+			t.Errorf("Got a value encrypted with the active key stale")
+		}
+	}
+
+	// values encrypted before a rotation are read with the retired key until they're re-encrypted
+	stored, err := old.encode("discord.webhookUrl", values[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, err := codec.decode("discord.webhookUrl", stored); err != nil || raw != values[0].Raw {
+		t.Errorf("Got decoded %q, %v but expected %q", raw, err, values[0].Raw)
+	}
+	if !codec.stale("discord.webhookUrl", stored) || !codec.stale("runelite.theme", stored) {
+		t.Errorf("Expected a value encrypted with a retired key to be stale")
+	}
+	if !codec.stale("discord.webhookUrl", storedValue{Raw: values[0].Raw}) || codec.stale("runelite.theme", storedValue{Raw: "dark mode"}) {
+		t.Errorf("Expected only plain values of encrypted keys to be stale")
+	}
+	if _, err = codec.decode("discord.webhookUrl", storedValue{Encrypted: []byte{envelopeVersion, 0, 10, 'a'}}); err != errInvalidEnvelope {
+		t.Errorf("Got error %v for a truncated envelope but expected %v", err, errInvalidEnvelope)
+	}
+}
+
+func TestSealChanges(t *testing.T) {
+	secret, previous, theme := "https://discord.com/api/webhooks/2/secret", "https://discord.com/api/webhooks/1/secret", "dark mode"
+	changes := []ConfigChange{
+		{Key: "discord.webhookUrl", Value: &secret, Previous: &previous},
+		{Key: "raids.apiToken"},
+		{Key: "runelite.theme", Value: &theme},
+	}
+	codec := valueCodec{encryption: contractOptions.Encryption}
+	sealed, err := codec.sealChanges(changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sealed[0].Sealed || *sealed[0].Value == secret || *sealed[0].Previous == previous || !sealed[1].Sealed || sealed[1].Value != nil {
+		t.Errorf("Got changes %v but expected the encrypted keys sealed", sealed)
+	}
+	if sealed[2].Sealed || *sealed[2].Value != theme || *changes[0].Value != secret {
+		t.Errorf("Got changes %v but expected the others left as they were", sealed)
+	}
+	if codec.staleChanges(sealed) {
+		t.Errorf("Got changes sealed with the active key stale")
+	}
+	rotated := valueCodec{encryption: EncryptionOptions{Keys: []EncryptionKey{{Id: "contract-2", Key: bytes.Repeat([]byte{2}, 32)}, contractEncryptionKey}, Patterns: []string{"*webhook*"}}}
+	if !rotated.staleChanges(sealed) || !rotated.staleChanges(sealed[1:2]) || rotated.staleChanges(sealed[2:]) {
+		t.Errorf("Expected changes sealed with a retired key or of keys no longer encrypted to be stale")
+	}
+
+	if err = rotated.openChanges(sealed); err != nil {
+		t.Fatal(err)
+	}
+	for i, change := range sealed {
+		if change.Sealed || !equalStrings(change.Value, changes[i].Value) || !equalStrings(change.Previous, changes[i].Previous) {
+			t.Errorf("Got opened change %v but expected %v", change, changes[i])
+		}
+	}
+}
+
+func equalStrings(a *string, b *string) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
@@ -3,14 +3,18 @@ module github.com/runelite/config-server
 go 1.17
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/caarlos0/env/v6 v6.9.1
 	github.com/dgraph-io/ristretto v0.1.0
 	github.com/go-sql-driver/mysql v1.6.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/klauspost/compress v1.13.6
 	github.com/newrelic/go-agent v3.15.2+incompatible
 	github.com/newrelic/go-agent/v3 v3.15.2
 	github.com/newrelic/go-agent/v3/integrations/nrhttprouter v1.0.1
 	github.com/newrelic/go-agent/v3/integrations/nrmongo v1.0.2
+	go.etcd.io/bbolt v1.3.6
 	go.mongodb.org/mongo-driver v1.8.4
 	go.uber.org/zap v1.21.0
 )
@@ -22,7 +26,6 @@ require (
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
 	github.com/golang/protobuf v1.3.3 // indirect
 	github.com/golang/snappy v0.0.1 // indirect
-	github.com/klauspost/compress v1.13.6 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
 	github.com/xdg-go/scram v1.0.2 // indirect
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// ConfigGroup is a group of config keys, the keys sharing the prefix before their first dot
+type ConfigGroup struct {
+	Name string `json:"name"`
+	Keys int    `json:"keys"`
+}
+
+// configGroup returns the group key is stored under
+func configGroup(key string) string {
+	return strings.SplitN(key, ".", 2)[0]
+}
+
+// ListGroups returns the groups of the profile's configuration sorted by name, nil when the profile has no
+// configuration
+func ListGroups(ctx context.Context, repository ConfigRepository, userId int64, profile string) ([]ConfigGroup, error) {
+	configuration, err := repository.FindByUserId(ctx, userId, profile)
+
+	if err != nil || configuration == nil {
+		return nil, err
+	}
+	keys := make(map[string]int)
+	for _, entry := range configuration.Config {
+		keys[configGroup(entry.Key)]++
+	}
+	groups := make([]ConfigGroup, 0, len(keys))
+	for name, count := range keys {
+		groups = append(groups, ConfigGroup{Name: name, Keys: count})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+// DeleteGroup deletes every key of a group as a single revision. The write is conditioned on the revision the keys were
+// read at, it's retried when another write gets in between unless precondition already requires a revision, and
+// errTooManyConflicts is returned once it gave up.
+func DeleteGroup(ctx context.Context, repository ConfigRepository, userId int64, profile string, group string, precondition Precondition) (*ConfigRevision, []string, error) {
+	for attempt := 1; ; attempt++ {
+		configuration, err := repository.FindGroup(ctx, userId, profile, group)
+
+		if err != nil {
+			return nil, nil, err
+		}
+		if configuration == nil {
+			if !precondition.holds(false, 0) {
+				return nil, nil, ErrPreconditionFailed
+			}
+			return nil, make([]string, 0), nil
+		}
+		if !precondition.holds(true, configuration.Revision) {
+			return nil, nil, ErrPreconditionFailed
+		}
+		if len(configuration.Config) == 0 {
+			return &ConfigRevision{Revision: configuration.Revision, Changes: make([]ConfigChange, 0)}, make([]string, 0), nil
+		}
+
+		mutations := make([]ConfigMutation, len(configuration.Config))
+		for i, entry := range configuration.Config {
+			mutations[i] = ConfigMutation{Key: entry.Key}
+		}
+		revision, failedKeys, err := repository.Apply(ctx, userId, profile, mutations, Precondition{Revision: &configuration.Revision})
+		if err == ErrPreconditionFailed && precondition.Revision == nil {
+			if attempt < maxUpdateAttempts {
+				continue
+			}
+			err = errTooManyConflicts
+		}
+		return revision, failedKeys, err
+	}
+}
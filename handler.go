@@ -5,7 +5,12 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"go.uber.org/zap"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type AuthorizedHttpHandle func(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params)
@@ -13,17 +18,34 @@ type AuthorizedHttpHandle func(userId int64, writer http.ResponseWriter, request
 type Handlers struct {
 	logger     *zap.Logger
 	repository ConfigRepository
+	broker     ChangeBroker
 }
 
-func NewHandlers(logger *zap.Logger, repository ConfigRepository) *Handlers {
+func NewHandlers(logger *zap.Logger, repository ConfigRepository, broker ChangeBroker) *Handlers {
 	return &Handlers{
 		logger:     logger,
 		repository: repository,
+		broker:     broker,
 	}
 }
 
 func (h *Handlers) HandleGet(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
-	configuration, err := h.repository.FindByUserId(request.Context(), userId)
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		// checking the revision first spares loading and serializing configurations the client already has
+		revision, ok, err := h.repository.FindCurrentRevision(request.Context(), userId, profileParam(params))
+
+		if err != nil {
+			http.Error(writer, "Internal server error", http.StatusInternalServerError)
+			h.logger.Error("Error fetching config revision", zap.Error(err))
+			return
+		}
+		if etag := matchingETag(ifNoneMatch, revision); ok && etag != "" {
+			writer.Header().Set("ETag", etag)
+			writer.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	configuration, err := h.repository.FindByUserId(request.Context(), userId, profileParam(params))
 
 	if configuration == nil {
 		if err == nil {
@@ -35,6 +57,10 @@ func (h *Handlers) HandleGet(userId int64, writer http.ResponseWriter, request *
 			return
 		}
 	} else {
+		if !typedValues(request) {
+			withoutTypes(configuration.Config)
+		}
+		writer.Header().Set("ETag", revisionETag(configuration.Revision))
 		err = json.NewEncoder(writer).Encode(configuration)
 
 		if err != nil {
@@ -44,6 +70,32 @@ func (h *Handlers) HandleGet(userId int64, writer http.ResponseWriter, request *
 	}
 }
 
+func (h *Handlers) HandleGetKey(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	entry, err := h.repository.FindKey(request.Context(), userId, profileParam(params), params.ByName("key"))
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error fetching config entry", zap.Error(err))
+		return
+	}
+	if entry == nil {
+		http.NotFound(writer, request)
+		return
+	}
+	if typedValues(request) {
+		writer.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(writer).Encode(entry); err != nil {
+			h.logger.Debug("Failed to write config entry", zap.Error(err))
+		}
+		return
+	}
+	// the value is returned as is, like the body of PUT /config/:key
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err = writer.Write([]byte(entry.Value)); err != nil {
+		h.logger.Debug("Failed to write config entry", zap.Error(err))
+	}
+}
+
 func (h *Handlers) HandlePut(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
 	key := params.ByName("key")
 	value, err := ioutil.ReadAll(request.Body)
@@ -53,31 +105,113 @@ func (h *Handlers) HandlePut(userId int64, writer http.ResponseWriter, request *
 		h.logger.Error("Failed to read request body", zap.Error(err))
 		return
 	}
-	err = h.repository.Save(request.Context(), userId, &ConfigEntry{
-		Key:   key,
-		Value: string(value),
-	})
+	entry := string(value)
+	mutation := ConfigMutation{Key: key, Value: &entry, Type: ValueType(request.URL.Query().Get("type"))}
+	revision, failedKeys, err := h.repository.Apply(request.Context(), userId, profileParam(params), []ConfigMutation{mutation}, writePrecondition(request, params))
 
-	if err != nil {
+	if err == nil && len(failedKeys) > 0 {
+		// the value is too long or doesn't hold its type
+		http.Error(writer, "Invalid config entry", http.StatusBadRequest)
+	} else if err == ErrPreconditionFailed {
+		writePreconditionFailed(writer, request)
+	} else if writeQuotaExceeded(writer, err) {
+		return
+	} else if err != nil {
 		http.Error(writer, "Update failed", http.StatusInternalServerError)
 		h.logger.Error("Failed to update config entry", zap.Error(err))
+	} else {
+		setRevisionETag(writer, revision)
 	}
 }
 
+// patchEntry is an entry of a PATCH body. A null value deletes the key, entries without a value still set it empty
+// like they did before deletions were supported.
+type patchEntry struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	Type  ValueType       `json:"type"`
+}
+
+// patchMutations turns the entries of a PATCH body into mutations, entries whose value isn't a string or null are
+// returned as failed keys
+func patchMutations(entries []patchEntry) ([]ConfigMutation, []string) {
+	mutations := make([]ConfigMutation, 0, len(entries))
+	failedKeys := make([]string, 0)
+	for _, entry := range entries {
+		mutation := ConfigMutation{Key: entry.Key, Value: new(string), Type: entry.Type}
+
+		if string(entry.Value) == "null" {
+			mutation.Value = nil
+		} else if len(entry.Value) > 0 && json.Unmarshal(entry.Value, mutation.Value) != nil {
+			failedKeys = append(failedKeys, entry.Key)
+			continue
+		}
+		mutations = append(mutations, mutation)
+	}
+	return mutations, failedKeys
+}
+
 func (h *Handlers) HandlePatch(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
-	var configuration Configuration
-	err := json.NewDecoder(request.Body).Decode(&configuration)
+	// anything but the standard patch formats is the Configuration payload clients have always sent
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if mediaType == "application/merge-patch+json" || mediaType == "application/json-patch+json" {
+		h.handleStandardPatch(userId, writer, request, params, mediaType)
+		return
+	}
+
+	var patch struct {
+		Config []patchEntry `json:"config"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&patch)
 
 	if err != nil {
 		http.Error(writer, "Invalid request body", http.StatusBadRequest)
 		h.logger.Error("Error decoding configuration json", zap.Error(err))
 		return
 	}
-	failedKeys, err := h.repository.SaveBatch(request.Context(), userId, &configuration)
+	mutations, invalidKeys := patchMutations(patch.Config)
+	h.applyBatch(userId, writer, request, params, mutations, invalidKeys)
+}
+
+// handleStandardPatch applies a JSON Merge Patch or JSON Patch body, see patch.go for the document they operate on
+func (h *Handlers) handleStandardPatch(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params, mediaType string) {
+	body, err := ioutil.ReadAll(request.Body)
 
 	if err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	patch := MergePatchConfig
+	if mediaType == "application/json-patch+json" {
+		patch = JsonPatchConfig
+	}
+	revision, failedKeys, err := patch(request.Context(), h.repository, userId, profileParam(params), body, writePrecondition(request, params))
+
+	if writeQuotaExceeded(writer, err) {
+		return
+	}
+	switch err {
+	case nil:
+	case ErrInvalidPatch:
+		http.Error(writer, "Invalid patch", http.StatusBadRequest)
+		return
+	case ErrPatchConflict:
+		http.Error(writer, "Patch conflicts with the configuration", http.StatusConflict)
+		return
+	case ErrPreconditionFailed:
+		writePreconditionFailed(writer, request)
+		return
+	case errTooManyConflicts:
+		http.Error(writer, "Too many concurrent updates", http.StatusConflict)
+		return
+	default:
 		http.Error(writer, "Update failed", http.StatusInternalServerError)
-		h.logger.Error("Failed to batch update config entries", zap.Error(err))
+		h.logger.Error("Failed to patch config", zap.Error(err))
+		return
+	}
+	setRevisionETag(writer, revision)
+	if failedKeys == nil {
+		failedKeys = make([]string, 0)
 	}
 	err = json.NewEncoder(writer).Encode(failedKeys)
 
@@ -87,12 +221,699 @@ func (h *Handlers) HandlePatch(userId int64, writer http.ResponseWriter, request
 	}
 }
 
+// HandleBulkDelete deletes every key listed in the body as a single revision
+func (h *Handlers) HandleBulkDelete(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var keys []string
+	err := json.NewDecoder(request.Body).Decode(&keys)
+
+	if err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	mutations := make([]ConfigMutation, len(keys))
+	for i, key := range keys {
+		mutations[i] = ConfigMutation{Key: key}
+	}
+	h.applyBatch(userId, writer, request, params, mutations, nil)
+}
+
+// applyBatch applies mutations as a single revision and answers with the keys that couldn't be applied, including
+// invalidKeys rejected before reaching the repository
+func (h *Handlers) applyBatch(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params, mutations []ConfigMutation, invalidKeys []string) {
+	revision, failedKeys, err := h.repository.Apply(request.Context(), userId, profileParam(params), mutations, writePrecondition(request, params))
+
+	if err == ErrPreconditionFailed {
+		writePreconditionFailed(writer, request)
+		return
+	} else if writeQuotaExceeded(writer, err) {
+		return
+	} else if err != nil {
+		http.Error(writer, "Update failed", http.StatusInternalServerError)
+		h.logger.Error("Failed to batch update config entries", zap.Error(err))
+	} else {
+		setRevisionETag(writer, revision)
+	}
+	if failedKeys == nil {
+		failedKeys = make([]string, 0)
+	}
+	err = json.NewEncoder(writer).Encode(append(invalidKeys, failedKeys...))
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error serializing response", zap.Error(err))
+	}
+}
+
 func (h *Handlers) HandleDelete(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
 	key := params.ByName("key")
-	err := h.repository.DeleteKey(request.Context(), userId, key)
+	revision, failedKeys, err := h.repository.Apply(request.Context(), userId, profileParam(params), []ConfigMutation{{Key: key}}, writePrecondition(request, params))
 
-	if err != nil {
+	if err == nil && len(failedKeys) > 0 {
+		err = errInvalidConfigEntry
+	}
+	if err == ErrPreconditionFailed {
+		writePreconditionFailed(writer, request)
+	} else if err != nil {
 		http.Error(writer, "Delete failed", http.StatusInternalServerError)
 		h.logger.Error("Error deleting config entry", zap.Error(err))
+	} else {
+		setRevisionETag(writer, revision)
+	}
+}
+
+// revisionETag formats a configuration revision as a strong entity tag, every change bumps the revision so the tag
+// identifies the exact configuration. Compressed responses suffix it with their encoding, see encodedETag.
+func revisionETag(revision int64) string {
+	return "\"" + strconv.FormatInt(revision, 10) + "\""
+}
+
+func setRevisionETag(writer http.ResponseWriter, revision *ConfigRevision) {
+	if revision != nil {
+		writer.Header().Set("ETag", revisionETag(revision.Revision))
+	}
+}
+
+// parseRevisionETag reads the revision of an entity tag revisionETag formatted, whichever encoding suffixes it. Weak
+// entity tags are only read when weak is set.
+func parseRevisionETag(etag string, weak bool) (int64, bool) {
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+	if len(etag) < 3 || !strings.HasPrefix(etag, "\"") || !strings.HasSuffix(etag, "\"") {
+		return 0, false
+	}
+	etag = etag[1 : len(etag)-1]
+	for _, encoding := range responseEncodings {
+		if strings.HasSuffix(etag, "-"+encoding) {
+			etag = strings.TrimSuffix(etag, "-"+encoding)
+			break
+		}
+	}
+	revision, err := strconv.ParseInt(etag, 10, 64)
+	return revision, err == nil && revision >= 0
+}
+
+// matchingETag weakly compares the entity tags of an If-None-Match header, which may list several of them or be "*",
+// against the tags of a revision in any encoding. It returns the strong tag of the one that matched, "" when none did.
+func matchingETag(header string, revision int64) string {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return revisionETag(revision)
+		}
+		if parsed, ok := parseRevisionETag(candidate, true); ok && parsed == revision {
+			return strings.TrimPrefix(candidate, "W/")
+		}
+	}
+	return ""
+}
+
+// profileParam is the profile a route is scoped to, the routes predating profiles use the default profile
+func profileParam(params httprouter.Params) string {
+	if profile := params.ByName("profile"); profile != "" {
+		return profile
+	}
+	return DefaultProfile
+}
+
+// writePrecondition is the precondition of a write to the config of a profile, named profiles are never created
+// implicitly so writes to them always require the profile to exist
+func writePrecondition(request *http.Request, params httprouter.Params) Precondition {
+	precondition := parsePrecondition(request)
+	if profileParam(params) != DefaultProfile {
+		precondition.Exists = true
+	}
+	return precondition
+}
+
+// writePreconditionFailed answers a write whose precondition didn't hold, without an If-Match header that means the
+// named profile it was written to doesn't exist
+func writePreconditionFailed(writer http.ResponseWriter, request *http.Request) {
+	if request.Header.Get("If-Match") == "" {
+		http.Error(writer, "Profile not found", http.StatusNotFound)
+	} else {
+		http.Error(writer, "Precondition failed", http.StatusPreconditionFailed)
+	}
+}
+
+// writeQuotaExceeded answers a write a quota rejected with 413 Payload Too Large naming the quota, it reports whether
+// err was a *QuotaError or ErrConfigTooLarge
+func writeQuotaExceeded(writer http.ResponseWriter, err error) bool {
+	if quotaErr, ok := err.(*QuotaError); ok {
+		http.Error(writer, "Quota exceeded, "+quotaErr.Error(), http.StatusRequestEntityTooLarge)
+		return true
+	} else if err == ErrConfigTooLarge {
+		http.Error(writer, "Configuration too large", http.StatusRequestEntityTooLarge)
+		return true
+	}
+	return false
+}
+
+// parseConfigSource reads a ConfigSource from the profileKey and revisionKey query parameters, the profile defaults to
+// profile and is always profile when profileKey is empty
+func parseConfigSource(query url.Values, profileKey string, revisionKey string, profile string) (ConfigSource, error) {
+	source := ConfigSource{Profile: profile}
+	if from := query.Get(profileKey); profileKey != "" && from != "" {
+		source.Profile = from
+	}
+	if revision := query.Get(revisionKey); revision != "" {
+		var err error
+		if source.Revision, err = strconv.ParseInt(revision, 10, 64); err != nil || source.Revision < 0 {
+			return source, errInvalidRevision
+		}
+	}
+	return source, nil
+}
+
+// parsePrecondition turns the request's If-Match header into the precondition of its write. A configuration only has
+// a single current revision, so anything but "*" or one of our strong entity tags, in any encoding, is a precondition
+// that never holds.
+func parsePrecondition(request *http.Request) Precondition {
+	ifMatch := strings.TrimSpace(request.Header.Get("If-Match"))
+
+	if ifMatch == "" {
+		return Precondition{}
+	} else if ifMatch == "*" {
+		return Precondition{Exists: true}
+	}
+	revision, ok := parseRevisionETag(ifMatch, false)
+	if !ok {
+		revision = -1
+	}
+	return Precondition{Revision: &revision}
+}
+
+const defaultRevisionLimit = 50
+const maxRevisionLimit = 500
+
+func (h *Handlers) HandleRevisions(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	query := request.URL.Query()
+	filter := RevisionFilter{Limit: defaultRevisionLimit}
+
+	if before := query.Get("before"); before != "" {
+		value, err := strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			http.Error(writer, "Invalid before revision", http.StatusBadRequest)
+			return
+		}
+		filter.Before = value
+	}
+	if limit := query.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 || value > maxRevisionLimit {
+			http.Error(writer, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = value
+	}
+	revisions, err := h.repository.FindRevisions(request.Context(), userId, profileParam(params), filter)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error fetching config revisions", zap.Error(err))
+		return
+	}
+	if !typedValues(request) {
+		for i := range revisions {
+			revisions[i].Changes = changesWithoutTypes(revisions[i].Changes)
+		}
+	}
+	err = json.NewEncoder(writer).Encode(revisions)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error serializing revisions json", zap.Error(err))
+	}
+}
+
+func (h *Handlers) HandleChanges(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	since, err := strconv.ParseInt(request.URL.Query().Get("since"), 10, 64)
+
+	if err != nil || since < 0 {
+		http.Error(writer, "Invalid since revision", http.StatusBadRequest)
+		return
+	}
+	changes, err := FindChanges(request.Context(), h.repository, userId, profileParam(params), since)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error fetching config changes", zap.Error(err))
+		return
+	}
+	if !typedValues(request) {
+		changedWithoutTypes(changes.Config)
+	}
+	err = json.NewEncoder(writer).Encode(changes)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error serializing changes json", zap.Error(err))
+	}
+}
+
+const eventKeepAliveInterval = 30 * time.Second
+
+// HandleEvents streams the revisions written by the user's other sessions as server-sent events. The stream ends when
+// the session falls behind, clients should then catch up through /config/changes before reconnecting.
+func (h *Handlers) HandleEvents(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	flusher, ok := writer.(http.Flusher)
+
+	if !ok {
+		http.Error(writer, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := h.broker.Subscribe(userId)
+	defer cancel()
+
+	origin, _ := request.Context().Value(ctxToken).(string)
+	profile := profileParam(params)
+	typed := typedValues(request)
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := writer.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Profile != profile || event.Origin != "" && event.Origin == origin {
+				continue
+			}
+			revision := event.Revision
+			if !typed {
+				revision.Changes = changesWithoutTypes(revision.Changes)
+			}
+			data, err := json.Marshal(revision)
+			if err != nil {
+				h.logger.Error("Error serializing revision json", zap.Error(err))
+				continue
+			}
+			_, err = writer.Write([]byte("id: " + strconv.FormatInt(event.Revision.Revision, 10) + "\nevent: change\ndata: " + string(data) + "\n\n"))
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (h *Handlers) HandleRestore(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	query := request.URL.Query()
+	var revision int64
+	var err error
+
+	if at := query.Get("time"); at != "" {
+		t, parseErr := time.Parse(time.RFC3339, at)
+		if parseErr != nil {
+			http.Error(writer, "Invalid time, expected RFC 3339", http.StatusBadRequest)
+			return
+		}
+		revision, err = FindRevisionAt(request.Context(), h.repository, userId, profileParam(params), t)
+	} else {
+		revision, err = strconv.ParseInt(query.Get("revision"), 10, 64)
+		if err != nil {
+			http.Error(writer, "Invalid revision", http.StatusBadRequest)
+			return
+		}
+	}
+	var restored *ConfigRevision
+	var failedKeys []string
+	if err == nil {
+		restored, failedKeys, err = RestoreRevision(request.Context(), h.repository, userId, profileParam(params), revision, query.Get("group"), parsePrecondition(request))
+	}
+
+	if err == ErrRevisionNotFound {
+		http.Error(writer, "Revision not found", http.StatusNotFound)
+		return
+	} else if err == ErrPreconditionFailed {
+		if request.Header.Get("If-Match") != "" {
+			http.Error(writer, "Precondition failed", http.StatusPreconditionFailed)
+		} else {
+			http.Error(writer, "Too many concurrent updates", http.StatusConflict)
+		}
+		return
+	} else if writeQuotaExceeded(writer, err) {
+		return
+	} else if err != nil {
+		http.Error(writer, "Restore failed", http.StatusInternalServerError)
+		h.logger.Error("Failed to restore config revision", zap.Error(err))
+		return
+	}
+	if len(failedKeys) > 0 {
+		h.logger.Warn("Some keys couldn't be restored", zap.Int64("revision", revision), zap.Strings("keys", failedKeys))
+	}
+	setRevisionETag(writer, restored)
+	if restored == nil || len(restored.Changes) == 0 {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !typedValues(request) {
+		restored.Changes = changesWithoutTypes(restored.Changes)
+	}
+	err = json.NewEncoder(writer).Encode(restored)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error serializing revision json", zap.Error(err))
+	}
+}
+
+// HandleUsage reports the size of the configuration and the quotas it's held to
+func (h *Handlers) HandleUsage(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	usage, err := h.repository.FindUsage(request.Context(), userId, profileParam(params))
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error fetching config usage", zap.Error(err))
+		return
+	}
+	if usage == nil {
+		http.NotFound(writer, request)
+		return
+	}
+	err = json.NewEncoder(writer).Encode(usage)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error serializing usage json", zap.Error(err))
+	}
+}
+
+func (h *Handlers) HandleListGroups(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	groups, err := ListGroups(request.Context(), h.repository, userId, profileParam(params))
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error fetching config groups", zap.Error(err))
+		return
+	}
+	if groups == nil {
+		http.NotFound(writer, request)
+		return
+	}
+	err = json.NewEncoder(writer).Encode(groups)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error serializing groups json", zap.Error(err))
+	}
+}
+
+func (h *Handlers) HandleGetGroup(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	configuration, err := h.repository.FindGroup(request.Context(), userId, profileParam(params), params.ByName("group"))
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error fetching config group", zap.Error(err))
+		return
+	}
+	if configuration == nil {
+		http.NotFound(writer, request)
+		return
+	}
+	if !typedValues(request) {
+		withoutTypes(configuration.Config)
+	}
+	writer.Header().Set("ETag", revisionETag(configuration.Revision))
+	err = json.NewEncoder(writer).Encode(configuration)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error serializing config json", zap.Error(err))
+	}
+}
+
+func (h *Handlers) HandleDeleteGroup(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	revision, failedKeys, err := DeleteGroup(request.Context(), h.repository, userId, profileParam(params), params.ByName("group"), writePrecondition(request, params))
+
+	if err == nil && len(failedKeys) > 0 {
+		err = errInvalidConfigEntry
+	}
+	if err == ErrPreconditionFailed {
+		writePreconditionFailed(writer, request)
+	} else if err == errTooManyConflicts {
+		http.Error(writer, "Too many concurrent updates", http.StatusConflict)
+	} else if err != nil {
+		http.Error(writer, "Delete failed", http.StatusInternalServerError)
+		h.logger.Error("Error deleting config group", zap.Error(err))
+	} else {
+		setRevisionETag(writer, revision)
+	}
+}
+
+// groupRoute serves handle on /config/group/:group only. httprouter doesn't allow a static segment where the key
+// routes have their :key wildcard, so the group routes are registered as /config/:key/:group.
+func groupRoute(handle AuthorizedHttpHandle) AuthorizedHttpHandle {
+	return func(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		if params.ByName("key") != "group" {
+			http.NotFound(writer, request)
+			return
+		}
+		handle(userId, writer, request, params)
+	}
+}
+
+// keyRoute serves handle on /config/:key, except for the static routes sharing the position of the :key wildcard
+// which httprouter can't register alongside it. Those are dispatched to their own handle, config keys always contain a
+// dot so they can't clash with them.
+func keyRoute(handle AuthorizedHttpHandle, static map[string]AuthorizedHttpHandle) AuthorizedHttpHandle {
+	return func(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		if staticHandle, ok := static[params.ByName("key")]; ok {
+			staticHandle(userId, writer, request, params)
+		} else {
+			handle(userId, writer, request, params)
+		}
+	}
+}
+
+func (h *Handlers) HandleDiff(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	query := request.URL.Query()
+	from, err := parseConfigSource(query, "from", "fromRevision", profileParam(params))
+	if err != nil {
+		http.Error(writer, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+	to, err := parseConfigSource(query, "", "revision", profileParam(params))
+	if err != nil {
+		http.Error(writer, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+	diff, err := DiffConfigs(request.Context(), h.repository, userId, from, to, query["group"])
+
+	if err == ErrRevisionNotFound {
+		http.Error(writer, "Revision not found", http.StatusNotFound)
+		return
+	} else if err == ErrProfileNotFound {
+		http.Error(writer, "Profile not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Failed to diff configs", zap.Error(err))
+		return
+	}
+	if !typedValues(request) {
+		withoutTypes(diff.Added)
+		withoutTypes(diff.Removed)
+		diff.Changed = changesWithoutTypes(diff.Changed)
+	}
+	err = json.NewEncoder(writer).Encode(diff)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error serializing diff json", zap.Error(err))
+	}
+}
+
+func (h *Handlers) HandleCopy(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	query := request.URL.Query()
+	source, err := parseConfigSource(query, "from", "revision", profileParam(params))
+	if err != nil {
+		http.Error(writer, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+	copied, failedKeys, err := CopyConfig(request.Context(), h.repository, userId, source, profileParam(params), query["group"])
+
+	if err == ErrRevisionNotFound {
+		http.Error(writer, "Revision not found", http.StatusNotFound)
+		return
+	} else if err == ErrProfileNotFound {
+		http.Error(writer, "Profile not found", http.StatusNotFound)
+		return
+	} else if err == ErrPreconditionFailed {
+		http.Error(writer, "Too many concurrent updates", http.StatusConflict)
+		return
+	} else if writeQuotaExceeded(writer, err) {
+		return
+	} else if err != nil {
+		http.Error(writer, "Copy failed", http.StatusInternalServerError)
+		h.logger.Error("Failed to copy config", zap.Error(err))
+		return
+	}
+	if len(failedKeys) > 0 {
+		h.logger.Warn("Some keys couldn't be copied", zap.String("profile", source.Profile), zap.Strings("keys", failedKeys))
+	}
+	setRevisionETag(writer, copied)
+	if copied == nil || len(copied.Changes) == 0 {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !typedValues(request) {
+		copied.Changes = changesWithoutTypes(copied.Changes)
+	}
+	err = json.NewEncoder(writer).Encode(copied)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error serializing revision json", zap.Error(err))
+	}
+}
+
+func (h *Handlers) HandleListProfiles(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	profiles, err := h.repository.ListProfiles(request.Context(), userId)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error fetching profiles", zap.Error(err))
+		return
+	}
+	err = json.NewEncoder(writer).Encode(profiles)
+
+	if err != nil {
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Error serializing profiles json", zap.Error(err))
+	}
+}
+
+// createProfileRequest creates an empty profile, or clones the groups of From into it when it's set
+type createProfileRequest struct {
+	Name   string        `json:"name"`
+	From   *ConfigSource `json:"from"`
+	Groups []string      `json:"groups"`
+}
+
+func (h *Handlers) HandleCreateProfile(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var createRequest createProfileRequest
+	err := json.NewDecoder(request.Body).Decode(&createRequest)
+
+	if err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	profile := Profile{Name: createRequest.Name}
+	if createRequest.From == nil {
+		err = h.repository.CreateProfile(request.Context(), userId, profile.Name)
+	} else {
+		var revision *ConfigRevision
+		var failedKeys []string
+		revision, failedKeys, err = CloneProfile(request.Context(), h.repository, userId, *createRequest.From, profile.Name, createRequest.Groups)
+
+		if len(failedKeys) > 0 {
+			h.logger.Warn("Some keys couldn't be cloned", zap.String("profile", profile.Name), zap.Strings("keys", failedKeys))
+		}
+		if revision != nil {
+			profile.Revision = revision.Revision
+		}
+	}
+
+	if err == ErrRevisionNotFound {
+		http.Error(writer, "Revision not found", http.StatusNotFound)
+		return
+	} else if writeQuotaExceeded(writer, err) {
+		return
+	} else if err != nil {
+		h.profileError(writer, err)
+		return
+	}
+	writer.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(writer).Encode(profile)
+
+	if err != nil {
+		h.logger.Error("Error serializing profile json", zap.Error(err))
+	}
+}
+
+func (h *Handlers) HandleRenameProfile(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	var profile Profile
+	err := json.NewDecoder(request.Body).Decode(&profile)
+
+	if err != nil {
+		http.Error(writer, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	err = h.repository.RenameProfile(request.Context(), userId, params.ByName("profile"), profile.Name)
+
+	if err != nil {
+		h.profileError(writer, err)
+	}
+}
+
+func (h *Handlers) HandleDeleteProfile(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	err := h.repository.DeleteProfile(request.Context(), userId, params.ByName("profile"))
+
+	if err != nil {
+		h.profileError(writer, err)
+	}
+}
+
+func (h *Handlers) profileError(writer http.ResponseWriter, err error) {
+	switch err {
+	case ErrInvalidProfile:
+		http.Error(writer, "Invalid profile", http.StatusBadRequest)
+	case ErrProfileNotFound:
+		http.Error(writer, "Profile not found", http.StatusNotFound)
+	case ErrProfileExists:
+		http.Error(writer, "Profile already exists", http.StatusConflict)
+	default:
+		http.Error(writer, "Internal server error", http.StatusInternalServerError)
+		h.logger.Error("Failed to update profile", zap.Error(err))
+	}
+}
+
+// typedValues reports whether the client asked for the type of each value it reads, with ?types=true or an Accept
+// header listing application/json with a types=true parameter. Clients that don't only receive plain string values.
+func typedValues(request *http.Request) bool {
+	if types, err := strconv.ParseBool(request.URL.Query().Get("types")); err == nil {
+		return types
+	}
+	for _, accepted := range strings.Split(request.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err == nil && mediaType == "application/json" && params["types"] == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutTypes(entries []ConfigEntry) {
+	for i := range entries {
+		entries[i].Type = ""
+	}
+}
+
+func changedWithoutTypes(entries []ChangedEntry) {
+	for i := range entries {
+		entries[i].Type = ""
+	}
+}
+
+// changesWithoutTypes returns a copy of changes carrying no types, changes may be shared with other readers like the
+// revisions of change events are
+func changesWithoutTypes(changes []ConfigChange) []ConfigChange {
+	untyped := make([]ConfigChange, len(changes))
+	for i, change := range changes {
+		change.Type, change.PreviousType = "", ""
+		untyped[i] = change
 	}
+	return untyped
 }
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newTestHandlers() *Handlers {
+	broker := NewMemoryChangeBroker()
+	return NewHandlers(zap.NewNop(), NewPublishingConfigRepository(NewMemoryConfigRepository(contractOptions), broker), broker)
+}
+
+func serve(handle AuthorizedHttpHandle, method string, body string, params httprouter.Params) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, "/config", strings.NewReader(body))
+	handle(1000, recorder, request, params)
+	return recorder
+}
+
+func TestHandleGetMissingConfig(t *testing.T) {
+	handlers := newTestHandlers()
+
+	if status := serve(handlers.HandleGet, "GET", "", nil).Code; status != http.StatusNotFound {
+		t.Errorf("Invalid http got status %d but expected %d", status, http.StatusNotFound)
+	}
+}
+
+func TestHandlersRoundTrip(t *testing.T) {
+	handlers := newTestHandlers()
+	key := httprouter.Params{{Key: "key", Value: "xpdrop.fakeXpDropColor"}}
+
+	if status := serve(handlers.HandlePut, "PUT", "-16711936", key).Code; status != http.StatusOK {
+		t.Errorf("Invalid http got status %d but expected %d", status, http.StatusOK)
+	}
+	oversize := strings.Repeat("a", contractMaxConfigValueLength+1)
+	patch := serve(handlers.HandlePatch, "PATCH", `{"config":[{"key":"npcindicators.npcToHighlight","value":"Vorkath"},{"key":"oversize.value","value":"`+oversize+`"}]}`, nil)
+
+	var failedKeys []string
+	if err := json.NewDecoder(patch.Body).Decode(&failedKeys); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failedKeys, []string{"oversize.value"}) {
+		t.Errorf("Got failed keys %v but expected %v", failedKeys, []string{"oversize.value"})
+	}
+	if get := serve(handlers.HandleGetKey, "GET", "", key); get.Code != http.StatusOK || get.Body.String() != "-16711936" {
+		t.Errorf("Got status %d and value %q but expected %d and the stored value", get.Code, get.Body.String(), http.StatusOK)
+	}
+	serve(handlers.HandleDelete, "DELETE", "", key)
+	if status := serve(handlers.HandleGetKey, "GET", "", key).Code; status != http.StatusNotFound {
+		t.Errorf("Getting a deleted key got status %d but expected %d", status, http.StatusNotFound)
+	}
+
+	var configuration Configuration
+	if err := json.NewDecoder(serve(handlers.HandleGet, "GET", "", nil).Body).Decode(&configuration); err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConfigEntry{{Key: "npcindicators.npcToHighlight", Value: "Vorkath"}}
+	if !reflect.DeepEqual(configuration.Config, expected) {
+		t.Errorf("Got configuration %v but expected %v", configuration.Config, expected)
+	}
+}
+
+func TestHandlePatchDeletions(t *testing.T) {
+	handlers := newTestHandlers()
+	serve(handlers.HandlePatch, "PATCH", `{"config":[{"key":"grounditems.defaultColor","value":"-16777216"},{"key":"grounditems.hideUnderValue","value":"1.5"},{"key":"runelite.theme","value":"dark mode"},{"key":"xpdrop.fakeXpDropColor","value":"-16711936"}]}`, nil)
+
+	patch := serve(handlers.HandlePatch, "PATCH", `{"config":[{"key":"grounditems.defaultColor","value":null},{"key":"runelite.theme","value":"light mode"},{"key":"runelite.scale","value":2},{"key":"runelite.empty"}]}`, nil)
+	var failedKeys []string
+	if err := json.NewDecoder(patch.Body).Decode(&failedKeys); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failedKeys, []string{"runelite.scale"}) {
+		t.Errorf("Got failed keys %v but expected %v", failedKeys, []string{"runelite.scale"})
+	}
+
+	bulk := serve(handlers.HandleBulkDelete, "POST", `["grounditems.hideUnderValue","xpdrop.fakeXpDropColor","_id.value"]`, nil)
+	if err := json.NewDecoder(bulk.Body).Decode(&failedKeys); err != nil {
+		t.Fatal(err)
+	}
+	if len(failedKeys) != 0 {
+		t.Errorf("Got failed keys %v but expected none", failedKeys)
+	}
+
+	var configuration Configuration
+	if err := json.NewDecoder(serve(handlers.HandleGet, "GET", "", nil).Body).Decode(&configuration); err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConfigEntry{{Key: "runelite.empty", Value: ""}, {Key: "runelite.theme", Value: "light mode"}}
+	if !reflect.DeepEqual(sortedEntries(configuration.Config), expected) {
+		t.Errorf("Got configuration %v but expected %v", configuration.Config, expected)
+	}
+
+	// both batches are a single revision each on top of the initial one
+	var revisions []ConfigRevision
+	if err := json.NewDecoder(serve(handlers.HandleRevisions, "GET", "", nil).Body).Decode(&revisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 {
+		t.Errorf("Got %d revisions but expected %d", len(revisions), 3)
+	}
+}
+
+func TestHandlePatchFormats(t *testing.T) {
+	handlers := newTestHandlers()
+	serve(handlers.HandlePut, "PUT", "dark mode", httprouter.Params{{Key: "key", Value: "runelite.theme"}})
+
+	for _, test := range []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"application/merge-patch+json", `{"runelite":{"scale":"2"},"xpdrop":{"fakeXpDropColor":"-16711936"}}`, http.StatusOK},
+		{"application/json-patch+json", `[{"op":"test","path":"/runelite/theme","value":"dark mode"},{"op":"remove","path":"/xpdrop"}]`, http.StatusOK},
+		{"application/json-patch+json", `[{"op":"test","path":"/runelite/theme","value":"light mode"}]`, http.StatusConflict},
+		{"application/merge-patch+json; charset=utf-8", `["runelite"]`, http.StatusBadRequest},
+		{"application/json", `{"config":[{"key":"runelite.theme","value":"light mode"}]}`, http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("PATCH", "/config", strings.NewReader(test.body))
+		request.Header.Set("Content-Type", test.contentType)
+		handlers.HandlePatch(1000, recorder, request, nil)
+
+		if recorder.Code != test.status {
+			t.Errorf("Patching %s with %s got status %d but expected %d", test.contentType, test.body, recorder.Code, test.status)
+		}
+	}
+
+	var configuration Configuration
+	if err := json.NewDecoder(serve(handlers.HandleGet, "GET", "", nil).Body).Decode(&configuration); err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConfigEntry{{Key: "runelite.scale", Value: "2"}, {Key: "runelite.theme", Value: "light mode"}}
+	if !reflect.DeepEqual(sortedEntries(configuration.Config), expected) {
+		t.Errorf("Got configuration %v but expected %v", configuration.Config, expected)
+	}
+}
+
+func TestHandleRestore(t *testing.T) {
+	handlers := newTestHandlers()
+	key := httprouter.Params{{Key: "key", Value: "bank.tagTabs"}}
+	serve(handlers.HandlePut, "PUT", "Vorkath,Zulrah", key)
+	serve(handlers.HandleDelete, "DELETE", "", key)
+
+	var revisions []ConfigRevision
+	if err := json.NewDecoder(serve(handlers.HandleRevisions, "GET", "", nil).Body).Decode(&revisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("Got %d revisions but expected %d", len(revisions), 2)
+	}
+
+	// the configuration is at revisions[0], restores conditioned on an earlier one aren't applied
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/config/restore?revision="+strconv.FormatInt(revisions[1].Revision, 10), nil)
+	request.Header.Set("If-Match", `"`+strconv.FormatInt(revisions[1].Revision, 10)+`"`)
+	handlers.HandleRestore(1000, recorder, request, nil)
+
+	if status := recorder.Code; status != http.StatusPreconditionFailed {
+		t.Errorf("Invalid http got status %d but expected %d", status, http.StatusPreconditionFailed)
+	}
+
+	recorder = httptest.NewRecorder()
+	request.Header.Set("If-Match", `"`+strconv.FormatInt(revisions[0].Revision, 10)+`"`)
+	handlers.HandleRestore(1000, recorder, request, nil)
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Errorf("Invalid http got status %d but expected %d", status, http.StatusOK)
+	}
+	var configuration Configuration
+	if err := json.NewDecoder(serve(handlers.HandleGet, "GET", "", nil).Body).Decode(&configuration); err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConfigEntry{{Key: "bank.tagTabs", Value: "Vorkath,Zulrah"}}
+	if !reflect.DeepEqual(configuration.Config, expected) {
+		t.Errorf("Got configuration %v but expected %v", configuration.Config, expected)
+	}
+
+	recorder = httptest.NewRecorder()
+	handlers.HandleRestore(1000, recorder, httptest.NewRequest("POST", "/config/restore?revision=1000", nil), nil)
+	if status := recorder.Code; status != http.StatusNotFound {
+		t.Errorf("Invalid http got status %d but expected %d", status, http.StatusNotFound)
+	}
+}
+
+func TestHandleProfiles(t *testing.T) {
+	handlers := newTestHandlers()
+	pvm := httprouter.Params{{Key: "profile", Value: "pvm"}}
+	key := append(httprouter.Params{{Key: "key", Value: "runelite.theme"}}, pvm...)
+
+	if status := serve(handlers.HandlePut, "PUT", "light mode", key).Code; status != http.StatusNotFound {
+		t.Errorf("Writing to a missing profile got status %d but expected %d", status, http.StatusNotFound)
+	}
+	if status := serve(handlers.HandleCreateProfile, "POST", `{"name":"pvm"}`, nil).Code; status != http.StatusCreated {
+		t.Errorf("Creating a profile got status %d but expected %d", status, http.StatusCreated)
+	}
+	if status := serve(handlers.HandleCreateProfile, "POST", `{"name":"pvm"}`, nil).Code; status != http.StatusConflict {
+		t.Errorf("Creating an existing profile got status %d but expected %d", status, http.StatusConflict)
+	}
+	if status := serve(handlers.HandleCreateProfile, "POST", `{"name":"../pvm"}`, nil).Code; status != http.StatusBadRequest {
+		t.Errorf("Creating an invalid profile got status %d but expected %d", status, http.StatusBadRequest)
+	}
+	serve(handlers.HandlePut, "PUT", "dark mode", httprouter.Params{{Key: "key", Value: "runelite.theme"}})
+	if status := serve(handlers.HandlePut, "PUT", "light mode", key).Code; status != http.StatusOK {
+		t.Errorf("Writing to a profile got status %d but expected %d", status, http.StatusOK)
+	}
+
+	for _, test := range []struct {
+		params httprouter.Params
+		value  string
+	}{{nil, "dark mode"}, {pvm, "light mode"}} {
+		var configuration Configuration
+		if err := json.NewDecoder(serve(handlers.HandleGet, "GET", "", test.params).Body).Decode(&configuration); err != nil {
+			t.Fatal(err)
+		}
+		expected := []ConfigEntry{{Key: "runelite.theme", Value: test.value}}
+		if !reflect.DeepEqual(configuration.Config, expected) {
+			t.Errorf("Got configuration %v but expected %v", configuration.Config, expected)
+		}
+	}
+
+	if status := serve(handlers.HandleRenameProfile, "PUT", `{"name":"bossing"}`, pvm).Code; status != http.StatusOK {
+		t.Errorf("Renaming a profile got status %d but expected %d", status, http.StatusOK)
+	}
+	var profiles []Profile
+	if err := json.NewDecoder(serve(handlers.HandleListProfiles, "GET", "", nil).Body).Decode(&profiles); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Profile{{Name: "bossing", Revision: 1}, {Name: DefaultProfile, Revision: 1}}
+	if !reflect.DeepEqual(profiles, expected) {
+		t.Errorf("Got profiles %v but expected %v", profiles, expected)
+	}
+
+	if status := serve(handlers.HandleDeleteProfile, "DELETE", "", httprouter.Params{{Key: "profile", Value: DefaultProfile}}).Code; status != http.StatusBadRequest {
+		t.Errorf("Deleting the default profile got status %d but expected %d", status, http.StatusBadRequest)
+	}
+	if status := serve(handlers.HandleDeleteProfile, "DELETE", "", pvm).Code; status != http.StatusNotFound {
+		t.Errorf("Deleting a missing profile got status %d but expected %d", status, http.StatusNotFound)
+	}
+	if status := serve(handlers.HandleDeleteProfile, "DELETE", "", httprouter.Params{{Key: "profile", Value: "bossing"}}).Code; status != http.StatusOK {
+		t.Errorf("Deleting a profile got status %d but expected %d", status, http.StatusOK)
+	}
+}
+
+func TestHandleCopyAndDiff(t *testing.T) {
+	handlers := newTestHandlers()
+	serve(handlers.HandlePut, "PUT", "dark mode", httprouter.Params{{Key: "key", Value: "runelite.theme"}})
+	serve(handlers.HandlePut, "PUT", "Vorkath", httprouter.Params{{Key: "key", Value: "npcindicators.npcToHighlight"}})
+
+	if status := serve(handlers.HandleCreateProfile, "POST", `{"name":"pvm","from":{"profile":"default"},"groups":["runelite"]}`, nil).Code; status != http.StatusCreated {
+		t.Errorf("Cloning a profile got status %d but expected %d", status, http.StatusCreated)
+	}
+	pvm := httprouter.Params{{Key: "profile", Value: "pvm"}}
+	serve(handlers.HandlePut, "PUT", "light mode", append(httprouter.Params{{Key: "key", Value: "runelite.theme"}}, pvm...))
+
+	recorder := httptest.NewRecorder()
+	handlers.HandleDiff(1000, recorder, httptest.NewRequest("GET", "/config/diff?from=default", nil), pvm)
+
+	var diff ConfigDiff
+	if err := json.NewDecoder(recorder.Body).Decode(&diff); err != nil {
+		t.Fatal(err)
+	}
+	expected := ConfigDiff{
+		Added:   []ConfigEntry{},
+		Removed: []ConfigEntry{{Key: "npcindicators.npcToHighlight", Value: "Vorkath"}},
+		Changed: []ConfigChange{{Key: "runelite.theme", Value: stringPtr("light mode"), Previous: stringPtr("dark mode")}},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Got diff %+v but expected %+v", diff, expected)
+	}
+
+	recorder = httptest.NewRecorder()
+	handlers.HandleDiff(1000, recorder, httptest.NewRequest("GET", "/config/diff?from=default&types=true", nil), pvm)
+	diff = ConfigDiff{}
+	if err := json.NewDecoder(recorder.Body).Decode(&diff); err != nil {
+		t.Fatal(err)
+	}
+	expected.Removed[0].Type = ValueString
+	expected.Changed[0].Type, expected.Changed[0].PreviousType = ValueString, ValueString
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Got typed diff %+v but expected %+v", diff, expected)
+	}
+
+	recorder = httptest.NewRecorder()
+	handlers.HandleCopy(1000, recorder, httptest.NewRequest("POST", "/config/copy?from=pvm&group=runelite", nil), nil)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Copying a profile got status %d but expected %d", recorder.Code, http.StatusOK)
+	}
+	recorder = httptest.NewRecorder()
+	handlers.HandleCopy(1000, recorder, httptest.NewRequest("POST", "/config/copy?from=missing", nil), nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Copying a missing profile got status %d but expected %d", recorder.Code, http.StatusNotFound)
+	}
+
+	var configuration Configuration
+	if err := json.NewDecoder(serve(handlers.HandleGet, "GET", "", nil).Body).Decode(&configuration); err != nil {
+		t.Fatal(err)
+	}
+	expectedConfig := []ConfigEntry{{Key: "npcindicators.npcToHighlight", Value: "Vorkath"}, {Key: "runelite.theme", Value: "light mode"}}
+	if !reflect.DeepEqual(configuration.Config, expectedConfig) {
+		t.Errorf("Got configuration %v but expected %v", configuration.Config, expectedConfig)
+	}
+}
+
+func TestHandleGroups(t *testing.T) {
+	handlers := newTestHandlers()
+	serve(handlers.HandlePatch, "PATCH", `{"config":[{"key":"grounditems.defaultColor","value":"-16777216"},{"key":"grounditems.hideUnderValue","value":"1.5"},{"key":"runelite.theme","value":"dark mode"}]}`, nil)
+
+	var groups []ConfigGroup
+	if err := json.NewDecoder(serve(handlers.HandleListGroups, "GET", "", nil).Body).Decode(&groups); err != nil {
+		t.Fatal(err)
+	}
+	expectedGroups := []ConfigGroup{{Name: "grounditems", Keys: 2}, {Name: "runelite", Keys: 1}}
+	if !reflect.DeepEqual(groups, expectedGroups) {
+		t.Errorf("Got groups %v but expected %v", groups, expectedGroups)
+	}
+
+	group := httprouter.Params{{Key: "key", Value: "group"}, {Key: "group", Value: "grounditems"}}
+	if status := serve(groupRoute(handlers.HandleDeleteGroup), "DELETE", "", httprouter.Params{{Key: "key", Value: "grounditems"}, {Key: "group", Value: "grounditems"}}).Code; status != http.StatusNotFound {
+		t.Errorf("Deleting outside of the group route got status %d but expected %d", status, http.StatusNotFound)
+	}
+	if status := serve(groupRoute(handlers.HandleDeleteGroup), "DELETE", "", group).Code; status != http.StatusOK {
+		t.Errorf("Deleting a group got status %d but expected %d", status, http.StatusOK)
+	}
+
+	var configuration Configuration
+	if err := json.NewDecoder(serve(handlers.HandleGetGroup, "GET", "", group).Body).Decode(&configuration); err != nil {
+		t.Fatal(err)
+	}
+	if len(configuration.Config) != 0 {
+		t.Errorf("Got group %v after deleting it but expected it to be empty", configuration.Config)
+	}
+	if err := json.NewDecoder(serve(handlers.HandleGetGroup, "GET", "", httprouter.Params{{Key: "group", Value: "runelite"}}).Body).Decode(&configuration); err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConfigEntry{{Key: "runelite.theme", Value: "dark mode"}}
+	if !reflect.DeepEqual(configuration.Config, expected) {
+		t.Errorf("Got group %v but expected %v", configuration.Config, expected)
+	}
+}
+
+// contendedRepository fails every write conditioned on a revision, as if another write always got in between
+type contendedRepository struct {
+	ConfigRepository
+}
+
+func (r contendedRepository) Apply(ctx context.Context, userId int64, profile string, mutations []ConfigMutation, precondition Precondition) (*ConfigRevision, []string, error) {
+	if precondition.Revision != nil {
+		return nil, nil, ErrPreconditionFailed
+	}
+	return r.ConfigRepository.Apply(ctx, userId, profile, mutations, precondition)
+}
+
+func TestHandleDeleteGroupConflicts(t *testing.T) {
+	repository := NewMemoryConfigRepository(contractOptions)
+	if err := repository.Save(context.Background(), 1000, DefaultProfile, &ConfigEntry{Key: "grounditems.defaultColor", Value: "-16777216"}); err != nil {
+		t.Fatal(err)
+	}
+	handlers := NewHandlers(zap.NewNop(), contendedRepository{repository}, NewMemoryChangeBroker())
+
+	group := httprouter.Params{{Key: "key", Value: "group"}, {Key: "group", Value: "grounditems"}}
+	if status := serve(groupRoute(handlers.HandleDeleteGroup), "DELETE", "", group).Code; status != http.StatusConflict {
+		t.Errorf("Deleting a group that kept changing got status %d but expected %d", status, http.StatusConflict)
+	}
+	missing := append(httprouter.Params{{Key: "profile", Value: "pvm"}}, group...)
+	if status := serve(groupRoute(handlers.HandleDeleteGroup), "DELETE", "", missing).Code; status != http.StatusNotFound {
+		t.Errorf("Deleting a group of a missing profile got status %d but expected %d", status, http.StatusNotFound)
+	}
+}
+
+func TestHandlePatchConflicts(t *testing.T) {
+	repository := NewMemoryConfigRepository(contractOptions)
+	if err := repository.Save(context.Background(), 1000, DefaultProfile, &ConfigEntry{Key: "runelite.theme", Value: "dark mode"}); err != nil {
+		t.Fatal(err)
+	}
+	handlers := NewHandlers(zap.NewNop(), contendedRepository{repository}, NewMemoryChangeBroker())
+
+	patch := func(params httprouter.Params) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("PATCH", "/config", strings.NewReader(`{"runelite":{"theme":"light mode"}}`))
+		request.Header.Set("Content-Type", "application/merge-patch+json")
+		handlers.HandlePatch(1000, recorder, request, params)
+		return recorder
+	}
+	if recorder := patch(nil); recorder.Code != http.StatusConflict || !strings.Contains(recorder.Body.String(), "Too many concurrent updates") {
+		t.Errorf("Patching a configuration that kept changing got status %d and %q but expected %d", recorder.Code, recorder.Body.String(), http.StatusConflict)
+	}
+	if status := patch(httprouter.Params{{Key: "profile", Value: "pvm"}}).Code; status != http.StatusNotFound {
+		t.Errorf("Patching a missing profile got status %d but expected %d", status, http.StatusNotFound)
+	}
+}
+
+// overQuotaRepository rejects every write to an existing profile, as if its configuration was past the quotas
+type overQuotaRepository struct {
+	ConfigRepository
+}
+
+func (r overQuotaRepository) Apply(ctx context.Context, userId int64, profile string, mutations []ConfigMutation, precondition Precondition) (*ConfigRevision, []string, error) {
+	if precondition.Exists {
+		return nil, nil, &QuotaError{Quota: "bytes", Limit: contractOptions.Quotas.MaxBytes, Usage: contractOptions.Quotas.MaxBytes + 1}
+	}
+	return r.ConfigRepository.Apply(ctx, userId, profile, mutations, precondition)
+}
+
+func TestHandleCloneProfileOverQuota(t *testing.T) {
+	repository := NewMemoryConfigRepository(contractOptions)
+	if err := repository.Save(context.Background(), 1000, DefaultProfile, &ConfigEntry{Key: "runelite.theme", Value: "dark mode"}); err != nil {
+		t.Fatal(err)
+	}
+	handlers := NewHandlers(zap.NewNop(), overQuotaRepository{repository}, NewMemoryChangeBroker())
+
+	clone := `{"name":"pvm","from":{"profile":"default"}}`
+	if status := serve(handlers.HandleCreateProfile, "POST", clone, nil).Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Cloning a profile past the quotas got status %d but expected %d", status, http.StatusRequestEntityTooLarge)
+	}
+	if profiles, err := repository.ListProfiles(context.Background(), 1000); err != nil || len(profiles) != 1 {
+		t.Errorf("Got profiles %v, %v after a failed clone but expected only the default one", profiles, err)
+	}
+	// the clone can be retried rather than running into the profile it failed to fill
+	if status := serve(handlers.HandleCreateProfile, "POST", clone, nil).Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Retrying a clone past the quotas got status %d but expected %d", status, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestHandleValueTypes(t *testing.T) {
+	handlers := newTestHandlers()
+	key := httprouter.Params{{Key: "key", Value: "bank.tagTabs"}}
+
+	put := httptest.NewRecorder()
+	handlers.HandlePut(1000, put, httptest.NewRequest("PUT", "/config?type=number", strings.NewReader("Vorkath")), key)
+	if put.Code != http.StatusBadRequest {
+		t.Errorf("Putting a value that doesn't hold its type got status %d but expected %d", put.Code, http.StatusBadRequest)
+	}
+	put = httptest.NewRecorder()
+	handlers.HandlePut(1000, put, httptest.NewRequest("PUT", "/config?type=string", strings.NewReader("1")), key)
+	if put.Code != http.StatusOK {
+		t.Errorf("Putting a typed value got status %d but expected %d", put.Code, http.StatusOK)
+	}
+	patch := serve(handlers.HandlePatch, "PATCH", `{"config":[{"key":"runelite.scale","value":"2","type":"number"},{"key":"runelite.theme","value":"dark mode","type":"boolean"}]}`, nil)
+	var failedKeys []string
+	if err := json.NewDecoder(patch.Body).Decode(&failedKeys); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failedKeys, []string{"runelite.theme"}) {
+		t.Errorf("Got failed keys %v but expected %v", failedKeys, []string{"runelite.theme"})
+	}
+
+	var configuration Configuration
+	if err := json.NewDecoder(serve(handlers.HandleGet, "GET", "", nil).Body).Decode(&configuration); err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConfigEntry{{Key: "bank.tagTabs", Value: "1"}, {Key: "runelite.scale", Value: "2"}}
+	if !reflect.DeepEqual(sortedEntries(configuration.Config), expected) {
+		t.Errorf("Got untyped configuration %v but expected %v", configuration.Config, expected)
+	}
+
+	expected = []ConfigEntry{{Key: "bank.tagTabs", Value: "1", Type: ValueString}, {Key: "runelite.scale", Value: "2", Type: ValueNumber}}
+	for _, request := range []*http.Request{httptest.NewRequest("GET", "/config?types=true", nil), httptest.NewRequest("GET", "/config", nil)} {
+		if request.URL.RawQuery == "" {
+			request.Header.Set("Accept", "text/plain;q=0.5, application/json; types=true")
+		}
+		recorder := httptest.NewRecorder()
+		handlers.HandleGet(1000, recorder, request, nil)
+		if err := json.NewDecoder(recorder.Body).Decode(&configuration); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(sortedEntries(configuration.Config), expected) {
+			t.Errorf("Got typed configuration %v but expected %v", configuration.Config, expected)
+		}
+	}
+
+	get := httptest.NewRecorder()
+	handlers.HandleGetKey(1000, get, httptest.NewRequest("GET", "/config/bank.tagTabs?types=true", nil), key)
+	var entry ConfigEntry
+	if err := json.NewDecoder(get.Body).Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry != expected[0] {
+		t.Errorf("Got entry %v but expected %v", entry, expected[0])
+	}
+}
+
+func TestHandleQuotas(t *testing.T) {
+	handlers := newTestHandlers()
+
+	if status := serve(keyRoute(handlers.HandleGetKey, map[string]AuthorizedHttpHandle{"usage": handlers.HandleUsage}), "GET", "", httprouter.Params{{Key: "key", Value: "usage"}}).Code; status != http.StatusNotFound {
+		t.Errorf("Getting the usage of a missing configuration got status %d but expected %d", status, http.StatusNotFound)
+	}
+	large := strings.Repeat("a", 1000)
+	serve(handlers.HandlePatch, "PATCH", `{"config":[{"key":"bank.a","value":"`+large+`"},{"key":"bank.b","value":"`+large+`"}]}`, nil)
+
+	put := serve(handlers.HandlePut, "PUT", large, httprouter.Params{{Key: "key", Value: "bank.c"}})
+	if put.Code != http.StatusRequestEntityTooLarge || !strings.Contains(put.Body.String(), "groupBytes") {
+		t.Errorf("Growing a group past its quota got status %d and %q but expected %d naming the quota", put.Code, put.Body.String(), http.StatusRequestEntityTooLarge)
+	}
+	if patch := serve(handlers.HandlePatch, "PATCH", `{"config":[{"key":"bank.c","value":"`+large+`"}]}`, nil); patch.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Patching a group past its quota got status %d but expected %d", patch.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	var usage ConfigUsage
+	if err := json.NewDecoder(serve(handlers.HandleUsage, "GET", "", nil).Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	expected := ConfigUsage{Keys: 2, Bytes: 2012, Groups: map[string]int64{"bank": 2012}, Quotas: contractOptions.Quotas}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Errorf("Got usage %v but expected %v", usage, expected)
+	}
+}
+
+func TestHandleIfMatch(t *testing.T) {
+	handlers := newTestHandlers()
+	key := httprouter.Params{{Key: "key", Value: "bank.tagTabs"}}
+	serve(handlers.HandlePut, "PUT", "Vorkath", key)
+
+	etag := serve(handlers.HandleGet, "GET", "", nil).Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Got no ETag for the configuration")
+	}
+
+	write := func(handle AuthorizedHttpHandle, method string, body string, ifMatch string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, "/config", strings.NewReader(body))
+		request.Header.Set("If-Match", ifMatch)
+		handle(1000, recorder, request, key)
+		return recorder
+	}
+	updated := write(handlers.HandlePut, "PUT", "Zulrah", etag)
+	if updated.Code != http.StatusOK || updated.Header().Get("ETag") == etag {
+		t.Errorf("Got status %d and ETag %s but expected %d and a new ETag", updated.Code, updated.Header().Get("ETag"), http.StatusOK)
+	}
+	for _, stale := range []string{etag, `W/` + updated.Header().Get("ETag"), `"abc"`} {
+		if status := write(handlers.HandleDelete, "DELETE", "", stale).Code; status != http.StatusPreconditionFailed {
+			t.Errorf("Got status %d deleting with If-Match %s but expected %d", status, stale, http.StatusPreconditionFailed)
+		}
+	}
+	patch := `{"config":[{"key":"bank.tagTabs","value":"Vorkath"}]}`
+	patched := write(handlers.HandlePatch, "PATCH", patch, updated.Header().Get("ETag"))
+	if patched.Code != http.StatusOK {
+		t.Errorf("Got status %d patching at the current ETag but expected %d", patched.Code, http.StatusOK)
+	}
+	// the ETag of a compressed response names the same revision
+	if status := write(handlers.HandlePut, "PUT", "Zulrah", encodedETag(patched.Header().Get("ETag"), "gzip")).Code; status != http.StatusOK {
+		t.Errorf("Got status %d writing at the current gzip ETag but expected %d", status, http.StatusOK)
+	}
+	if status := write(handlers.HandlePatch, "PATCH", patch, "*").Code; status != http.StatusOK {
+		t.Errorf("Got status %d patching with If-Match * but expected %d", status, http.StatusOK)
+	}
+}
+
+func TestHandleGetIfNoneMatch(t *testing.T) {
+	handlers := newTestHandlers()
+	serve(handlers.HandlePut, "PUT", "Vorkath", httprouter.Params{{Key: "key", Value: "bank.tagTabs"}})
+	etag := serve(handlers.HandleGet, "GET", "", nil).Header().Get("ETag")
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/config", nil)
+		request.Header.Set("If-None-Match", ifNoneMatch)
+		handlers.HandleGet(1000, recorder, request, nil)
+		return recorder
+	}
+	for _, ifNoneMatch := range []string{etag, `"0", W/` + etag, "*"} {
+		recorder := get(ifNoneMatch)
+		if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 || recorder.Header().Get("ETag") != etag {
+			t.Errorf("Got status %d with %d bytes for If-None-Match %s but expected an empty %d", recorder.Code, recorder.Body.Len(), ifNoneMatch, http.StatusNotModified)
+		}
+	}
+	for _, ifNoneMatch := range []string{encodedETag(etag, "br"), `"0", W/` + encodedETag(etag, "br")} {
+		recorder := get(ifNoneMatch)
+		if recorder.Code != http.StatusNotModified || recorder.Header().Get("ETag") != encodedETag(etag, "br") {
+			t.Errorf("Got status %d and ETag %s for If-None-Match %s but expected %d with the br ETag", recorder.Code, recorder.Header().Get("ETag"), ifNoneMatch, http.StatusNotModified)
+		}
+	}
+	if status := get(`"0"`).Code; status != http.StatusOK {
+		t.Errorf("Got status %d for a stale ETag but expected %d", status, http.StatusOK)
+	}
+	if status := get(`"0-gzip"`).Code; status != http.StatusOK {
+		t.Errorf("Got status %d for a stale gzip ETag but expected %d", status, http.StatusOK)
+	}
+}
+
+func TestHandleChanges(t *testing.T) {
+	handlers := newTestHandlers()
+	serve(handlers.HandlePut, "PUT", "Vorkath", httprouter.Params{{Key: "key", Value: "bank.tagTabs"}})
+
+	changes := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handlers.HandleChanges(1000, recorder, httptest.NewRequest("GET", "/config/changes"+query, nil), nil)
+		return recorder
+	}
+	for _, query := range []string{"", "?since=-1", "?since=latest"} {
+		if status := changes(query).Code; status != http.StatusBadRequest {
+			t.Errorf("Got status %d for %q but expected %d", status, query, http.StatusBadRequest)
+		}
+	}
+
+	var response ConfigChanges
+	if err := json.NewDecoder(changes("?since=0").Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	expected := []ChangedEntry{{Key: "bank.tagTabs", Value: "Vorkath", Revision: response.Revision}}
+	if !response.Reset || !reflect.DeepEqual(response.Config, expected) {
+		t.Errorf("Got changes %+v but expected a reset to %v", response, expected)
+	}
+	// clients opted into types keep them when they resync
+	if err := json.NewDecoder(changes("?since=0&types=true").Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	expected[0].Type = ValueString
+	if !reflect.DeepEqual(response.Config, expected) {
+		t.Errorf("Got changes %+v but expected the typed %v", response.Config, expected)
+	}
+}
+
+// streamRecorder signals every flush so tests can wait for a streaming handler to catch up
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan struct{}
+}
+
+func (r *streamRecorder) Flush() {
+	r.ResponseRecorder.Flush()
+	r.flushed <- struct{}{}
+}
+
+func TestHandleEvents(t *testing.T) {
+	handlers := newTestHandlers()
+	recorder := &streamRecorder{ResponseRecorder: httptest.NewRecorder(), flushed: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxToken, "listener"))
+	done := make(chan struct{})
+	go func() {
+		handlers.HandleEvents(1000, recorder, httptest.NewRequest("GET", "/config/events", nil).WithContext(ctx), nil)
+		close(done)
+	}()
+	<-recorder.flushed
+
+	put := func(session string, value string) {
+		request := httptest.NewRequest("PUT", "/config", strings.NewReader(value))
+		request = request.WithContext(context.WithValue(request.Context(), ctxToken, session))
+		handlers.HandlePut(1000, httptest.NewRecorder(), request, httprouter.Params{{Key: "key", Value: "bank.tagTabs"}})
+	}
+	put("listener", "Vorkath")
+	put("other", "Zulrah")
+	<-recorder.flushed
+	cancel()
+	<-done
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Got content type %s but expected text/event-stream", contentType)
+	}
+	expected := "id: 2\nevent: change\ndata: "
+	if body := recorder.Body.String(); !strings.HasPrefix(body, expected) || strings.Count(body, "event: change") != 1 || !strings.Contains(body, "Zulrah") {
+		t.Errorf("Got events %q but expected only the other session's change", body)
+	}
+}
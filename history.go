@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// revisionPageLength is how many revisions FindRevisionAt reads at a time walking back through the history
+const revisionPageLength = 100
+
+// FindRevisionAt returns the newest revision recorded at or before t, reading the history back from the newest
+// revision only as far as it
+func FindRevisionAt(ctx context.Context, repository ConfigRepository, userId int64, profile string, t time.Time) (int64, error) {
+	filter := RevisionFilter{Limit: revisionPageLength}
+	for {
+		revisions, err := repository.FindRevisions(ctx, userId, profile, filter)
+
+		if err != nil {
+			return 0, err
+		}
+		for _, revision := range revisions {
+			if !revision.Time.After(t) {
+				return revision.Revision, nil
+			}
+		}
+		if len(revisions) < filter.Limit {
+			return 0, ErrRevisionNotFound
+		}
+		filter.Before = revisions[len(revisions)-1].Revision
+	}
+}
+
+// RestoreRevision reverts the user's configuration, or only the given group of it, to how it was right after
+// revision by undoing every later change. The restore is itself recorded as a new revision so it can be undone too.
+// It's conditioned on the revision the history was read at and retried when another write gets in between, unless
+// precondition names a revision, in which case ErrPreconditionFailed is returned once the configuration has moved on.
+func RestoreRevision(ctx context.Context, repository ConfigRepository, userId int64, profile string, revision int64, group string, precondition Precondition) (*ConfigRevision, []string, error) {
+	for attempt := 1; ; attempt++ {
+		current, ok, err := repository.FindCurrentRevision(ctx, userId, profile)
+
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok || revision > current {
+			return nil, nil, ErrRevisionNotFound
+		}
+		if !precondition.holds(ok, current) {
+			return nil, nil, ErrPreconditionFailed
+		}
+		// revision itself is included to tell apart a missing revision from one without later changes, revisions
+		// written since current was read are left out and fail the write below
+		revisions, err := repository.FindRevisions(ctx, userId, profile, RevisionFilter{After: revision - 1, Before: current + 1})
+
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(revisions) == 0 || revisions[len(revisions)-1].Revision != revision {
+			return nil, nil, ErrRevisionNotFound
+		}
+
+		// revisions are newest first, so the oldest change to a key ends up deciding its restored value and type
+		restored := make(map[string]ConfigMutation)
+		order := make([]string, 0)
+		for _, later := range revisions[:len(revisions)-1] {
+			for _, change := range later.Changes {
+				if group != "" && !strings.HasPrefix(change.Key, group+".") {
+					continue
+				}
+				if _, ok := restored[change.Key]; !ok {
+					order = append(order, change.Key)
+				}
+				restored[change.Key] = ConfigMutation{Key: change.Key, Value: change.Previous, Type: change.PreviousType}
+			}
+		}
+
+		mutations := make([]ConfigMutation, len(order))
+		for i, key := range order {
+			mutations[i] = restored[key]
+		}
+		applied, failedKeys, err := repository.Apply(ctx, userId, profile, mutations, Precondition{Revision: &current})
+		if err == ErrPreconditionFailed && precondition.Revision == nil && attempt < maxUpdateAttempts {
+			continue
+		}
+		return applied, failedKeys, err
+	}
+}
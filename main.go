@@ -2,32 +2,26 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	_ "expvar"
 	"github.com/caarlos0/env/v6"
-	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/newrelic/go-agent/_integrations/nrmysql"
 	"github.com/newrelic/go-agent/v3/integrations/nrhttprouter"
-	"github.com/newrelic/go-agent/v3/integrations/nrmongo"
 	"github.com/newrelic/go-agent/v3/newrelic"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"net/http"
-	"time"
+	"os"
+	"strings"
 )
 
+// config holds the server wide settings, each store driver parses its own settings, see storeDriver
 type config struct {
-	Port                 string `env:"PORT" envDefault:"8080"`
-	MongodbUri           string `env:"MONGODB_URI,required,notEmpty"`
-	MysqlUri             string `env:"MYSQL_URI,required,notEmpty"`
-	MysqlConnPool        int    `env:"MYSQL_POOL_SIZE" envDefault:"10"`
-	MysqlConnLifetime    int    `env:"MYSQL_CONN_LIFETIME" envDefault:"5"`
-	MaxPayloadBytes      int64  `env:"MAX_PAYLOAD_BYTES" envDefault:"5242880"` // 5mb default
-	MaxConfigValueLength int64  `env:"MAX_CONFIG_VALUE_LENGTH" envDefault:"262144"`
-	NewRelicLicense      string `env:"NR_LICENSE"`
+	Port            string `env:"PORT" envDefault:"8080"`
+	ConfigStore     string `env:"CONFIG_STORE" envDefault:"mongo"`
+	SessionStore    string `env:"SESSION_STORE" envDefault:"mysql"`
+	MaxPayloadBytes int64  `env:"MAX_PAYLOAD_BYTES" envDefault:"5242880"` // 5mb default
+	NewRelicLicense string `env:"NR_LICENSE"`
+	DebugPort       string `env:"DEBUG_PORT"` // serves the expvar stats at /debug/vars, not to be exposed publicly
+	Repository      RepositoryOptions
 }
 
 type maxBytesHandler struct {
@@ -37,55 +31,24 @@ type maxBytesHandler struct {
 
 func (h *maxBytesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, h.maxBytes)
-	h.handler.ServeHTTP(w, r)
-}
-
-func setupMongoDatabase(cfg *config, logger *zap.Logger) (*mongo.Client, *mongo.Collection) {
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	monitor := nrmongo.NewCommandMonitor(nil)
-	mongodb, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.MongodbUri).SetMonitor(monitor))
-
-	if err != nil {
-		logger.Fatal("Failed to create mongodb client", zap.Error(err))
-	}
-
-	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	// mongo.Connect doesn't actually connect, to verify if we can connect properly we have to Ping the server
-	err = mongodb.Ping(ctx, readpref.Primary())
-
-	if err != nil {
-		logger.Fatal("Failed to ping mongodb", zap.Error(err))
-	}
-	cfgCollection := mongodb.Database("runelite").Collection("config")
-
-	_, err = cfgCollection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
-		Keys:    bson.M{"_userId": 1},
-		Options: options.Index().SetUnique(true),
-	})
-
-	if err != nil {
-		logger.Fatal("Failed to create mongodb index", zap.Error(err))
-	}
-	return mongodb, cfgCollection
-}
-
-func setupMysql(cfg *config, logger *zap.Logger) *sql.DB {
-	mysql, err := sql.Open("nrmysql", cfg.MysqlUri)
-	if err != nil {
-		logger.Fatal("Failed to connect to mysql", zap.Error(err))
-	}
-	err = mysql.Ping()
-	if err != nil {
-		logger.Fatal("Failed to ping mysql", zap.Error(err))
+	// compressed bodies are held to the limit once decompressed too, so compressing them can't get past it
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		body, err := decodeRequestBody(encoding, r.Body)
+		if err == errUnsupportedEncoding {
+			w.Header().Set("Accept-Encoding", requestEncodings)
+			http.Error(w, "Unsupported content encoding", http.StatusUnsupportedMediaType)
+			return
+		} else if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		defer body.Close()
+		r.Body = http.MaxBytesReader(w, body, h.maxBytes)
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
 	}
-	mysql.SetConnMaxLifetime(time.Minute * time.Duration(cfg.MysqlConnLifetime))
-	mysql.SetMaxOpenConns(cfg.MysqlConnPool)
-	mysql.SetMaxIdleConns(cfg.MysqlConnPool)
-	return mysql
+	h.handler.ServeHTTP(w, r)
 }
 
 func main() {
@@ -99,18 +62,29 @@ func main() {
 	if err := env.Parse(cfg); err != nil {
 		logger.Fatal("Failed to load env config", zap.Error(err))
 	}
-	mongodb, cfgCollection := setupMongoDatabase(cfg, logger)
-
+	stores, err := OpenStores(cfg, logger)
+	if err != nil {
+		logger.Fatal("Failed to open stores", zap.Error(err))
+	}
 	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := mongodb.Disconnect(ctx); err != nil {
-			logger.Fatal("Failed to disconnect from mongodb", zap.Error(err))
+		if err := stores.Close(); err != nil {
+			logger.Error("Failed to close stores", zap.Error(err))
 		}
 	}()
 
-	mysql := setupMysql(cfg, logger)
-	defer mysql.Close()
+	// `config-server reencrypt` re-encrypts the stored values after the encryption keys or patterns changed and exits
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		reencrypter, ok := stores.Config.(ValueReencrypter)
+		if !ok {
+			logger.Fatal(cfg.ConfigStore + " store doesn't encrypt values")
+		}
+		rewritten, err := reencrypter.ReencryptValues(context.Background())
+		if err != nil {
+			logger.Fatal("Failed to re-encrypt values", zap.Int("rewritten", rewritten), zap.Error(err))
+		}
+		logger.Info("Re-encrypted values", zap.Int("rewritten", rewritten))
+		return
+	}
 
 	nrelic, err := newrelic.NewApplication(
 		newrelic.ConfigAppName("config-server"),
@@ -122,21 +96,54 @@ func main() {
 		logger.Info("NewRelic agent is enabled")
 	}
 	router := nrhttprouter.New(nrelic)
-	handlers := NewHandlers(logger, NewConfigRepository(cfgCollection, cfg.MaxConfigValueLength))
+	broker := NewMemoryChangeBroker()
+	repository := NewPublishingConfigRepository(stores.Config, broker)
+	handlers := NewHandlers(logger, repository, broker)
+	socketHandler := NewSocketHandler(logger, repository, broker, cfg.MaxPayloadBytes)
 
-	sessionCache, err := NewSessionCache(NewSessionRepository(mysql), 10000)
+	sessionCache, err := NewSessionCache(stores.Session, 10000)
 	if err != nil {
 		logger.Fatal("Failed to create session cache", zap.Error(err))
 	}
 	authFilter := NewAuthFilter(sessionCache)
 
-	router.GET("/config", authFilter.Filtered(handlers.HandleGet))
-	router.PUT("/config/:key", authFilter.Filtered(handlers.HandlePut))
-	router.PATCH("/config", authFilter.Filtered(handlers.HandlePatch))
-	router.DELETE("/config/:key", authFilter.Filtered(handlers.HandleDelete))
+	// every config route is also scoped to a profile, the unscoped routes use the default profile
+	for _, prefix := range []string{"", "/profiles/:profile"} {
+		router.GET(prefix+"/config", authFilter.Filtered(handlers.HandleGet))
+		router.GET(prefix+"/config/:key", authFilter.Filtered(keyRoute(handlers.HandleGetKey, map[string]AuthorizedHttpHandle{
+			"revisions": handlers.HandleRevisions,
+			"changes":   handlers.HandleChanges,
+			"events":    handlers.HandleEvents,
+			"socket":    socketHandler.HandleSocket,
+			"diff":      handlers.HandleDiff,
+			"groups":    handlers.HandleListGroups,
+			"usage":     handlers.HandleUsage,
+		})))
+		router.PUT(prefix+"/config/:key", authFilter.Filtered(handlers.HandlePut))
+		router.PATCH(prefix+"/config", authFilter.Filtered(handlers.HandlePatch))
+		router.DELETE(prefix+"/config/:key", authFilter.Filtered(handlers.HandleDelete))
+		router.POST(prefix+"/config/restore", authFilter.Filtered(handlers.HandleRestore))
+		router.POST(prefix+"/config/copy", authFilter.Filtered(handlers.HandleCopy))
+		router.POST(prefix+"/config/delete", authFilter.Filtered(handlers.HandleBulkDelete))
+		router.GET(prefix+"/config/:key/:group", authFilter.Filtered(groupRoute(handlers.HandleGetGroup)))
+		router.DELETE(prefix+"/config/:key/:group", authFilter.Filtered(groupRoute(handlers.HandleDeleteGroup)))
+	}
+	router.GET("/profiles", authFilter.Filtered(handlers.HandleListProfiles))
+	router.POST("/profiles", authFilter.Filtered(handlers.HandleCreateProfile))
+	router.PUT("/profiles/:profile", authFilter.Filtered(handlers.HandleRenameProfile))
+	router.DELETE("/profiles/:profile", authFilter.Filtered(handlers.HandleDeleteProfile))
+
+	if cfg.DebugPort != "" {
+		go func() {
+			logger.Info("Starting debug server on port " + cfg.DebugPort)
+			if err := http.ListenAndServe(":"+cfg.DebugPort, http.DefaultServeMux); err != nil {
+				logger.Error("Failed to start debug server", zap.Error(err))
+			}
+		}()
+	}
 
 	logger.Info("Starting server on port " + cfg.Port)
-	err = http.ListenAndServe(":"+cfg.Port, &maxBytesHandler{handler: router, maxBytes: cfg.MaxPayloadBytes})
+	err = http.ListenAndServe(":"+cfg.Port, &maxBytesHandler{handler: &compressingHandler{handler: router}, maxBytes: cfg.MaxPayloadBytes})
 	if err != nil {
 		logger.Fatal("Failed to start server", zap.Error(err))
 	}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerStoreDriver("memory", func() storeDriver { return &memoryStore{} })
+}
+
+type memoryStoreConfig struct {
+	Sessions []string `env:"MEMORY_SESSIONS"`
+}
+
+// memoryStore keeps everything in process, nothing survives a restart
+type memoryStore struct {
+	config memoryStoreConfig
+}
+
+func (m *memoryStore) Config() interface{} {
+	return &m.config
+}
+
+func (m *memoryStore) Validate() error {
+	_, err := parseStaticSessions(m.config.Sessions)
+	return err
+}
+
+func (m *memoryStore) Open(logger *zap.Logger) error {
+	logger.Warn("Using the in-memory store, nothing will be persisted across restarts")
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+func (m *memoryStore) NewConfigRepository(options RepositoryOptions) (ConfigRepository, error) {
+	return NewMemoryConfigRepository(options), nil
+}
+
+func (m *memoryStore) NewSessionRepository() (SessionRepository, error) {
+	return NewMemorySessionRepository(m.config.Sessions)
+}
+
+// memoryProfile is everything the memory store keeps for a single profile of a user
+type memoryProfile struct {
+	document  configDocument
+	revision  int64
+	revisions []ConfigRevision
+}
+
+type memoryDocumentStore struct {
+	lock             sync.RWMutex
+	users            map[int64]map[string]*memoryProfile
+	historyRetention time.Duration
+}
+
+func NewMemoryConfigRepository(options RepositoryOptions) ConfigRepository {
+	return newDocumentConfigRepository(&memoryDocumentStore{
+		users:            make(map[int64]map[string]*memoryProfile),
+		historyRetention: options.HistoryRetention,
+	}, options)
+}
+
+func (m *memoryDocumentStore) findDocument(userId int64, profile string) (configDocument, int64, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	stored, ok := m.users[userId][profile]
+	if !ok {
+		return nil, 0, nil
+	}
+	// the stored document is only ever replaced under the write lock, callers get a copy of their own to read
+	return stored.document.clone(), stored.revision, nil
+}
+
+func (m *memoryDocumentStore) findRevision(userId int64, profile string) (int64, bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	stored, ok := m.users[userId][profile]
+	if !ok {
+		return 0, false, nil
+	}
+	return stored.revision, true, nil
+}
+
+func (m *memoryDocumentStore) update(userId int64, profile string, update func(document configDocument, revision int64, exists bool) (*ConfigRevision, error)) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stored, ok := m.users[userId][profile]
+	if !ok {
+		stored = &memoryProfile{document: make(configDocument)}
+	}
+	// the update mutates a copy which replaces the stored document once it's recorded, so the documents handed to
+	// readers are never written to
+	document := stored.document.clone()
+	revision, err := update(document, stored.revision, ok)
+
+	if err != nil || revision == nil {
+		return err
+	}
+	stored.document = document
+	stored.revision = revision.Revision
+	stored.revisions = append(stored.revisions, *revision)
+
+	if m.historyRetention > 0 {
+		expiry := time.Now().Add(-m.historyRetention)
+		expired := 0
+		for expired < len(stored.revisions) && stored.revisions[expired].Time.Before(expiry) {
+			expired++
+		}
+		stored.revisions = stored.revisions[expired:]
+	}
+	m.store(userId, profile, stored)
+	return nil
+}
+
+func (m *memoryDocumentStore) store(userId int64, profile string, stored *memoryProfile) {
+	if m.users[userId] == nil {
+		m.users[userId] = make(map[string]*memoryProfile)
+	}
+	m.users[userId][profile] = stored
+}
+
+func (m *memoryDocumentStore) findRevisions(userId int64, profile string, filter RevisionFilter) ([]ConfigRevision, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	stored, ok := m.users[userId][profile]
+	if !ok {
+		return make([]ConfigRevision, 0), nil
+	}
+	return filterRevisions(stored.revisions, filter), nil
+}
+
+func (m *memoryDocumentStore) listProfiles(userId int64) ([]Profile, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	profiles := make([]Profile, 0, len(m.users[userId]))
+	for name, stored := range m.users[userId] {
+		profiles = append(profiles, Profile{Name: name, Revision: stored.revision})
+	}
+	return profiles, nil
+}
+
+func (m *memoryDocumentStore) createProfile(userId int64, profile string, quotas Quotas) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.users[userId][profile]; ok {
+		return ErrProfileExists
+	}
+	profiles := len(m.users[userId])
+	if _, ok := m.users[userId][DefaultProfile]; ok {
+		profiles--
+	}
+	if err := quotas.checkProfiles(profiles); err != nil {
+		return err
+	}
+	m.store(userId, profile, &memoryProfile{document: make(configDocument)})
+	return nil
+}
+
+func (m *memoryDocumentStore) renameProfile(userId int64, profile string, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stored, ok := m.users[userId][profile]
+	if !ok {
+		return ErrProfileNotFound
+	}
+	if _, ok = m.users[userId][name]; ok {
+		return ErrProfileExists
+	}
+	delete(m.users[userId], profile)
+	m.users[userId][name] = stored
+	return nil
+}
+
+func (m *memoryDocumentStore) deleteProfile(userId int64, profile string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.users[userId][profile]; !ok {
+		return ErrProfileNotFound
+	}
+	delete(m.users[userId], profile)
+	return nil
+}
+
+type memorySessionRepository struct {
+	sessions map[string]int64
+}
+
+// NewMemorySessionRepository creates a session repository from a static list of uuid:userId pairs
+func NewMemorySessionRepository(sessions []string) (SessionRepository, error) {
+	parsed, err := parseStaticSessions(sessions)
+	if err != nil {
+		return nil, err
+	}
+	return memorySessionRepository{sessions: parsed}, nil
+}
+
+func parseStaticSessions(sessions []string) (map[string]int64, error) {
+	parsed := make(map[string]int64, len(sessions))
+	for _, session := range sessions {
+		parts := strings.SplitN(session, ":", 2)
+
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("invalid session, expected uuid:userId but got " + session)
+		}
+		userId, err := strconv.ParseInt(parts[1], 10, 64)
+
+		if err != nil {
+			return nil, err
+		}
+		parsed[parts[0]] = userId
+	}
+	return parsed, nil
+}
+
+func (m memorySessionRepository) FindUserIdByUuid(ctx context.Context, uuid string) (int64, error) {
+	userId, ok := m.sessions[uuid]
+	if !ok {
+		return -1, sql.ErrNoRows
+	}
+	return userId, nil
+}
+
+func (m memorySessionRepository) UpdateLastUsedByUserId(userId int64) error {
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMemoryRepositoryRoundTrip(t *testing.T) {
+	repository := NewMemoryConfigRepository(contractOptions)
+	ctx := context.Background()
+
+	failedKeys, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: []ConfigEntry{
+		{Key: "grounditems.highlightedItems", Value: "Abyssal whip,Dragon bones"},
+		{Key: "grounditems.defaultColor", Value: "-16777216"},
+		{Key: "raids.layout.enabled", Value: "true"},
+		{Key: "$set.value", Value: "1"},
+		{Key: "_id.value", Value: "1"},
+		{Key: "broken.value", Value: "{invalid"},
+		{Key: "oversize.value", Value: strings.Repeat("a", contractMaxConfigValueLength+1)},
+	}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"oversize.value"}; !reflect.DeepEqual(failedKeys, expected) {
+		t.Errorf("Got failed keys %v but expected %v", failedKeys, expected)
+	}
+	configuration, err := repository.FindByUserId(ctx, 1, DefaultProfile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConfigEntry{
+		{Key: "$set.value", Value: "1", Type: ValueNumber},
+		{Key: "_id.value", Value: "1", Type: ValueNumber},
+		{Key: "broken.value", Value: "{invalid", Type: ValueString},
+		{Key: "grounditems.defaultColor", Value: "-16777216", Type: ValueNumber},
+		{Key: "grounditems.highlightedItems", Value: "Abyssal whip,Dragon bones", Type: ValueString},
+		{Key: "raids.layout.enabled", Value: "true", Type: ValueBoolean},
+	}
+	if !reflect.DeepEqual(sortedEntries(configuration.Config), expected) {
+		t.Errorf("Got configuration %v but expected %v", configuration.Config, expected)
+	}
+}
+
+func TestMemoryRepositoryMissingDocument(t *testing.T) {
+	repository := NewMemoryConfigRepository(contractOptions)
+	ctx := context.Background()
+
+	if err := repository.DeleteKey(ctx, 1, DefaultProfile, "group.key"); err != nil {
+		t.Errorf("Deleting from a missing document failed: %s", err)
+	}
+	if configuration, err := repository.FindByUserId(ctx, 1, DefaultProfile); configuration != nil || err != nil {
+		t.Errorf("Got configuration %v for a missing document", configuration)
+	}
+}
+
+func TestMemoryRepositoryDeleteKeepsDocument(t *testing.T) {
+	repository := NewMemoryConfigRepository(contractOptions)
+	ctx := context.Background()
+
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "group.key", Value: "value"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.DeleteKey(ctx, 1, DefaultProfile, "group.key"); err != nil {
+		t.Fatal(err)
+	}
+	configuration, err := repository.FindByUserId(ctx, 1, DefaultProfile)
+
+	if err != nil || configuration == nil || len(configuration.Config) != 0 {
+		t.Errorf("Got configuration %v but expected an empty document", configuration)
+	}
+}
+
+func TestMemoryRepositoryEmptyUpdatePath(t *testing.T) {
+	repository := NewMemoryConfigRepository(contractOptions)
+	ctx := context.Background()
+
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "nogroup", Value: "value"}); err == nil {
+		t.Errorf("Saved a key without a group")
+	}
+	_, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: []ConfigEntry{
+		{Key: "group.key", Value: "value"},
+		{Key: "nogroup", Value: "value"},
+	}})
+
+	if err == nil {
+		t.Errorf("Saved a batch containing a key without a group")
+	}
+	if configuration, _ := repository.FindByUserId(ctx, 1, DefaultProfile); configuration != nil {
+		t.Errorf("Failed batch was partially applied, got %v", configuration.Config)
+	}
+}
+
+func TestMemoryRepositoryConcurrentReadsAndWrites(t *testing.T) {
+	repository := NewMemoryConfigRepository(contractOptions)
+	ctx := context.Background()
+
+	var wait sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		wait.Add(1)
+		go func(writer int) {
+			defer wait.Done()
+			for i := 0; i < 100; i++ {
+				entry := &ConfigEntry{Key: "group.key" + strconv.Itoa(writer), Value: strconv.Itoa(i)}
+				if err := repository.Save(ctx, 1, DefaultProfile, entry); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(writer)
+	}
+	for reader := 0; reader < 4; reader++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := 0; i < 100; i++ {
+				if _, err := repository.FindByUserId(ctx, 1, DefaultProfile); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := repository.FindKey(ctx, 1, DefaultProfile, "group.key0"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wait.Wait()
+
+	configuration, err := repository.FindByUserId(ctx, 1, DefaultProfile)
+	if err != nil || configuration == nil || len(configuration.Config) != 4 || configuration.Revision != 400 {
+		t.Errorf("Got configuration %v but expected 4 keys at revision 400", configuration)
+	}
+}
+
+func TestMemorySessionRepository(t *testing.T) {
+	repository, err := NewMemorySessionRepository([]string{"f1b7d3c4-uuid:1000"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userId, err := repository.FindUserIdByUuid(context.Background(), "f1b7d3c4-uuid"); err != nil || userId != 1000 {
+		t.Errorf("Got user id %d but expected %d", userId, 1000)
+	}
+	if _, err := repository.FindUserIdByUuid(context.Background(), "missing"); err == nil {
+		t.Errorf("Found user id for a missing session")
+	}
+	if _, err := NewMemorySessionRepository([]string{"malformed"}); err == nil {
+		t.Errorf("Accepted a malformed session")
+	}
+}
+
+func sortedEntries(entries []ConfigEntry) []ConfigEntry {
+	sorted := append([]ConfigEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted
+}
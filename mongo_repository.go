@@ -4,60 +4,310 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/newrelic/go-agent/v3/integrations/nrmongo"
 	"github.com/newrelic/go-agent/v3/newrelic"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"regexp"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.uber.org/zap"
+	"net/url"
 	"strings"
 	"time"
 )
 
-var maybeJsonPattern = regexp.MustCompile("^[\\-0-9{\\[\"]|true|false")
+var errEmptyUpdatePath = errors.New("empty update path")
 
+// mongoConfigRepository stores a document per user profile in collection holding the profile's revision, each group of
+// its configuration is stored in its own document of groups so no single document has to hold the whole configuration
 type mongoConfigRepository struct {
-	collection           *mongo.Collection
-	maxConfigValueLength int64
+	configWriter
+	collection *mongo.Collection
+	groups     *mongo.Collection
+	history    *mongo.Collection
+	codec      valueCodec
 }
 
-func NewConfigRepository(collection *mongo.Collection, maxConfigValueLength int64) ConfigRepository {
-	return &mongoConfigRepository{
-		collection:           collection,
-		maxConfigValueLength: maxConfigValueLength,
-	}
+// mongoRevision is a ConfigRevision as stored in the history collection
+type mongoRevision struct {
+	UserId   int64          `bson:"_userId"`
+	Profile  string         `bson:"_profile,omitempty"`
+	Revision int64          `bson:"revision"`
+	Time     time.Time      `bson:"time"`
+	Changes  []ConfigChange `bson:"changes"`
+	// Keys is mongoKeyEncoding for revisions recording keys as they were written, older ones recorded the keys with
+	// their field's dots rewritten like the documents did
+	Keys int `bson:"keys,omitempty"`
 }
 
-func invalidConfigKey(key string) bool {
-	// $ and _ are reserved prefixes for mongodb
-	return key == "" || strings.HasPrefix(key, "$") || strings.HasPrefix(key, "_")
+func NewConfigRepository(collection *mongo.Collection, groups *mongo.Collection, history *mongo.Collection, options RepositoryOptions) ConfigRepository {
+	repository := &mongoConfigRepository{
+		collection: collection,
+		groups:     groups,
+		history:    history,
+		codec:      newValueCodec(options),
+	}
+	repository.configWriter = configWriter{
+		apply:                repository.apply,
+		find:                 repository.FindByUserId,
+		maxConfigValueLength: options.MaxConfigValueLength,
+		quotas:               options.Quotas,
+	}
+	return repository
 }
 
-func sanitizeConfigKey(key string) string {
+// splitConfigPath splits a config key into its group, the prefix before the first dot, and the field it's stored as
+// within the group. Keys with an empty group or field can't be addressed by an update and are rejected.
+func splitConfigPath(key string) (string, string, error) {
 	parts := strings.SplitN(key, ".", 2)
 
-	if len(parts) != 2 {
-		return ""
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errEmptyUpdatePath
 	}
-	return parts[0] + "." + strings.ReplaceAll(parts[1], ".", ":")
+	return parts[0], parts[1], nil
 }
 
-func serializeGroup(groupKey string, group interface{}) []ConfigEntry {
-	groupMap := group.(map[string]interface{})
-	entries := make([]ConfigEntry, len(groupMap))
-	idx := 0
-	for key, value := range groupMap {
-		serializedValue, err := serializeGroupValue(value)
+// configPath returns the group and field a key is stored under, ok is false when no valid key could be stored there
+func configPath(key string) (group string, field string, ok bool) {
+	group, field, err := splitConfigPath(key)
+	return group, field, err == nil
+}
 
-		if err != nil {
+// legacyConfigField decodes a field stored before keys were stored losslessly, every dot of a field used to be
+// rewritten into a colon and was never restored. Colons are assumed to have been dots, as they practically always were.
+func legacyConfigField(field string) string {
+	return strings.ReplaceAll(field, ":", ".")
+}
+
+// legacyMongoField is the name a field was stored as before keys were stored losslessly, see legacyConfigField
+func legacyMongoField(field string) string {
+	return strings.ReplaceAll(field, ".", ":")
+}
+
+// legacyConfigKey decodes a key recorded in the history before keys were stored losslessly, see legacyConfigField
+func legacyConfigKey(key string) string {
+	group, field, err := splitConfigPath(key)
+	if err != nil {
+		return key
+	}
+	return group + "." + legacyConfigField(field)
+}
+
+// mongoKeyEncoding is stored as _keys in documents whose group and field names are encoded by encodeMongoName.
+// Documents without it predate the encoding, they're decoded with legacyConfigField until they've been migrated.
+const mongoKeyEncoding = 1
+
+// encodeMongoName escapes the characters mongodb doesn't allow in field names as %XX, along with a leading _ which
+// is reserved for the document's own fields. % itself is escaped too so the encoding can always be reversed.
+func encodeMongoName(name string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c == '%' || c == '.' || c == '$' || c == 0 || i == 0 && c == '_' {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		} else {
+			encoded.WriteByte(c)
+		}
+	}
+	return encoded.String()
+}
+
+func decodeMongoName(name string) string {
+	decoded, err := url.PathUnescape(name)
+	if err != nil {
+		return name
+	}
+	return decoded
+}
+
+// mongoPath is the update path a key is stored at in documents using mongoKeyEncoding
+func mongoPath(group string, field string) string {
+	return encodeMongoName(group) + "." + encodeMongoName(field)
+}
+
+// mongoValueEncoding is stored as _values in documents storing their values as mongoValue returns them. Documents
+// without it predate the encoding, they stored values parsed when their text looked like JSON and are read with
+// legacyConfigValue until they've been migrated.
+const mongoValueEncoding = 1
+
+// mongoGroupDocuments is stored as _groups in user documents whose groups are stored in their own documents. Documents
+// without it predate group documents and hold their groups as subdocuments, they're moved out of the user document by
+// migrateMongoDocument. Group documents always use the current key and value encodings.
+const mongoGroupDocuments = 1
+
+// mongoGroupFilter matches the document storing a group of a profile's configuration
+func mongoGroupFilter(userId int64, profile string, group string) bson.M {
+	filter := mongoProfileFilter(userId, profile)
+	filter["_group"] = group
+	return filter
+}
+
+// mongoValue is how a value is stored, its text and type along with the number, boolean or string it holds so
+// documents can be queried by it, e.g. {"runelite.scale.value": {"$gt": 1}}. Compressed and encrypted values store
+// their text as zraw or enc instead and can only be queried by type.
+func mongoValue(value configValue, stored storedValue) bson.M {
+	if stored.Encrypted != nil {
+		return bson.M{"type": string(value.Type), "enc": stored.Encrypted}
+	}
+	if stored.Compressed != nil {
+		return bson.M{"type": string(value.Type), "zraw": stored.Compressed}
+	}
+	encoded := bson.M{"type": string(value.Type), "raw": stored.Raw}
+	if scalar := value.scalar(); scalar != nil {
+		encoded["value"] = scalar
+	}
+	return encoded
+}
+
+// mongoStoredValue reads the type and text of a value stored by mongoValue
+func mongoStoredValue(stored interface{}) (ValueType, storedValue, bool) {
+	fields, _ := stored.(map[string]interface{})
+	valueType, typed := fields["type"].(string)
+	if encrypted, ok := fields["enc"].(primitive.Binary); ok {
+		return ValueType(valueType), storedValue{Encrypted: encrypted.Data}, typed
+	}
+	if compressed, ok := fields["zraw"].(primitive.Binary); ok {
+		return ValueType(valueType), storedValue{Compressed: compressed.Data}, typed
+	}
+	raw, ok := fields["raw"].(string)
+	return ValueType(valueType), storedValue{Raw: raw}, typed && ok
+}
+
+// decodeMongoValue reads key's stored value, encoded is whether its document uses mongoValueEncoding. ok is false for
+// values that can't be read.
+func decodeMongoValue(codec valueCodec, key string, stored interface{}, encoded bool) (configValue, bool) {
+	if !encoded {
+		value, err := legacyConfigValue(stored)
+		return value, err == nil
+	}
+	valueType, text, ok := mongoStoredValue(stored)
+	if !ok {
+		return configValue{}, false
+	}
+	raw, err := codec.decode(key, text)
+	return configValue{Type: valueType, Raw: raw}, err == nil
+}
+
+// mongoDocumentEntries reads the entries of a user document, whichever way its names and values are encoded. User
+// documents only hold values written before group documents, which were never compressed or encrypted.
+func mongoDocumentEntries(document map[string]interface{}) []ConfigEntry {
+	keysEncoded := documentInt(document, "_keys") == mongoKeyEncoding
+	valuesEncoded := documentInt(document, "_values") == mongoValueEncoding
+	entries := make([]ConfigEntry, 0)
+	for groupKey, group := range document {
+		// stored group names never start with _, those are the document's own fields like _rev and _profile
+		if strings.HasPrefix(groupKey, "_") {
+			continue
+		}
+		groupMap, ok := group.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if keysEncoded {
+			groupKey = decodeMongoName(groupKey)
+		}
+		for field, stored := range groupMap {
+			if keysEncoded {
+				field = decodeMongoName(field)
+			} else {
+				field = legacyConfigField(field)
+			}
+			key := groupKey + "." + field
+			if value, ok := decodeMongoValue(valueCodec{}, key, stored, valuesEncoded); ok {
+				entries = append(entries, ConfigEntry{Key: key, Value: value.Raw, Type: value.Type})
+			}
+		}
+	}
+	return entries
+}
+
+// mongoGroupEntries reads the entries of a group document
+func mongoGroupEntries(document map[string]interface{}, codec valueCodec) []ConfigEntry {
+	group, _ := document["_group"].(string)
+	entries := make([]ConfigEntry, 0, len(document))
+	for field, stored := range document {
+		// like in user documents stored names never start with _
+		if strings.HasPrefix(field, "_") {
 			continue
 		}
-		entries[idx].Key = groupKey + "." + key
-		entries[idx].Value = serializedValue
-		idx++
+		key := group + "." + decodeMongoName(field)
+		if value, ok := decodeMongoValue(codec, key, stored, true); ok {
+			entries = append(entries, ConfigEntry{Key: key, Value: value.Raw, Type: value.Type})
+		}
 	}
 	return entries
 }
 
+// hasMongoFields reports whether a group document still stores any field
+func hasMongoFields(document map[string]interface{}) bool {
+	for field := range document {
+		if !strings.HasPrefix(field, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitMongoDocument splits a user document using the current encodings into the user document it's left as, holding
+// only its own fields, and a document per group
+func splitMongoDocument(document map[string]interface{}) (map[string]interface{}, []map[string]interface{}) {
+	user := make(map[string]interface{})
+	groups := make([]map[string]interface{}, 0)
+	for groupKey, group := range document {
+		fields, ok := group.(map[string]interface{})
+		if strings.HasPrefix(groupKey, "_") || !ok {
+			user[groupKey] = group
+			continue
+		}
+		groupDocument := map[string]interface{}{"_userId": document["_userId"], "_group": decodeMongoName(groupKey)}
+		if profile, ok := document["_profile"].(string); ok {
+			groupDocument["_profile"] = profile
+		}
+		for field, stored := range fields {
+			groupDocument[field] = stored
+		}
+		groups = append(groups, groupDocument)
+	}
+	user["_groups"] = mongoGroupDocuments
+	return user, groups
+}
+
+// encodeMongoDocument migrates a document to mongoKeyEncoding and mongoValueEncoding, whichever it predates. Values
+// that can't be read are kept as they are.
+func encodeMongoDocument(document map[string]interface{}) map[string]interface{} {
+	keysEncoded := documentInt(document, "_keys") == mongoKeyEncoding
+	valuesEncoded := documentInt(document, "_values") == mongoValueEncoding
+	migrated := make(map[string]interface{}, len(document)+2)
+	for groupKey, group := range document {
+		groupMap, ok := group.(map[string]interface{})
+		if strings.HasPrefix(groupKey, "_") || !ok {
+			migrated[groupKey] = group
+			continue
+		}
+		fields := make(map[string]interface{}, len(groupMap))
+		for field, stored := range groupMap {
+			if !keysEncoded {
+				field = encodeMongoName(legacyConfigField(field))
+			}
+			if !valuesEncoded {
+				if value, err := legacyConfigValue(stored); err == nil {
+					stored = mongoValue(value, storedValue{Raw: value.Raw})
+				}
+			}
+			fields[field] = stored
+		}
+		if !keysEncoded {
+			groupKey = encodeMongoName(groupKey)
+		}
+		migrated[groupKey] = fields
+	}
+	migrated["_keys"] = mongoKeyEncoding
+	migrated["_values"] = mongoValueEncoding
+	return migrated
+}
+
 func serializeGroupValue(value interface{}) (string, error) {
 	switch value.(type) {
 	case string:
@@ -71,106 +321,1056 @@ func serializeGroupValue(value interface{}) (string, error) {
 	}
 }
 
-func deserializeGroupValue(value string, maxLength int64) (interface{}, error) {
+// mongoProfileFilter matches the document, or history, of a profile. The default profile has no _profile so documents
+// written before profiles were introduced belong to it.
+func mongoProfileFilter(userId int64, profile string) bson.M {
+	if profile == DefaultProfile {
+		return bson.M{"_userId": userId, "_profile": nil}
+	}
+	return bson.M{"_userId": userId, "_profile": profile}
+}
 
-	if int64(len(value)) > maxLength {
-		return nil, errors.New("value exceeds max length")
-	} else if maybeJsonPattern.MatchString(value) {
-		// this should be safe to deserialize without much validation https://go-review.googlesource.com/c/go/+/199837
-		var deserializedValue interface{}
-		err := json.Unmarshal([]byte(value), &deserializedValue)
-		if err != nil {
+// mongoProfileName is the stored _profile of a profile, empty for the default profile
+func mongoProfileName(profile string) string {
+	if profile == DefaultProfile {
+		return ""
+	}
+	return profile
+}
+
+func (m *mongoConfigRepository) FindByUserId(ctx context.Context, userId int64, profile string) (*Configuration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	var configuration *Configuration
+	err := m.readConsistently(ctx, userId, profile, func() (*int64, error) {
+		configuration = nil
+		var document map[string]interface{}
+
+		err := m.collection.FindOne(
+			ctx,
+			mongoProfileFilter(userId, profile),
+			options.FindOne().SetProjection(bson.M{"_id": 0, "_userId": 0}),
+		).Decode(&document)
+
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		} else if err != nil {
 			return nil, err
 		}
-		return deserializedValue, nil
+		entries := mongoDocumentEntries(document)
+		if documentInt(document, "_groups") == mongoGroupDocuments {
+			cursor, err := m.groups.Find(
+				ctx,
+				mongoProfileFilter(userId, profile),
+				options.Find().SetProjection(bson.M{"_id": 0, "_userId": 0, "_profile": 0}),
+			)
+			if err != nil {
+				return nil, err
+			}
+			var groups []map[string]interface{}
+			if err = cursor.All(ctx, &groups); err != nil {
+				return nil, err
+			}
+			for _, group := range groups {
+				entries = append(entries, mongoGroupEntries(group, m.codec)...)
+			}
+		}
+		configuration = &Configuration{
+			Config:   entries,
+			Revision: documentInt(document, "_rev"),
+		}
+		return &configuration.Revision, nil
+	})
+	return configuration, err
+}
+
+func (m *mongoConfigRepository) FindGroup(ctx context.Context, userId int64, profile string, group string) (*Configuration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	// the document may not have been migrated yet, so the group is projected wherever either encoding stores it
+	projection := bson.M{"_id": 0, "_rev": 1, "_keys": 1, "_values": 1, "_groups": 1}
+	if group != "" {
+		projection[encodeMongoName(group)] = 1
+		if !strings.HasPrefix(group, "_") && !strings.Contains(group, "$") {
+			projection[group] = 1
+		}
 	}
-	return value, nil
+	var configuration *Configuration
+	err := m.readConsistently(ctx, userId, profile, func() (*int64, error) {
+		configuration = nil
+		var document map[string]interface{}
+
+		err := m.collection.FindOne(
+			ctx,
+			mongoProfileFilter(userId, profile),
+			options.FindOne().SetProjection(projection),
+		).Decode(&document)
+
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries := make([]ConfigEntry, 0)
+		for _, entry := range mongoDocumentEntries(document) {
+			if configGroup(entry.Key) == group {
+				entries = append(entries, entry)
+			}
+		}
+		if documentInt(document, "_groups") == mongoGroupDocuments {
+			var groupDocument map[string]interface{}
+			err = m.groups.FindOne(
+				ctx,
+				mongoGroupFilter(userId, profile, group),
+				options.FindOne().SetProjection(bson.M{"_id": 0, "_userId": 0, "_profile": 0}),
+			).Decode(&groupDocument)
+
+			if err != nil && err != mongo.ErrNoDocuments {
+				return nil, err
+			}
+			entries = append(entries, mongoGroupEntries(groupDocument, m.codec)...)
+		}
+		configuration = &Configuration{
+			Config:   entries,
+			Revision: documentInt(document, "_rev"),
+		}
+		return &configuration.Revision, nil
+	})
+	return configuration, err
 }
 
-func (m *mongoConfigRepository) FindByUserId(ctx context.Context, userId int64) (*Configuration, error) {
+func (m *mongoConfigRepository) FindKey(ctx context.Context, userId int64, profile string, key string) (*ConfigEntry, error) {
+	group, field, ok := configPath(key)
+	if !ok {
+		return nil, nil
+	}
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
 	defer cancel()
 
+	// the document may not have been migrated yet, so the key is projected wherever either encoding stores it. Legacy
+	// documents stored the field's dots as colons, and a field holding colons was never stored that way.
+	projection := bson.M{"_id": 0, "_keys": 1, "_values": 1, "_groups": 1, mongoPath(group, field): 1}
+	if !strings.HasPrefix(group, "_") && !strings.ContainsAny(group+field, "$:") {
+		projection[group+"."+legacyMongoField(field)] = 1
+	}
 	var document map[string]interface{}
 
 	err := m.collection.FindOne(
 		ctx,
-		bson.M{"_userId": userId},
-		options.FindOne().SetProjection(bson.M{"_id": 0, "_userId": 0}),
+		mongoProfileFilter(userId, profile),
+		options.FindOne().SetProjection(projection),
 	).Decode(&document)
 
 	if err == mongo.ErrNoDocuments {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
-	} else {
-		entries := make([]ConfigEntry, 0)
-		for groupKey, group := range document {
-			entries = append(entries, serializeGroup(groupKey, group)...)
+	}
+	entries := mongoDocumentEntries(document)
+	if documentInt(document, "_groups") == mongoGroupDocuments {
+		document = nil
+		err = m.groups.FindOne(
+			ctx,
+			mongoGroupFilter(userId, profile, group),
+			options.FindOne().SetProjection(bson.M{"_id": 0, "_group": 1, encodeMongoName(field): 1}),
+		).Decode(&document)
+
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
 		}
-		configuration := &Configuration{
-			Config: entries,
+		entries = mongoGroupEntries(document, m.codec)
+	}
+	for _, entry := range entries {
+		if entry.Key == key {
+			return &entry, nil
 		}
-		return configuration, nil
 	}
+	return nil, nil
 }
 
-func (m *mongoConfigRepository) Save(ctx context.Context, userId int64, entry *ConfigEntry) error {
-	key := entry.Key
+func (m *mongoConfigRepository) FindCurrentRevision(ctx context.Context, userId int64, profile string) (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	var document map[string]interface{}
+
+	err := m.collection.FindOne(
+		ctx,
+		mongoProfileFilter(userId, profile),
+		options.FindOne().SetProjection(bson.M{"_id": 0, "_rev": 1}),
+	).Decode(&document)
 
-	if invalidConfigKey(key) {
-		return errors.New("invalid config key")
+	if err == mongo.ErrNoDocuments {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
 	}
-	value, err := deserializeGroupValue(entry.Value, m.maxConfigValueLength)
+	return documentInt(document, "_rev"), true, nil
+}
+
+// documentInt reads an integer field of a user document like the _rev counter, $inc stores it as whatever integer
+// type fits
+func documentInt(document map[string]interface{}, name string) int64 {
+	switch value := document[name].(type) {
+	case int:
+		return int64(value)
+	case int32:
+		return int64(value)
+	case int64:
+		return value
+	case float64:
+		return int64(value)
+	default:
+		return 0
+	}
+}
+
+// errMongoReadRaced is returned by reads that kept being overtaken by writes to the configuration they read
+var errMongoReadRaced = errors.New("configuration kept changing while it was read")
+
+const mongoReadAttempts = 5
+
+// readConsistently runs read, which reads a profile's user document and then its group documents, until the
+// revision of the user document read is still current once read returns. Writes increment the revision in the
+// transaction updating the group documents, so the groups read are then those of the revision read. Reads don't need
+// a transaction of their own this way. read returns a nil revision for a missing profile, which isn't checked.
+func (m *mongoConfigRepository) readConsistently(ctx context.Context, userId int64, profile string, read func() (*int64, error)) error {
+	for attempt := 1; attempt <= mongoReadAttempts; attempt++ {
+		revision, err := read()
+
+		if err != nil || revision == nil {
+			return err
+		}
+		current, ok, err := m.FindCurrentRevision(ctx, userId, profile)
+		if err != nil {
+			return err
+		} else if ok && current == *revision {
+			return nil
+		}
+	}
+	return errMongoReadRaced
+}
 
+// mongoTransaction runs fn in a transaction of collection's client, writes span a user document and its group
+// documents so they need MongoDB to run as a replica set. The driver retries fn on transient errors like write
+// conflicts with concurrent transactions.
+func mongoTransaction(ctx context.Context, collection *mongo.Collection, fn func(ctx mongo.SessionContext) error) error {
+	session, err := collection.Database().Client().StartSession()
 	if err != nil {
 		return err
 	}
-	update := bson.M{"$set": bson.M{sanitizeConfigKey(key): value}}
-
-	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
-	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
-	defer cancel()
-	_, err = m.collection.UpdateOne(ctx, bson.M{"_userId": userId}, update, options.Update().SetUpsert(true))
+	defer session.EndSession(ctx)
 
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(ctx)
+	}, options.Transaction().SetReadConcern(readconcern.Snapshot()))
 	return err
 }
 
-func (m *mongoConfigRepository) SaveBatch(ctx context.Context, userId int64, configuration *Configuration) ([]string, error) {
-	entries := bson.M{}
-	failedKeys := make([]string, 0)
-	for _, entry := range configuration.Config {
-		if invalidConfigKey(entry.Key) {
-			failedKeys = append(failedKeys, entry.Key)
-			continue
+// mongoDocumentTooLarge reports whether err is mongodb refusing to grow a document past its 16MB limit
+func mongoDocumentTooLarge(err error) bool {
+	var serverErr mongo.ServerError
+	// BSONObjectTooLarge, or an update growing the document too large
+	return errors.As(err, &serverErr) && (serverErr.HasErrorCode(10334) || serverErr.HasErrorCode(17419) || serverErr.HasErrorCode(17420))
+}
+
+// mongoLegacyFilter matches the documents predating mongoKeyEncoding, mongoValueEncoding or mongoGroupDocuments
+func mongoLegacyFilter() bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"_keys": bson.M{"$ne": mongoKeyEncoding}},
+		bson.M{"_values": bson.M{"$ne": mongoValueEncoding}},
+		bson.M{"_groups": bson.M{"$ne": mongoGroupDocuments}},
+	}}
+}
+
+// migrateMongoDocument re-encodes the document matching filter if it predates one of the encodings and moves its groups
+// to their own documents, migrated is whether there was such a document. Both happen in a single transaction.
+func migrateMongoDocument(ctx context.Context, collection *mongo.Collection, groups *mongo.Collection, filter bson.M) (bool, error) {
+	legacyFilter := mongoLegacyFilter()
+	for name, value := range filter {
+		legacyFilter[name] = value
+	}
+	migrated := false
+	err := mongoTransaction(ctx, collection, func(ctx mongo.SessionContext) error {
+		migrated = false
+		var document map[string]interface{}
+		err := collection.FindOne(ctx, legacyFilter).Decode(&document)
+
+		if err == mongo.ErrNoDocuments {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		user, groupDocuments := splitMongoDocument(encodeMongoDocument(document))
+		for _, group := range groupDocuments {
+			_, err = groups.ReplaceOne(
+				ctx,
+				bson.M{"_userId": group["_userId"], "_profile": group["_profile"], "_group": group["_group"]},
+				group,
+				options.Replace().SetUpsert(true),
+			)
+			if err != nil {
+				return err
+			}
 		}
-		value, err := deserializeGroupValue(entry.Value, m.maxConfigValueLength)
+		if _, err = collection.ReplaceOne(ctx, bson.M{"_id": document["_id"]}, user); err != nil {
+			return err
+		}
+		migrated = true
+		return nil
+	})
+	return migrated, err
+}
 
+// mongoMigrationBatch is the number of documents migrateMongoDocuments migrates before recording its progress
+const mongoMigrationBatch = 500
+
+// mongoGroupsMigration is the _id of the document recording the progress of migrateMongoDocuments in the migrations
+// collection
+const mongoGroupsMigration = "groups"
+
+// migrateMongoDocuments migrates every document predating one of the encodings or group documents in batches, in _id
+// order. The last _id of each batch is recorded in migrations so a migration that was interrupted resumes where it
+// stopped and a finished one isn't repeated. Writes migrate the document they're made to on their own, including
+// documents written behind the migration by instances that haven't been upgraded yet, this spares reads decoding the
+// legacy encodings and makes every value queryable.
+func migrateMongoDocuments(ctx context.Context, collection *mongo.Collection, groups *mongo.Collection, migrations *mongo.Collection, logger *zap.Logger) (int, error) {
+	var progress struct {
+		Last interface{} `bson:"last"`
+		Done bool        `bson:"done"`
+	}
+	err := migrations.FindOne(ctx, bson.M{"_id": mongoGroupsMigration}).Decode(&progress)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, err
+	} else if progress.Done {
+		return 0, nil
+	}
+
+	migrated := 0
+	for {
+		filter := mongoLegacyFilter()
+		if progress.Last != nil {
+			filter["_id"] = bson.M{"$gt": progress.Last}
+		}
+		batch, err := mongoMigrationIds(ctx, collection, filter)
 		if err != nil {
-			failedKeys = append(failedKeys, entry.Key)
+			return migrated, err
+		}
+		for _, id := range batch {
+			documentCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			ok, err := migrateMongoDocument(documentCtx, collection, groups, bson.M{"_id": id})
+			cancel()
+			if err != nil {
+				return migrated, err
+			} else if ok {
+				migrated++
+			}
+		}
+		update := bson.M{"$set": bson.M{"done": len(batch) < mongoMigrationBatch}}
+		if len(batch) > 0 {
+			progress.Last = batch[len(batch)-1]
+			// instances migrating at the same time never move the progress back
+			update["$max"] = bson.M{"last": progress.Last}
+		}
+		_, err = migrations.UpdateOne(ctx, bson.M{"_id": mongoGroupsMigration}, update, options.Update().SetUpsert(true))
+		if err != nil || len(batch) < mongoMigrationBatch {
+			return migrated, err
+		}
+		logger.Info("Migrating config documents", zap.Int("migrated", migrated))
+	}
+}
+
+// mongoMigrationIds returns the _id of the next batch of documents matching filter
+func mongoMigrationIds(ctx context.Context, collection *mongo.Collection, filter bson.M) ([]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(
+		ctx,
+		filter,
+		options.Find().SetProjection(bson.M{"_id": 1}).SetSort(bson.M{"_id": 1}).SetLimit(mongoMigrationBatch),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var documents []struct {
+		Id interface{} `bson:"_id"`
+	}
+	if err = cursor.All(ctx, &documents); err != nil {
+		return nil, err
+	}
+	ids := make([]interface{}, len(documents))
+	for i, document := range documents {
+		ids[i] = document.Id
+	}
+	return ids, nil
+}
+
+// mongoGroupUpdate sets and unsets the fields of a group document
+type mongoGroupUpdate struct {
+	set        bson.M
+	unset      bson.M
+	projection bson.M
+}
+
+// apply updates the group's document, returning the fields it touched as they were before. A document left without
+// fields is deleted.
+func (u *mongoGroupUpdate) apply(ctx context.Context, groups *mongo.Collection, filter bson.M) (map[string]interface{}, error) {
+	update := bson.M{}
+	if len(u.set) > 0 {
+		update["$set"] = u.set
+	}
+	if len(u.unset) > 0 {
+		update["$unset"] = u.unset
+	}
+	var previous map[string]interface{}
+	err := groups.FindOneAndUpdate(
+		ctx,
+		filter,
+		update,
+		options.FindOneAndUpdate().
+			SetUpsert(len(u.set) > 0).
+			SetProjection(u.projection).
+			SetReturnDocument(options.Before),
+	).Decode(&previous)
+
+	if err == mongo.ErrNoDocuments {
+		// either the document was just created or there was nothing to delete from
+		return nil, nil
+	} else if err != nil || len(u.set) > 0 {
+		return previous, err
+	}
+	var remaining map[string]interface{}
+	if err = groups.FindOne(ctx, filter).Decode(&remaining); err != nil {
+		return nil, err
+	}
+	if !hasMongoFields(remaining) {
+		_, err = groups.DeleteOne(ctx, bson.M{"_id": remaining["_id"]})
+	}
+	return previous, err
+}
+
+// apply updates the documents of the mutated groups and, when that changed anything, increments the revision of the user
+// document in a single transaction. The previous values are projected out of the group documents as they were before
+// the update so the change can be recorded. The precondition is part of the user document's filter, so a document
+// that doesn't match it is simply not found. Writes racing on the same profile both increment the revision, so the
+// transaction retried on their write conflict reads the other's changes.
+func (m *mongoConfigRepository) apply(ctx context.Context, userId int64, profile string, mutations []preparedMutation, precondition Precondition) (*ConfigRevision, error) {
+	groups := make(map[string]*mongoGroupUpdate)
+	upsert := false
+	for _, mutation := range mutations {
+		update, ok := groups[mutation.Group]
+		if !ok {
+			update = &mongoGroupUpdate{set: bson.M{}, unset: bson.M{}, projection: bson.M{"_id": 0}}
+			groups[mutation.Group] = update
+		}
+		name := encodeMongoName(mutation.Field)
+		update.projection[name] = 1
+		if mutation.Delete {
+			update.unset[name] = nil
 		} else {
-			entries[sanitizeConfigKey(entry.Key)] = value
+			stored, err := m.codec.encode(mutation.path(), mutation.Value)
+			if err != nil {
+				return nil, err
+			}
+			update.set[name] = mongoValue(mutation.Value, stored)
+			upsert = true
 		}
 	}
-	update := bson.M{"$set": entries}
+	// a document failing the precondition must not be upserted as a duplicate
+	upsert = upsert && precondition.empty()
 
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
 	defer cancel()
-	_, err := m.collection.UpdateOne(ctx, bson.M{"_userId": userId}, update, options.Update().SetUpsert(true))
-	return failedKeys, err
+
+	filter := mongoProfileFilter(userId, profile)
+	// groups are only stored in their own documents once the user document has been migrated, older documents are
+	// migrated first. Upserts copy the filter's markers into the document they create.
+	filter["_keys"] = mongoKeyEncoding
+	filter["_values"] = mongoValueEncoding
+	filter["_groups"] = mongoGroupDocuments
+	if precondition.Revision != nil {
+		if *precondition.Revision == 0 {
+			// documents written before revisions were introduced don't have a counter yet
+			filter["_rev"] = bson.M{"$in": bson.A{int64(0), nil}}
+		} else {
+			filter["_rev"] = *precondition.Revision
+		}
+	}
+
+	var revision *ConfigRevision
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = mongoTransaction(ctx, m.collection, func(ctx mongo.SessionContext) error {
+			var user map[string]interface{}
+			err := m.collection.FindOne(
+				ctx,
+				filter,
+				options.FindOne().SetProjection(bson.M{"_id": 0, "_rev": 1, "_usage": 1}),
+			).Decode(&user)
+
+			// a missing document is created along with the revision
+			if err != nil && (err != mongo.ErrNoDocuments || !upsert) {
+				return err
+			}
+			// the totals are kept up to date once they've been counted, which is only worth it with quotas to check
+			usage := mongoUsage(user, m.quotas)
+			if usage == nil && m.quotas.enabled() {
+				if usage, err = m.countUsage(ctx, userId, profile); err != nil {
+					return err
+				}
+			}
+			previous := make(map[string]map[string]interface{}, len(groups))
+			for group, update := range groups {
+				if previous[group], err = update.apply(ctx, m.groups, mongoGroupFilter(userId, profile, group)); err != nil {
+					return err
+				}
+			}
+
+			changes := make([]ConfigChange, 0, len(mutations))
+			for _, mutation := range mutations {
+				var previousValue *configValue
+				if stored, existed := previous[mutation.Group][encodeMongoName(mutation.Field)]; existed {
+					if value, ok := decodeMongoValue(m.codec, mutation.path(), stored, true); ok {
+						previousValue = &value
+					}
+				}
+				if change, ok := recordChange(mutation, previousValue); ok {
+					changes = append(changes, change)
+				}
+			}
+			revision = newRevision(documentInt(user, "_rev"), changes)
+
+			if len(changes) == 0 {
+				// nothing is recorded and the revision stays as it is
+				return nil
+			}
+			revision.Revision++
+			update := bson.M{"$inc": bson.M{"_rev": int64(1)}}
+			if usage != nil {
+				after := usage.withChanges(changes)
+				if err = m.quotas.check(usage, after); err != nil {
+					return err
+				}
+				update["$set"] = bson.M{"_usage": mongoUsageDocument(after)}
+			}
+			if _, err = m.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(upsert)); err != nil {
+				return err
+			}
+			sealed, err := m.codec.sealChanges(revision.Changes)
+			if err != nil {
+				return err
+			}
+			_, err = m.history.InsertOne(ctx, mongoRevision{
+				UserId:   userId,
+				Profile:  mongoProfileName(profile),
+				Revision: revision.Revision,
+				Time:     revision.Time,
+				Changes:  sealed,
+				Keys:     mongoKeyEncoding,
+			})
+			return err
+		})
+
+		// a document predating the encodings or group documents isn't matched, and conflicts with the upsert
+		if err != mongo.ErrNoDocuments && !mongo.IsDuplicateKeyError(err) || attempt == maxUpdateAttempts {
+			break
+		}
+		migrated, migrateErr := migrateMongoDocument(ctx, m.collection, m.groups, mongoProfileFilter(userId, profile))
+		if migrateErr != nil {
+			return nil, migrateErr
+		} else if !migrated && err == mongo.ErrNoDocuments {
+			break
+		}
+	}
+
+	if err == mongo.ErrNoDocuments {
+		if !precondition.empty() {
+			return nil, ErrPreconditionFailed
+		}
+		// there was no document to delete from
+		return nil, nil
+	} else if mongoDocumentTooLarge(err) {
+		return nil, ErrConfigTooLarge
+	} else if err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+// mongoUsage reads the running totals of a user document, nil when they haven't been counted yet
+func mongoUsage(document map[string]interface{}, quotas Quotas) *ConfigUsage {
+	stored, ok := document["_usage"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	usage := &ConfigUsage{Keys: int(documentInt(stored, "keys")), Bytes: documentInt(stored, "bytes"), Groups: make(map[string]int64), Quotas: quotas}
+	groups, _ := stored["groups"].(map[string]interface{})
+	for group := range groups {
+		usage.Groups[decodeMongoName(group)] = documentInt(groups, group)
+	}
+	return usage
+}
+
+func mongoUsageDocument(usage *ConfigUsage) bson.M {
+	groups := make(bson.M, len(usage.Groups))
+	for group, size := range usage.Groups {
+		groups[encodeMongoName(group)] = size
+	}
+	return bson.M{"keys": int64(usage.Keys), "bytes": usage.Bytes, "groups": groups}
+}
+
+// countUsage sizes up the group documents of a profile without totals yet, they're stored by the write counting them
+func (m *mongoConfigRepository) countUsage(ctx context.Context, userId int64, profile string) (*ConfigUsage, error) {
+	cursor, err := m.groups.Find(ctx, mongoProfileFilter(userId, profile))
+	if err != nil {
+		return nil, err
+	}
+	var documents []map[string]interface{}
+	if err = cursor.All(ctx, &documents); err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64)
+	for _, document := range documents {
+		for _, entry := range mongoGroupEntries(document, m.codec) {
+			sizes[entry.Key] = entrySize(entry.Key, entry.Value)
+		}
+	}
+	return sizedUsage(sizes, m.quotas), nil
+}
+
+// FindUsage reads the profile's totals once they've been counted, and sizes up its configuration before that
+func (m *mongoConfigRepository) FindUsage(ctx context.Context, userId int64, profile string) (*ConfigUsage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	var user map[string]interface{}
+	err := m.collection.FindOne(ctx, mongoProfileFilter(userId, profile), options.FindOne().SetProjection(bson.M{"_id": 0, "_usage": 1})).Decode(&user)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if usage := mongoUsage(user, m.quotas); usage != nil {
+		return usage, nil
+	}
+	return m.configWriter.FindUsage(ctx, userId, profile)
+}
+
+func (m *mongoConfigRepository) FindRevisions(ctx context.Context, userId int64, profile string, filter RevisionFilter) ([]ConfigRevision, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	revisionFilter := bson.M{"$gt": filter.After}
+	if filter.Before > 0 {
+		revisionFilter["$lt"] = filter.Before
+	}
+	findOptions := options.Find().SetSort(bson.M{"revision": -1})
+	if filter.Limit > 0 {
+		findOptions.SetLimit(int64(filter.Limit))
+	}
+	historyFilter := mongoProfileFilter(userId, profile)
+	historyFilter["revision"] = revisionFilter
+	cursor, err := m.history.Find(ctx, historyFilter, findOptions)
+
+	if err != nil {
+		return nil, err
+	}
+	var stored []mongoRevision
+	if err = cursor.All(ctx, &stored); err != nil {
+		return nil, err
+	}
+	revisions := make([]ConfigRevision, len(stored))
+	for i, revision := range stored {
+		// changes are sealed with their keys as they're stored
+		if err = m.codec.openChanges(revision.Changes); err != nil {
+			return nil, err
+		}
+		if revision.Keys != mongoKeyEncoding {
+			for j := range revision.Changes {
+				revision.Changes[j].Key = legacyConfigKey(revision.Changes[j].Key)
+			}
+		}
+		revisions[i] = ConfigRevision{
+			Revision: revision.Revision,
+			Time:     revision.Time.UTC(),
+			Changes:  revision.Changes,
+		}
+	}
+	return revisions, nil
 }
 
-func (m *mongoConfigRepository) DeleteKey(ctx context.Context, userId int64, key string) error {
-	if invalidConfigKey(key) {
-		return errors.New("invalid config key")
+func (m *mongoConfigRepository) ListProfiles(ctx context.Context, userId int64) ([]Profile, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	cursor, err := m.collection.Find(
+		ctx,
+		bson.M{"_userId": userId},
+		options.Find().SetProjection(bson.M{"_id": 0, "_profile": 1, "_rev": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var documents []map[string]interface{}
+	if err = cursor.All(ctx, &documents); err != nil {
+		return nil, err
+	}
+	profiles := make([]Profile, 0, len(documents))
+	for _, document := range documents {
+		name, _ := document["_profile"].(string)
+		if name == "" {
+			name = DefaultProfile
+		}
+		profiles = append(profiles, Profile{Name: name, Revision: documentInt(document, "_rev")})
 	}
-	unset := bson.M{"$unset": bson.M{sanitizeConfigKey(key): nil}}
+	return withDefaultProfile(profiles), nil
+}
 
+func (m *mongoConfigRepository) CreateProfile(ctx context.Context, userId int64, profile string) error {
+	if err := validateProfile(profile); err != nil {
+		return err
+	}
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
 	defer cancel()
-	_, err := m.collection.UpdateOne(ctx, bson.M{"_userId": userId}, unset)
+
+	inserted, err := m.collection.InsertOne(ctx, bson.M{"_userId": userId, "_profile": profile, "_rev": int64(0), "_keys": mongoKeyEncoding, "_values": mongoValueEncoding, "_groups": mongoGroupDocuments})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrProfileExists
+	} else if err != nil || m.quotas.MaxProfiles == 0 {
+		return err
+	}
+	// the profiles are counted once the new one is in, so concurrent creations past the quota see each other and both
+	// back out rather than both getting the last profile it allows
+	profiles, err := m.collection.CountDocuments(ctx, bson.M{"_userId": userId, "_profile": bson.M{"$ne": nil}})
+	if err == nil {
+		err = m.quotas.checkProfiles(int(profiles) - 1)
+	}
+	if err != nil {
+		if _, deleteErr := m.collection.DeleteOne(ctx, bson.M{"_id": inserted.InsertedID}); deleteErr != nil {
+			return deleteErr
+		}
+	}
 	return err
 }
+
+// RenameProfile renames the documents before their history, a failure in between leaves history behind under the old
+// name which is only reachable again by recreating the profile
+func (m *mongoConfigRepository) RenameProfile(ctx context.Context, userId int64, profile string, name string) error {
+	if err := validateExistingProfile(profile); err != nil {
+		return err
+	}
+	if err := validateProfile(name); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	err := mongoTransaction(ctx, m.collection, func(ctx mongo.SessionContext) error {
+		result, err := m.collection.UpdateOne(ctx, mongoProfileFilter(userId, profile), bson.M{"$set": bson.M{"_profile": name}})
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrProfileExists
+		} else if err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return ErrProfileNotFound
+		}
+		_, err = m.groups.UpdateMany(ctx, mongoProfileFilter(userId, profile), bson.M{"$set": bson.M{"_profile": name}})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = m.history.UpdateMany(ctx, mongoProfileFilter(userId, profile), bson.M{"$set": bson.M{"_profile": name}})
+	return err
+}
+
+func (m *mongoConfigRepository) DeleteProfile(ctx context.Context, userId int64, profile string) error {
+	if err := validateExistingProfile(profile); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	err := mongoTransaction(ctx, m.collection, func(ctx mongo.SessionContext) error {
+		result, err := m.collection.DeleteOne(ctx, mongoProfileFilter(userId, profile))
+		if err != nil {
+			return err
+		} else if result.DeletedCount == 0 {
+			return ErrProfileNotFound
+		}
+		_, err = m.groups.DeleteMany(ctx, mongoProfileFilter(userId, profile))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = m.history.DeleteMany(ctx, mongoProfileFilter(userId, profile))
+	return err
+}
+
+func init() {
+	registerStoreDriver("mongo", func() storeDriver { return &mongoStore{} })
+}
+
+type mongoStoreConfig struct {
+	Uri string `env:"MONGODB_URI"`
+}
+
+type mongoStore struct {
+	config     mongoStoreConfig
+	logger     *zap.Logger
+	client     *mongo.Client
+	collection *mongo.Collection
+	// cancelMigration stops the background migration of legacy documents, migrating is closed once it stopped
+	cancelMigration context.CancelFunc
+	migrating       chan struct{}
+}
+
+func (m *mongoStore) Config() interface{} {
+	return &m.config
+}
+
+func (m *mongoStore) Validate() error {
+	if m.config.Uri == "" {
+		return errors.New("MONGODB_URI is required")
+	}
+	return nil
+}
+
+func (m *mongoStore) Open(logger *zap.Logger) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	monitor := nrmongo.NewCommandMonitor(nil)
+	mongodb, err := mongo.Connect(ctx, options.Client().ApplyURI(m.config.Uri).SetMonitor(monitor))
+
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+	m.client = mongodb
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// mongo.Connect doesn't actually connect, to verify if we can connect properly we have to Ping the server
+	err = mongodb.Ping(ctx, readpref.Primary())
+
+	if err != nil {
+		return fmt.Errorf("failed to ping mongodb: %w", err)
+	}
+	// writes run in transactions, which standalone servers don't support, mongos reports itself as isdbgrid. Rather
+	// than serving reads and failing every write the server doesn't start against them.
+	var hello bson.M
+	err = mongodb.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return fmt.Errorf("failed to check the mongodb deployment: %w", err)
+	} else if hello["setName"] == nil && hello["msg"] != "isdbgrid" {
+		return errors.New("mongodb must run as a replica set for config writes to run in transactions, a single node replica set will do")
+	}
+	m.collection = mongodb.Database("runelite").Collection("config")
+	m.logger = logger
+	return nil
+}
+
+func (m *mongoStore) Close() error {
+	if m.cancelMigration != nil {
+		m.cancelMigration()
+		<-m.migrating
+	}
+	if m.client == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return m.client.Disconnect(ctx)
+}
+
+func (m *mongoStore) NewConfigRepository(repositoryOptions RepositoryOptions) (ConfigRepository, error) {
+	// a user has a document per profile, the index on _userId alone predates profiles and is replaced
+	err := replaceIndex(m.collection, "_userId_1", mongo.IndexModel{
+		Keys:    bson.D{{Key: "_userId", Value: 1}, {Key: "_profile", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mongodb index: %w", err)
+	}
+	groups := m.collection.Database().Collection("config_groups")
+	_, err = groups.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "_userId", Value: 1}, {Key: "_profile", Value: 1}, {Key: "_group", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mongodb groups index: %w", err)
+	}
+	history := m.collection.Database().Collection("config_history")
+	err = replaceIndex(history, "_userId_1_revision_-1", mongo.IndexModel{
+		Keys:    bson.D{{Key: "_userId", Value: 1}, {Key: "_profile", Value: 1}, {Key: "revision", Value: -1}},
+		Options: options.Index().SetUnique(true),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mongodb history index: %w", err)
+	}
+	if err = ensureHistoryExpiry(history, repositoryOptions.HistoryRetention); err != nil {
+		return nil, fmt.Errorf("failed to create mongodb history expiry index: %w", err)
+	}
+	// documents are migrated in the background so a large collection doesn't hold up serving, reads decode the legacy
+	// layouts until then
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancelMigration = cancel
+	m.migrating = make(chan struct{})
+	go func() {
+		defer close(m.migrating)
+		migrations := m.collection.Database().Collection("config_migrations")
+		migrated, err := migrateMongoDocuments(ctx, m.collection, groups, migrations, m.logger)
+		if err != nil && ctx.Err() == nil {
+			m.logger.Error("Failed to migrate config documents, the migration resumes on the next start", zap.Int("migrated", migrated), zap.Error(err))
+		} else if migrated > 0 {
+			m.logger.Info("Migrated config documents", zap.Int("migrated", migrated))
+		}
+	}()
+	return NewConfigRepository(m.collection, groups, history, repositoryOptions), nil
+}
+
+// replaceIndex creates index and then drops the index it supersedes, if it's still around
+func replaceIndex(collection *mongo.Collection, superseded string, index mongo.IndexModel) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := collection.Indexes().CreateOne(ctx, index); err != nil {
+		return err
+	}
+	_, err := collection.Indexes().DropOne(ctx, superseded)
+	if cmdErr, ok := err.(mongo.CommandError); ok && (cmdErr.Name == "IndexNotFound" || cmdErr.Name == "NamespaceNotFound") {
+		return nil
+	}
+	return err
+}
+
+// ensureHistoryExpiry keeps the TTL index of the history collection in sync with the configured retention
+func ensureHistoryExpiry(history *mongo.Collection, retention time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if retention <= 0 {
+		_, err := history.Indexes().DropOne(ctx, "time_expiry")
+		if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Name == "IndexNotFound" {
+			return nil
+		}
+		return err
+	}
+	_, err := history.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"time": 1},
+		Options: options.Index().SetName("time_expiry").SetExpireAfterSeconds(int32(retention.Seconds())),
+	})
+
+	if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Name == "IndexOptionsConflict" {
+		// the retention changed since the index was created
+		return history.Database().RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: history.Name()},
+			{Key: "index", Value: bson.M{"name": "time_expiry", "expireAfterSeconds": int32(retention.Seconds())}},
+		}).Err()
+	}
+	return err
+}
+
+// ReencryptValues re-encrypts the stale values of the group documents and the stale revisions of the history. Each
+// value is only replaced while it's still stored as it was read, one written in the meantime is already current.
+func (m *mongoConfigRepository) ReencryptValues(ctx context.Context) (int, error) {
+	cursor, err := m.groups.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	rewritten := 0
+	for cursor.Next(ctx) {
+		var document map[string]interface{}
+		if err = cursor.Decode(&document); err != nil {
+			return rewritten, err
+		}
+		group, _ := document["_group"].(string)
+		for field, stored := range document {
+			if strings.HasPrefix(field, "_") {
+				continue
+			}
+			key := group + "." + decodeMongoName(field)
+			valueType, text, ok := mongoStoredValue(stored)
+			if !ok || !m.codec.stale(key, text) {
+				continue
+			}
+			raw, err := m.codec.decode(key, text)
+			if err != nil {
+				return rewritten, fmt.Errorf("failed to decrypt %s: %w", key, err)
+			}
+			value := configValue{Type: valueType, Raw: raw}
+			encoded, err := m.codec.encode(key, value)
+			if err != nil {
+				return rewritten, err
+			}
+			filter := bson.M{"_id": document["_id"]}
+			switch {
+			case text.Encrypted != nil:
+				filter[field+".enc"] = text.Encrypted
+			case text.Compressed != nil:
+				filter[field+".zraw"] = text.Compressed
+			default:
+				filter[field+".raw"] = text.Raw
+			}
+			result, err := m.groups.UpdateOne(ctx, filter, bson.M{"$set": bson.M{field: mongoValue(value, encoded)}})
+			if err != nil {
+				return rewritten, err
+			}
+			rewritten += int(result.ModifiedCount)
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return rewritten, err
+	}
+
+	history, err := m.history.Find(ctx, bson.M{})
+	if err != nil {
+		return rewritten, err
+	}
+	defer history.Close(ctx)
+
+	for history.Next(ctx) {
+		var revision struct {
+			Id      interface{}    `bson:"_id"`
+			Changes []ConfigChange `bson:"changes"`
+		}
+		if err = history.Decode(&revision); err != nil {
+			return rewritten, err
+		}
+		if !m.codec.staleChanges(revision.Changes) {
+			continue
+		}
+		sealed, err := m.codec.resealChanges(revision.Changes)
+		if err != nil {
+			return rewritten, err
+		}
+		if _, err = m.history.UpdateOne(ctx, bson.M{"_id": revision.Id}, bson.M{"$set": bson.M{"changes": sealed}}); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, history.Err()
+}
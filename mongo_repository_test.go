@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSerializeGroupValue(t *testing.T) {
@@ -39,61 +46,268 @@ func TestSerializeGroupValue(t *testing.T) {
 	}
 }
 
-func TestDeserializeGroupValue(t *testing.T) {
+func TestMongoNameEncoding(t *testing.T) {
 	tests := []struct {
-		serialized string
-		expected   interface{}
+		name     string
+		expected string
 	}{
-		{serialized: "string", expected: "string"},
-		{serialized: "string with spaces", expected: "string with spaces"},
-		{serialized: "true", expected: true},
-		{serialized: "false", expected: false},
-		{serialized: "1", expected: float64(1)},
-		{serialized: "1.2", expected: 1.2},
-		{serialized: "\"quote\"", expected: "quote"},
-		{serialized: "{\"key\": \"value\"}", expected: map[string]interface{}{"key": "value"}},
+		{name: "theme", expected: "theme"},
+		{name: "a.b:c", expected: "a%2Eb:c"},
+		{name: "$set", expected: "%24set"},
+		{name: "_id", expected: "%5Fid"},
+		{name: "a_b", expected: "a_b"},
+		{name: "100%", expected: "100%25"},
+		{name: "%2E", expected: "%252E"},
 	}
+
 	for _, test := range tests {
+		encoded := encodeMongoName(test.name)
+		if encoded != test.expected {
+			t.Errorf("Got encoded name %s but expected %s", encoded, test.expected)
+		}
+		if decoded := decodeMongoName(encoded); decoded != test.name {
+			t.Errorf("Got decoded name %s but expected %s", decoded, test.name)
+		}
+	}
+}
 
-		switch test.expected.(type) {
-		case map[string]interface{}:
-			if value, err := deserializeGroupValue(test.serialized, 1024); err != nil || !reflect.DeepEqual(value, test.expected) {
-				t.Errorf("Got deserialized %s but expected %s", value, test.expected)
-			}
-		default:
-			if value, err := deserializeGroupValue(test.serialized, 1024); err != nil || value != test.expected {
-				t.Errorf("Got deserialized value %s but expected %s", value, test.expected)
-			}
+func TestMongoDocumentEntries(t *testing.T) {
+	legacy := map[string]interface{}{"_rev": int64(3), "group": map[string]interface{}{"a:b": "legacy", "scale": int32(2)}}
+	// read the migrated document back the way it's stored
+	data, err := bson.Marshal(encodeMongoDocument(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encoded map[string]interface{}
+	if err = bson.Unmarshal(data, &encoded); err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConfigEntry{{Key: "group.a.b", Value: "legacy", Type: ValueString}, {Key: "group.scale", Value: "2", Type: ValueNumber}}
+
+	if entries := sortedEntries(mongoDocumentEntries(legacy)); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Got entries %v but expected %v", entries, expected)
+	}
+	if entries := sortedEntries(mongoDocumentEntries(encoded)); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Got entries %v of the migrated document but expected %v", entries, expected)
+	}
+	group := encoded["group"].(map[string]interface{})
+	if _, ok := group["a%2Eb"]; !ok || encoded["_rev"] != int64(3) {
+		t.Errorf("Got migrated document %v but expected the field encoded and its revision kept", encoded)
+	}
+	if scale := group["scale"]; !reflect.DeepEqual(scale, map[string]interface{}{"type": "number", "raw": "2", "value": float64(2)}) {
+		t.Errorf("Got migrated value %v but expected it typed", scale)
+	}
+}
+
+func TestMongoCompressedValues(t *testing.T) {
+	large := configValue{Type: ValueArray, Raw: "[" + strings.Repeat("\"Abyssal whip\",", 40) + "\"Dragon bones\"]"}
+	compressed := valueCompression{threshold: 64}.compress(large)
+	if compressed == nil {
+		t.Fatal("Expected the value to be compressed")
+	}
+	data, err := bson.Marshal(map[string]interface{}{"_userId": int64(1), "_group": "group", "large": mongoValue(large, storedValue{Compressed: compressed})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document map[string]interface{}
+	if err = bson.Unmarshal(data, &document); err != nil {
+		t.Fatal(err)
+	}
+	stored := document["large"].(map[string]interface{})
+	if _, ok := stored["raw"]; ok || stored["type"] != "array" {
+		t.Errorf("Got stored value %v but expected only its type and compressed text", stored)
+	}
+	expected := []ConfigEntry{{Key: "group.large", Value: large.Raw, Type: ValueArray}}
+	if entries := mongoGroupEntries(document, valueCodec{}); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Got entries %v but expected %v", entries, expected)
+	}
+}
+
+func TestSplitMongoDocument(t *testing.T) {
+	legacy := map[string]interface{}{
+		"_userId":  int64(7),
+		"_profile": "pvm",
+		"_rev":     int64(3),
+		"runelite": map[string]interface{}{"theme": "dark mode"},
+		"group":    map[string]interface{}{"a:b": int32(2)},
+	}
+	user, groups := splitMongoDocument(encodeMongoDocument(legacy))
+
+	for name := range user {
+		if !strings.HasPrefix(name, "_") {
+			t.Errorf("Got group %s left in the user document", name)
+		}
+	}
+	if user["_rev"] != int64(3) || user["_groups"] != mongoGroupDocuments {
+		t.Errorf("Got user document %v but expected its revision kept and it marked as using group documents", user)
+	}
+	entries := make([]ConfigEntry, 0)
+	for _, group := range groups {
+		if group["_userId"] != int64(7) || group["_profile"] != "pvm" {
+			t.Errorf("Got group document %v but expected it to belong to the user's profile", group)
+		}
+		// read the group document back the way it's stored
+		data, err := bson.Marshal(group)
+		if err != nil {
+			t.Fatal(err)
 		}
+		var stored map[string]interface{}
+		if err = bson.Unmarshal(data, &stored); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, mongoGroupEntries(stored, valueCodec{})...)
+	}
+	expected := []ConfigEntry{{Key: "group.a.b", Value: "2", Type: ValueNumber}, {Key: "runelite.theme", Value: "dark mode", Type: ValueString}}
+	if entries = sortedEntries(entries); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Got entries %v but expected %v", entries, expected)
 	}
 }
 
-func TestDeserializeGroupValueExceedMaxLength(t *testing.T) {
-	jsonBomb := strings.Repeat("{\"a\":", 1024) + "[]" + strings.Repeat("}", 1024)
+// testMongoCollections connects to the mongodb at TEST_MONGODB_URI and returns its test config, groups and history
+// collections, the test is skipped when it isn't set
+func testMongoCollections(t *testing.T) (*mongo.Collection, *mongo.Collection, *mongo.Collection) {
+	uri := os.Getenv("TEST_MONGODB_URI")
+	if uri == "" {
+		t.Skip("TEST_MONGODB_URI is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	if value, err := deserializeGroupValue(jsonBomb, 128); err == nil || value != nil {
-		t.Errorf("Deserialized json bomb string")
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
 	}
+	t.Cleanup(func() {
+		client.Disconnect(context.Background())
+	})
+
+	database := client.Database("runelite_test")
+	return database.Collection("config"), database.Collection("config_groups"), database.Collection("config_history")
 }
 
-func TestMaybeJson(t *testing.T) {
+func dropMongoCollections(t *testing.T, collections ...*mongo.Collection) {
+	for _, c := range collections {
+		if err := c.Drop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestMongoConfigRepositoryContract runs the repository contract against the mongodb at TEST_MONGODB_URI
+func TestMongoConfigRepositoryContract(t *testing.T) {
+	collection, groups, history := testMongoCollections(t)
+	testConfigRepositoryContract(t, func(t *testing.T) ConfigRepository {
+		dropMongoCollections(t, collection, groups, history)
+		return NewConfigRepository(collection, groups, history, contractOptions)
+	})
+
+	dropMongoCollections(t, collection, groups, history)
+	testValueReencryption(t, func(options RepositoryOptions) ConfigRepository {
+		return NewConfigRepository(collection, groups, history, options)
+	})
+}
+
+// TestMongoLegacyKeys reads keys out of a document written the way documents were before keys were stored losslessly,
+// with their dots rewritten to colons and their groups held in the user document
+func TestMongoLegacyKeys(t *testing.T) {
+	collection, groups, history := testMongoCollections(t)
+	dropMongoCollections(t, collection, groups, history)
+	ctx := context.Background()
+
+	legacy := bson.M{"_userId": int64(1), "plugin": bson.M{"a:b": "dotted", "scale": 2.0}}
+	if _, err := collection.InsertOne(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+	repository := NewConfigRepository(collection, groups, history, contractOptions)
+
 	tests := []struct {
-		value string
-		json  bool
+		key      string
+		expected *ConfigEntry
 	}{
-		{value: "string", json: false},
-		{value: "string with spaces", json: false},
-		{value: "true", json: true},
-		{value: "false", json: true},
-		{value: "1", json: true},
-		{value: "1.2", json: true},
-		{value: "\"quote\"", json: true},
-		{value: "{\"key\": \"value\"}", json: true},
-		{value: "[42]", json: true},
+		{key: "plugin.a.b", expected: &ConfigEntry{Key: "plugin.a.b", Value: "dotted", Type: ValueString}},
+		{key: "plugin.scale", expected: &ConfigEntry{Key: "plugin.scale", Value: "2", Type: ValueNumber}},
+		// colons were never stored as they are
+		{key: "plugin.a:b"},
 	}
 	for _, test := range tests {
-		if isJson := maybeJsonPattern.MatchString(test.value); isJson != test.json {
-			t.Errorf("Matched value as %t but expected %t", isJson, test.json)
+		entry, err := repository.FindKey(ctx, 1, DefaultProfile, test.key)
+		if err != nil || !reflect.DeepEqual(entry, test.expected) {
+			t.Errorf("Got entry %v, %v for %s but expected %v", entry, err, test.key, test.expected)
+		}
+	}
+}
+
+// TestMongoMigration migrates documents written the way they were before keys and values were encoded and groups were
+// stored in their own documents
+func TestMongoMigration(t *testing.T) {
+	collection, groups, history := testMongoCollections(t)
+	migrations := collection.Database().Collection("config_migrations")
+	dropMongoCollections(t, collection, groups, history, migrations)
+	ctx := context.Background()
+
+	legacy := []interface{}{
+		bson.M{"_userId": int64(1), "runelite": bson.M{"theme": "dark mode"}, "plugin": bson.M{"a:b": "dotted", "scale": 2.0, "list": bson.A{"NOON", "VORKI"}}},
+		bson.M{"_userId": int64(2), "runelite": bson.M{"theme": "light mode"}},
+	}
+	if _, err := collection.InsertMany(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if migrated, err := migrateMongoDocuments(ctx, collection, groups, migrations, zap.NewNop()); err != nil || migrated != 2 {
+		t.Fatalf("Got %d, %v migrating but expected both documents migrated", migrated, err)
+	}
+	// a finished migration isn't repeated, documents written the old way since are migrated by their next write
+	if _, err := collection.InsertOne(ctx, bson.M{"_userId": int64(3), "runelite": bson.M{"theme": "dark mode"}}); err != nil {
+		t.Fatal(err)
+	}
+	if migrated, err := migrateMongoDocuments(ctx, collection, groups, migrations, zap.NewNop()); err != nil || migrated != 0 {
+		t.Fatalf("Got %d, %v migrating again but expected the finished migration not to run again", migrated, err)
+	}
+
+	var user map[string]interface{}
+	if err := collection.FindOne(ctx, bson.M{"_userId": int64(1)}).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	for name := range user {
+		if !strings.HasPrefix(name, "_") {
+			t.Errorf("Got group %s left in the migrated user document", name)
 		}
 	}
+
+	repository := NewConfigRepository(collection, groups, history, contractOptions)
+	expected := []ConfigEntry{
+		{Key: "plugin.a.b", Value: "dotted", Type: ValueString},
+		{Key: "plugin.list", Value: "[\"NOON\",\"VORKI\"]", Type: ValueArray},
+		{Key: "plugin.scale", Value: "2", Type: ValueNumber},
+		{Key: "runelite.theme", Value: "dark mode", Type: ValueString},
+	}
+	configuration, err := repository.FindByUserId(ctx, 1, DefaultProfile)
+	if err != nil || configuration == nil || configuration.Revision != 0 || !reflect.DeepEqual(sortedEntries(configuration.Config), expected) {
+		t.Fatalf("Got configuration %v, %v but expected %v at revision 0", configuration, err, expected)
+	}
+	if entry, err := repository.FindKey(ctx, 1, DefaultProfile, "plugin.a.b"); err != nil || !reflect.DeepEqual(entry, &expected[0]) {
+		t.Errorf("Got entry %v, %v but expected %v", entry, err, expected[0])
+	}
+
+	// the first write to a migrated document records the first revision
+	if err = repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "plugin.scale", Value: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := repository.FindRevisions(ctx, 1, DefaultProfile, RevisionFilter{})
+	if err != nil || len(revisions) != 1 || revisions[0].Revision != 1 || len(revisions[0].Changes) != 1 {
+		t.Fatalf("Got revisions %v, %v but expected the save recorded as revision 1", revisions, err)
+	}
+	if change := revisions[0].Changes[0]; change.Key != "plugin.scale" || change.Previous == nil || *change.Previous != "2" || change.PreviousType != ValueNumber {
+		t.Errorf("Got change %v but expected the migrated number as its previous value", change)
+	}
+	if configuration, err = repository.FindByUserId(ctx, 2, DefaultProfile); err != nil || configuration == nil ||
+		!reflect.DeepEqual(configuration.Config, []ConfigEntry{{Key: "runelite.theme", Value: "light mode", Type: ValueString}}) {
+		t.Errorf("Got configuration %v, %v of the other user but expected its theme migrated", configuration, err)
+	}
+
+	if err = repository.Save(ctx, 3, DefaultProfile, &ConfigEntry{Key: "runelite.scale", Value: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := groups.CountDocuments(ctx, bson.M{"_userId": int64(3)}); err != nil || count != 1 {
+		t.Errorf("Got %d, %v group documents of the user written after the migration but expected its group split", count, err)
+	}
 }
@@ -3,9 +3,82 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/newrelic/go-agent/_integrations/nrmysql"
 	"github.com/newrelic/go-agent/v3/newrelic"
+	"go.uber.org/zap"
+	"time"
 )
 
+func init() {
+	registerStoreDriver("mysql", func() storeDriver { return &mysqlStore{} })
+}
+
+type mysqlStoreConfig struct {
+	Uri          string `env:"MYSQL_URI"`
+	ConnPool     int    `env:"MYSQL_POOL_SIZE" envDefault:"10"`
+	ConnLifetime int    `env:"MYSQL_CONN_LIFETIME" envDefault:"5"`
+}
+
+type mysqlStore struct {
+	config mysqlStoreConfig
+	mysql  *sql.DB
+}
+
+func (m *mysqlStore) Config() interface{} {
+	return &m.config
+}
+
+func (m *mysqlStore) Validate() error {
+	if m.config.Uri == "" {
+		return errors.New("MYSQL_URI is required")
+	}
+	if m.config.ConnPool <= 0 {
+		return errors.New("MYSQL_POOL_SIZE must be positive")
+	}
+	return nil
+}
+
+func (m *mysqlStore) Open(logger *zap.Logger) error {
+	mysql, err := sql.Open("nrmysql", m.config.Uri)
+	if err != nil {
+		return fmt.Errorf("failed to connect to mysql: %w", err)
+	}
+	m.mysql = mysql
+	err = mysql.Ping()
+	if err != nil {
+		return fmt.Errorf("failed to ping mysql: %w", err)
+	}
+	mysql.SetConnMaxLifetime(time.Minute * time.Duration(m.config.ConnLifetime))
+	mysql.SetMaxOpenConns(m.config.ConnPool)
+	mysql.SetMaxIdleConns(m.config.ConnPool)
+	return nil
+}
+
+func (m *mysqlStore) Close() error {
+	if m.mysql == nil {
+		return nil
+	}
+	return m.mysql.Close()
+}
+
+func (m *mysqlStore) NewConfigRepository(options RepositoryOptions) (ConfigRepository, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := MigrateMysql(ctx, m.mysql); err != nil {
+		return nil, fmt.Errorf("failed to migrate mysql config schema: %w", err)
+	}
+	return NewMysqlConfigRepository(m.mysql, options), nil
+}
+
+func (m *mysqlStore) NewSessionRepository() (SessionRepository, error) {
+	return NewSessionRepository(m.mysql), nil
+}
+
 type mysqlSessionRepository struct {
 	mysql *sql.DB
 }
@@ -46,3 +119,798 @@ func (m mysqlSessionRepository) UpdateLastUsedByUserId(userId int64) error {
 	}
 	return nil
 }
+
+// mysqlMigrations are applied in order and tracked in the config_migrations table, existing entries must never be
+// modified, append a new migration instead
+var mysqlMigrations = []string{
+	// values are stored as their text along with their type, or in compressed_value and encrypted_value with an empty
+	// value when they're stored compressed or encrypted
+	`CREATE TABLE IF NOT EXISTS config_entries (
+		user BIGINT NOT NULL,
+		profile VARCHAR(64) COLLATE utf8mb4_bin NOT NULL,
+		config_group VARCHAR(255) COLLATE utf8mb4_bin NOT NULL,
+		config_key VARCHAR(255) COLLATE utf8mb4_bin NOT NULL,
+		value LONGTEXT NOT NULL,
+		value_type VARCHAR(16) COLLATE utf8mb4_bin NOT NULL,
+		compressed_value LONGBLOB NULL,
+		encrypted_value LONGBLOB NULL,
+		PRIMARY KEY (user, profile, config_group, config_key)
+	) DEFAULT CHARSET = utf8mb4`,
+	// usage_keys and usage_bytes are the running totals the usage quotas are checked against, profiles without them
+	// are counted on their first write with quotas enabled, see countUsage
+	`CREATE TABLE IF NOT EXISTS config_users (
+		user BIGINT NOT NULL,
+		profile VARCHAR(64) COLLATE utf8mb4_bin NOT NULL,
+		revision BIGINT NOT NULL,
+		usage_keys INT NULL,
+		usage_bytes BIGINT NULL,
+		PRIMARY KEY (user, profile)
+	)`,
+	`CREATE TABLE IF NOT EXISTS config_history (
+		user BIGINT NOT NULL,
+		profile VARCHAR(64) COLLATE utf8mb4_bin NOT NULL,
+		revision BIGINT NOT NULL,
+		time BIGINT NOT NULL COMMENT 'unix millis',
+		changes LONGTEXT NOT NULL,
+		PRIMARY KEY (user, profile, revision)
+	) DEFAULT CHARSET = utf8mb4`,
+	`CREATE TABLE IF NOT EXISTS config_usage (
+		user BIGINT NOT NULL,
+		profile VARCHAR(64) COLLATE utf8mb4_bin NOT NULL,
+		config_group VARCHAR(255) COLLATE utf8mb4_bin NOT NULL,
+		bytes BIGINT NOT NULL,
+		PRIMARY KEY (user, profile, config_group)
+	) DEFAULT CHARSET = utf8mb4`,
+}
+
+const mysqlMaxKeyLength = 255
+
+type mysqlConfigRepository struct {
+	configWriter
+	mysql            *sql.DB
+	historyRetention time.Duration
+	codec            valueCodec
+}
+
+func NewMysqlConfigRepository(mysql *sql.DB, options RepositoryOptions) ConfigRepository {
+	repository := &mysqlConfigRepository{
+		mysql:            mysql,
+		historyRetention: options.HistoryRetention,
+		codec:            newValueCodec(options),
+	}
+	repository.configWriter = configWriter{
+		apply:                repository.apply,
+		find:                 repository.FindByUserId,
+		maxConfigValueLength: options.MaxConfigValueLength,
+		maxKeyLength:         mysqlMaxKeyLength,
+		quotas:               options.Quotas,
+	}
+	return repository
+}
+
+// MigrateMysql creates or upgrades the config schema, a named lock keeps concurrently starting servers from applying
+// the same migration twice
+func MigrateMysql(ctx context.Context, mysql *sql.DB) error {
+	conn, err := mysql.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked int
+	if err = conn.QueryRowContext(ctx, "SELECT GET_LOCK('config_migrations', 30)").Scan(&locked); err != nil {
+		return err
+	}
+	if locked != 1 {
+		return errors.New("timed out waiting for the migration lock")
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK('config_migrations')")
+
+	_, err = conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS config_migrations (version INT NOT NULL PRIMARY KEY)")
+	if err != nil {
+		return err
+	}
+	var version int
+	if err = conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM config_migrations").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(mysqlMigrations); version++ {
+		if _, err = conn.ExecContext(ctx, mysqlMigrations[version]); err != nil {
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+		if _, err = conn.ExecContext(ctx, "INSERT INTO config_migrations (version) VALUES (?)", version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeMysqlValue reads key's stored value, the value column holds its text along with its type in value_type, or
+// compressed_value and encrypted_value its compressed or encrypted text
+func decodeMysqlValue(codec valueCodec, key string, valueType string, stored storedValue) (configValue, error) {
+	raw, err := codec.decode(key, stored)
+	return configValue{Type: ValueType(valueType), Raw: raw}, err
+}
+
+func (m *mysqlConfigRepository) FindByUserId(ctx context.Context, userId int64, profile string) (*Configuration, error) {
+	return m.findEntries(ctx, userId, profile, nil)
+}
+
+func (m *mysqlConfigRepository) FindGroup(ctx context.Context, userId int64, profile string, group string) (*Configuration, error) {
+	return m.findEntries(ctx, userId, profile, &group)
+}
+
+// findEntries reads the profile's configuration along with its revision, only the entries of group unless it's nil
+func (m *mysqlConfigRepository) findEntries(ctx context.Context, userId int64, profile string, group *string) (*Configuration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	// the join keeps a row around for users whose entries have all been deleted, like an emptied mongodb document
+	query := "SELECT u.revision, e.config_group, e.config_key, e.value, e.value_type, e.compressed_value, e.encrypted_value FROM config_users u " +
+		"LEFT JOIN config_entries e ON e.user = u.user AND e.profile = u.profile"
+	args := []interface{}{userId, profile}
+	if group != nil {
+		query += " AND e.config_group = ?"
+		args = []interface{}{*group, userId, profile}
+	}
+	rows, err := m.mysql.QueryContext(ctx, query+" WHERE u.user = ? AND u.profile = ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var configuration *Configuration
+	for rows.Next() {
+		var revision int64
+		var group, field, value, valueType sql.NullString
+		var compressed, encrypted []byte
+
+		if err = rows.Scan(&revision, &group, &field, &value, &valueType, &compressed, &encrypted); err != nil {
+			return nil, err
+		}
+		if configuration == nil {
+			configuration = &Configuration{Config: make([]ConfigEntry, 0), Revision: revision}
+		}
+		if !value.Valid {
+			continue
+		}
+		key := group.String + "." + field.String
+		decodedValue, err := decodeMysqlValue(m.codec, key, valueType.String, storedValue{Raw: value.String, Compressed: compressed, Encrypted: encrypted})
+		if err != nil {
+			continue
+		}
+		configuration.Config = append(configuration.Config, ConfigEntry{Key: key, Value: decodedValue.Raw, Type: decodedValue.Type})
+	}
+	return configuration, rows.Err()
+}
+
+func (m *mysqlConfigRepository) FindKey(ctx context.Context, userId int64, profile string, key string) (*ConfigEntry, error) {
+	group, field, ok := configPath(key)
+	if !ok {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	var value, valueType string
+	var compressed, encrypted []byte
+	err := m.mysql.QueryRowContext(
+		ctx,
+		"SELECT value, value_type, compressed_value, encrypted_value FROM config_entries WHERE user = ? AND profile = ? AND config_group = ? AND config_key = ?",
+		userId, profile, group, field,
+	).Scan(&value, &valueType, &compressed, &encrypted)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	decodedValue, err := decodeMysqlValue(m.codec, key, valueType, storedValue{Raw: value, Compressed: compressed, Encrypted: encrypted})
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigEntry{Key: group + "." + field, Value: decodedValue.Raw, Type: decodedValue.Type}, nil
+}
+
+func (m *mysqlConfigRepository) FindCurrentRevision(ctx context.Context, userId int64, profile string) (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	var revision int64
+	err := m.mysql.QueryRowContext(ctx, "SELECT revision FROM config_users WHERE user = ? AND profile = ?", userId, profile).Scan(&revision)
+
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return revision, true, nil
+}
+
+// apply writes every mutation in a single transaction, the user row is locked first so concurrent writes of the same
+// user are serialized, their revisions can't interleave and the precondition and quotas are checked against the locked
+// revision and usage
+func (m *mysqlConfigRepository) apply(ctx context.Context, userId int64, profile string, mutations []preparedMutation, precondition Precondition) (*ConfigRevision, error) {
+	upsert := false
+	for _, mutation := range mutations {
+		upsert = upsert || !mutation.Delete
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	tx, err := m.mysql.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// a precondition can only hold for an existing user, so there's never a row to create
+	if upsert && precondition.empty() {
+		_, err = tx.ExecContext(ctx, "INSERT INTO config_users (user, profile, revision) VALUES (?, ?, 0) ON DUPLICATE KEY UPDATE user = user", userId, profile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var current int64
+	var usageKeys, usageBytes sql.NullInt64
+	err = tx.QueryRowContext(
+		ctx,
+		"SELECT revision, usage_keys, usage_bytes FROM config_users WHERE user = ? AND profile = ? FOR UPDATE",
+		userId, profile,
+	).Scan(&current, &usageKeys, &usageBytes)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if !precondition.holds(err == nil, current) {
+		return nil, ErrPreconditionFailed
+	}
+	if err == sql.ErrNoRows {
+		// nothing to delete from
+		return nil, nil
+	}
+	// the totals are kept up to date once they've been counted, which is only worth it with quotas to check
+	var usage *ConfigUsage
+	if usageKeys.Valid {
+		usage, err = m.findGroupUsage(ctx, tx, userId, profile, usageKeys.Int64, usageBytes.Int64)
+	} else if m.quotas.enabled() {
+		usage, err = m.countUsage(ctx, tx, userId, profile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]ConfigChange, 0, len(mutations))
+	for _, mutation := range mutations {
+		change, err := m.applyMutation(ctx, tx, userId, profile, mutation)
+
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+	if len(changes) == 0 {
+		return &ConfigRevision{Revision: current, Changes: changes}, nil
+	}
+	if usage != nil {
+		after := usage.withChanges(changes)
+		if err = m.quotas.check(usage, after); err != nil {
+			return nil, err
+		}
+		if err = m.writeUsage(ctx, tx, userId, profile, usage, after); err != nil {
+			return nil, err
+		}
+	}
+
+	revision := newRevision(current+1, changes)
+	if _, err = tx.ExecContext(ctx, "UPDATE config_users SET revision = ? WHERE user = ? AND profile = ?", revision.Revision, userId, profile); err != nil {
+		return nil, err
+	}
+	sealed, err := m.codec.sealChanges(revision.Changes)
+	if err != nil {
+		return nil, err
+	}
+	encodedChanges, err := json.Marshal(sealed)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO config_history (user, profile, revision, time, changes) VALUES (?, ?, ?, ?, ?)",
+		userId, profile, revision.Revision, revision.Time.UnixNano()/int64(time.Millisecond), string(encodedChanges),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if m.historyRetention > 0 {
+		_, err = tx.ExecContext(ctx, "DELETE FROM config_history WHERE user = ? AND profile = ? AND time < ?", userId, profile, time.Now().Add(-m.historyRetention).UnixNano()/int64(time.Millisecond))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+// findGroupUsage reads the group totals of a profile whose totals have been counted
+func (m *mysqlConfigRepository) findGroupUsage(ctx context.Context, tx *sql.Tx, userId int64, profile string, keys int64, bytes int64) (*ConfigUsage, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT config_group, bytes FROM config_usage WHERE user = ? AND profile = ?", userId, profile)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := &ConfigUsage{Keys: int(keys), Bytes: bytes, Groups: make(map[string]int64), Quotas: m.quotas}
+	for rows.Next() {
+		var group string
+		var size int64
+		if err = rows.Scan(&group, &size); err != nil {
+			return nil, err
+		}
+		usage.Groups[group] = size
+	}
+	return usage, rows.Err()
+}
+
+// countUsage sizes up the entries of a profile without totals yet and stores them, the profile's row must be locked
+func (m *mysqlConfigRepository) countUsage(ctx context.Context, tx *sql.Tx, userId int64, profile string) (*ConfigUsage, error) {
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT config_group, config_key, value, value_type, compressed_value, encrypted_value FROM config_entries WHERE user = ? AND profile = ?",
+		userId, profile,
+	)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var group, field, value, valueType string
+		var compressed, encrypted []byte
+
+		if err = rows.Scan(&group, &field, &value, &valueType, &compressed, &encrypted); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		key := group + "." + field
+		decodedValue, err := decodeMysqlValue(m.codec, key, valueType, storedValue{Raw: value, Compressed: compressed, Encrypted: encrypted})
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sizes[key] = entrySize(key, decodedValue.Raw)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	usage := sizedUsage(sizes, m.quotas)
+	if err = m.writeUsage(ctx, tx, userId, profile, &ConfigUsage{}, usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// writeUsage replaces the totals of a profile, only writing the groups whose size changed from before
+func (m *mysqlConfigRepository) writeUsage(ctx context.Context, tx *sql.Tx, userId int64, profile string, before *ConfigUsage, after *ConfigUsage) error {
+	_, err := tx.ExecContext(ctx, "UPDATE config_users SET usage_keys = ?, usage_bytes = ? WHERE user = ? AND profile = ?", after.Keys, after.Bytes, userId, profile)
+	if err != nil {
+		return err
+	}
+	for group := range before.Groups {
+		if _, ok := after.Groups[group]; !ok {
+			_, err = tx.ExecContext(ctx, "DELETE FROM config_usage WHERE user = ? AND profile = ? AND config_group = ?", userId, profile, group)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for group, size := range after.Groups {
+		if previous, ok := before.Groups[group]; ok && previous == size {
+			continue
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO config_usage (user, profile, config_group, bytes) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE bytes = VALUES(bytes)",
+			userId, profile, group, size,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindUsage reads the profile's totals once they've been counted, and sizes up its configuration before that
+func (m *mysqlConfigRepository) FindUsage(ctx context.Context, userId int64, profile string) (*ConfigUsage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	rows, err := m.mysql.QueryContext(
+		ctx,
+		"SELECT u.usage_keys, u.usage_bytes, g.config_group, g.bytes FROM config_users u "+
+			"LEFT JOIN config_usage g ON g.user = u.user AND g.profile = u.profile WHERE u.user = ? AND u.profile = ?",
+		userId, profile,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage *ConfigUsage
+	for rows.Next() {
+		var keys, bytes, size sql.NullInt64
+		var group sql.NullString
+		if err = rows.Scan(&keys, &bytes, &group, &size); err != nil {
+			return nil, err
+		}
+		if !keys.Valid {
+			rows.Close()
+			return m.configWriter.FindUsage(ctx, userId, profile)
+		}
+		if usage == nil {
+			usage = &ConfigUsage{Keys: int(keys.Int64), Bytes: bytes.Int64, Groups: make(map[string]int64), Quotas: m.quotas}
+		}
+		if group.Valid {
+			usage.Groups[group.String] = size.Int64
+		}
+	}
+	return usage, rows.Err()
+}
+
+func (m *mysqlConfigRepository) applyMutation(ctx context.Context, tx *sql.Tx, userId int64, profile string, mutation preparedMutation) (*ConfigChange, error) {
+	var encodedPrevious, previousType string
+	var previousCompressed, previousEncrypted []byte
+	err := tx.QueryRowContext(
+		ctx,
+		"SELECT value, value_type, compressed_value, encrypted_value FROM config_entries WHERE user = ? AND profile = ? AND config_group = ? AND config_key = ?",
+		userId, profile, mutation.Group, mutation.Field,
+	).Scan(&encodedPrevious, &previousType, &previousCompressed, &previousEncrypted)
+
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	var previous *configValue
+	if err == nil {
+		decodedPrevious, err := decodeMysqlValue(m.codec, mutation.path(), previousType, storedValue{Raw: encodedPrevious, Compressed: previousCompressed, Encrypted: previousEncrypted})
+		if err != nil {
+			return nil, err
+		}
+		previous = &decodedPrevious
+	}
+	change, changed := recordChange(mutation, previous)
+
+	if !changed {
+		return nil, nil
+	}
+	if mutation.Delete {
+		_, err = tx.ExecContext(
+			ctx,
+			"DELETE FROM config_entries WHERE user = ? AND profile = ? AND config_group = ? AND config_key = ?",
+			userId, profile, mutation.Group, mutation.Field,
+		)
+		return &change, err
+	}
+	stored, err := m.codec.encode(mutation.path(), mutation.Value)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO config_entries (user, profile, config_group, config_key, value, value_type, compressed_value, encrypted_value) VALUES (?, ?, ?, ?, ?, ?, ?, ?) "+
+			"ON DUPLICATE KEY UPDATE value = VALUES(value), value_type = VALUES(value_type), compressed_value = VALUES(compressed_value), encrypted_value = VALUES(encrypted_value)",
+		userId, profile, mutation.Group, mutation.Field, stored.Raw, string(mutation.Value.Type), stored.Compressed, stored.Encrypted,
+	)
+	return &change, err
+}
+
+func (m *mysqlConfigRepository) FindRevisions(ctx context.Context, userId int64, profile string, filter RevisionFilter) ([]ConfigRevision, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	query := "SELECT revision, time, changes FROM config_history WHERE user = ? AND profile = ? AND revision > ?"
+	args := []interface{}{userId, profile, filter.After}
+	if filter.Before > 0 {
+		query += " AND revision < ?"
+		args = append(args, filter.Before)
+	}
+	query += " ORDER BY revision DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	rows, err := m.mysql.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := make([]ConfigRevision, 0)
+	for rows.Next() {
+		var revision ConfigRevision
+		var millis int64
+		var changes string
+
+		if err = rows.Scan(&revision.Revision, &millis, &changes); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(changes), &revision.Changes); err != nil {
+			return nil, err
+		}
+		// changes are sealed with their keys as they're stored
+		if err = m.codec.openChanges(revision.Changes); err != nil {
+			return nil, err
+		}
+		revision.Time = time.Unix(0, millis*int64(time.Millisecond)).UTC()
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+func (m *mysqlConfigRepository) ListProfiles(ctx context.Context, userId int64) ([]Profile, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	rows, err := m.mysql.QueryContext(ctx, "SELECT profile, revision FROM config_users WHERE user = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	profiles := make([]Profile, 0)
+	for rows.Next() {
+		var profile Profile
+		if err = rows.Scan(&profile.Name, &profile.Revision); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return withDefaultProfile(profiles), nil
+}
+
+func (m *mysqlConfigRepository) CreateProfile(ctx context.Context, userId int64, profile string) error {
+	if err := validateProfile(profile); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	tx, err := m.mysql.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// locking the user's rows keeps concurrent creations from both getting the last profile the quota allows
+	rows, err := tx.QueryContext(ctx, "SELECT profile FROM config_users WHERE user = ? FOR UPDATE", userId)
+	if err != nil {
+		return err
+	}
+	profiles := 0
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == profile {
+			rows.Close()
+			return ErrProfileExists
+		} else if name != DefaultProfile {
+			profiles++
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if err = m.quotas.checkProfiles(profiles); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "INSERT INTO config_users (user, profile, revision) VALUES (?, ?, 0)", userId, profile); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *mysqlConfigRepository) RenameProfile(ctx context.Context, userId int64, profile string, name string) error {
+	if err := validateExistingProfile(profile); err != nil {
+		return err
+	}
+	if err := validateProfile(name); err != nil {
+		return err
+	}
+	return m.updateProfile(ctx, userId, profile, func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRowContext(ctx, "SELECT 1 FROM config_users WHERE user = ? AND profile = ? FOR UPDATE", userId, name).Scan(&exists)
+		if err == nil {
+			return ErrProfileExists
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+		for _, table := range []string{"config_users", "config_entries", "config_history", "config_usage"} {
+			if _, err = tx.ExecContext(ctx, "UPDATE "+table+" SET profile = ? WHERE user = ? AND profile = ?", name, userId, profile); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *mysqlConfigRepository) DeleteProfile(ctx context.Context, userId int64, profile string) error {
+	if err := validateExistingProfile(profile); err != nil {
+		return err
+	}
+	return m.updateProfile(ctx, userId, profile, func(tx *sql.Tx) error {
+		for _, table := range []string{"config_entries", "config_history", "config_usage", "config_users"} {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user = ? AND profile = ?", userId, profile); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// updateProfile runs update in a transaction holding the lock of the profile's row, which has to exist
+func (m *mysqlConfigRepository) updateProfile(ctx context.Context, userId int64, profile string, update func(tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	ctx = newrelic.NewContext(ctx, newrelic.FromContext(ctx))
+	defer cancel()
+
+	tx, err := m.mysql.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var revision int64
+	err = tx.QueryRowContext(ctx, "SELECT revision FROM config_users WHERE user = ? AND profile = ? FOR UPDATE", userId, profile).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return ErrProfileNotFound
+	} else if err != nil {
+		return err
+	}
+	if err = update(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReencryptValues re-encrypts the stale entries and revisions, which are read up front so no query is left open while
+// they're rewritten. Each is only replaced while it's still stored as it was read, one written in the meantime is
+// already current.
+func (m *mysqlConfigRepository) ReencryptValues(ctx context.Context) (int, error) {
+	type staleEntry struct {
+		user      int64
+		profile   string
+		group     string
+		field     string
+		valueType string
+		stored    storedValue
+	}
+	rows, err := m.mysql.QueryContext(ctx, "SELECT user, profile, config_group, config_key, value, value_type, compressed_value, encrypted_value FROM config_entries")
+	if err != nil {
+		return 0, err
+	}
+	var entries []staleEntry
+	for rows.Next() {
+		var entry staleEntry
+		if err = rows.Scan(&entry.user, &entry.profile, &entry.group, &entry.field, &entry.stored.Raw, &entry.valueType, &entry.stored.Compressed, &entry.stored.Encrypted); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if m.codec.stale(entry.group+"."+entry.field, entry.stored) {
+			entries = append(entries, entry)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rewritten := 0
+	for _, entry := range entries {
+		key := entry.group + "." + entry.field
+		value, err := decodeMysqlValue(m.codec, key, entry.valueType, entry.stored)
+		if err != nil {
+			return rewritten, fmt.Errorf("failed to decrypt %s: %w", key, err)
+		}
+		encoded, err := m.codec.encode(key, value)
+		if err != nil {
+			return rewritten, err
+		}
+		result, err := m.mysql.ExecContext(
+			ctx,
+			"UPDATE config_entries SET value = ?, value_type = ?, compressed_value = ?, encrypted_value = ? "+
+				"WHERE user = ? AND profile = ? AND config_group = ? AND config_key = ? "+
+				"AND value = ? AND value_type = ? AND compressed_value <=> ? AND encrypted_value <=> ?",
+			encoded.Raw, string(value.Type), encoded.Compressed, encoded.Encrypted,
+			entry.user, entry.profile, entry.group, entry.field,
+			entry.stored.Raw, entry.valueType, entry.stored.Compressed, entry.stored.Encrypted,
+		)
+		if err != nil {
+			return rewritten, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten += int(affected)
+	}
+
+	type staleRevision struct {
+		user     int64
+		profile  string
+		revision int64
+		changes  string
+	}
+	rows, err = m.mysql.QueryContext(ctx, "SELECT user, profile, revision, changes FROM config_history")
+	if err != nil {
+		return rewritten, err
+	}
+	var revisions []staleRevision
+	for rows.Next() {
+		var revision staleRevision
+		var changes []ConfigChange
+		if err = rows.Scan(&revision.user, &revision.profile, &revision.revision, &revision.changes); err != nil {
+			rows.Close()
+			return rewritten, err
+		}
+		if err = json.Unmarshal([]byte(revision.changes), &changes); err != nil {
+			rows.Close()
+			return rewritten, err
+		}
+		if m.codec.staleChanges(changes) {
+			revisions = append(revisions, revision)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return rewritten, err
+	}
+
+	for _, revision := range revisions {
+		var changes []ConfigChange
+		if err = json.Unmarshal([]byte(revision.changes), &changes); err != nil {
+			return rewritten, err
+		}
+		sealed, err := m.codec.resealChanges(changes)
+		if err != nil {
+			return rewritten, err
+		}
+		encodedChanges, err := json.Marshal(sealed)
+		if err != nil {
+			return rewritten, err
+		}
+		result, err := m.mysql.ExecContext(
+			ctx,
+			"UPDATE config_history SET changes = ? WHERE user = ? AND profile = ? AND revision = ? AND changes = ?",
+			string(encodedChanges), revision.user, revision.profile, revision.revision, revision.changes,
+		)
+		if err != nil {
+			return rewritten, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten += int(affected)
+	}
+	return rewritten, nil
+}
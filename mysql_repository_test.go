@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+)
+
+// TestMysqlConfigRepositoryContract runs the repository contract against the mysql database at TEST_MYSQL_URI
+func TestMysqlConfigRepositoryContract(t *testing.T) {
+	uri := os.Getenv("TEST_MYSQL_URI")
+	if uri == "" {
+		t.Skip("TEST_MYSQL_URI is not set")
+	}
+	mysql, err := sql.Open("mysql", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mysql.Close()
+
+	if err = MigrateMysql(context.Background(), mysql); err != nil {
+		t.Fatal(err)
+	}
+	// migrating an up to date schema must be a no-op
+	if err = MigrateMysql(context.Background(), mysql); err != nil {
+		t.Fatal(err)
+	}
+	testConfigRepositoryContract(t, func(t *testing.T) ConfigRepository {
+		for _, table := range []string{"config_entries", "config_users", "config_history", "config_usage"} {
+			if _, err := mysql.Exec("DELETE FROM " + table); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return NewMysqlConfigRepository(mysql, contractOptions)
+	})
+
+	for _, table := range []string{"config_entries", "config_users", "config_history", "config_usage"} {
+		if _, err := mysql.Exec("DELETE FROM " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testValueReencryption(t, func(options RepositoryOptions) ConfigRepository {
+		return NewMysqlConfigRepository(mysql, options)
+	})
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+// ErrInvalidPatch is returned for patch documents that are malformed or address something other than groups and keys
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// ErrPatchConflict is returned when a JSON Patch operation can't be applied to the current configuration, like a failed
+// test or the removal of a missing key. Nothing is written when it's returned.
+var ErrPatchConflict = errors.New("patch conflicts with the configuration")
+
+// The patch formats operate on the configuration as a JSON document of groups, each an object of its keys' values
+// without the group prefix, e.g. {"runelite": {"theme": "dark mode"}}. A JSON string sets a string value, any other
+// JSON value sets its JSON text with the type of that value, so patches keep types like ConfigEntry.Type does.
+
+// MergePatchConfig applies an RFC 7396 JSON Merge Patch to the profile's configuration as a single revision
+func MergePatchConfig(ctx context.Context, repository ConfigRepository, userId int64, profile string, patch []byte, precondition Precondition) (*ConfigRevision, []string, error) {
+	var groups map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &groups); err != nil || groups == nil {
+		return nil, nil, ErrInvalidPatch
+	}
+	return patchConfig(ctx, repository, userId, profile, precondition, func(values map[string]configValue) error {
+		for group, raw := range groups {
+			if isJsonNull(raw) {
+				deleteGroupValues(values, group)
+				continue
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+				return ErrInvalidPatch
+			}
+			for field, value := range fields {
+				key, err := patchKey(group, field)
+				if err != nil {
+					return err
+				}
+				if isJsonNull(value) {
+					delete(values, key)
+				} else {
+					values[key] = patchValue(value)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// jsonPatchOperation is an operation of an RFC 6902 JSON Patch
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// JsonPatchConfig applies an RFC 6902 JSON Patch to the profile's configuration. Like the RFC requires the patch is
+// applied atomically as a single revision, nothing is written when any of its operations fails.
+func JsonPatchConfig(ctx context.Context, repository ConfigRepository, userId int64, profile string, patch []byte, precondition Precondition) (*ConfigRevision, []string, error) {
+	var operations []jsonPatchOperation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, nil, ErrInvalidPatch
+	}
+	for _, operation := range operations {
+		if operation.Path == nil || (operation.Op == "move" || operation.Op == "copy") && operation.From == nil {
+			return nil, nil, ErrInvalidPatch
+		}
+	}
+	return patchConfig(ctx, repository, userId, profile, precondition, func(values map[string]configValue) error {
+		document := patchDocument(values)
+		for _, operation := range operations {
+			if err := document.apply(operation); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// patchConfig applies patch to a copy of the profile's values keyed by config key and writes the differences as a
+// single revision. The write is conditioned on the revision the values were read at, it's retried when another write
+// gets in between unless precondition already requires a revision, and errTooManyConflicts is returned once it gave up.
+func patchConfig(ctx context.Context, repository ConfigRepository, userId int64, profile string, precondition Precondition, patch func(values map[string]configValue) error) (*ConfigRevision, []string, error) {
+	for attempt := 1; ; attempt++ {
+		configuration, err := repository.FindByUserId(ctx, userId, profile)
+
+		if err != nil {
+			return nil, nil, err
+		}
+		exists := configuration != nil
+		current := make(map[string]configValue)
+		var revision int64
+		if exists {
+			revision = configuration.Revision
+			for _, entry := range configuration.Config {
+				current[entry.Key] = configValue{Type: entry.Type, Raw: entry.Value}
+			}
+		}
+		if !precondition.holds(exists, revision) {
+			return nil, nil, ErrPreconditionFailed
+		}
+
+		patched := make(map[string]configValue, len(current))
+		for key, value := range current {
+			patched[key] = value
+		}
+		if err = patch(patched); err != nil {
+			return nil, nil, err
+		}
+
+		written := precondition
+		if exists {
+			written.Revision = &revision
+		}
+		applied, failedKeys, err := repository.Apply(ctx, userId, profile, diffValues(current, patched).mutations(), written)
+		if err == ErrPreconditionFailed && exists && precondition.Revision == nil {
+			if attempt < maxUpdateAttempts {
+				continue
+			}
+			err = errTooManyConflicts
+		}
+		if err == nil && applied == nil && exists {
+			// nothing was changed
+			applied = &ConfigRevision{Revision: revision, Changes: make([]ConfigChange, 0)}
+		}
+		return applied, failedKeys, err
+	}
+}
+
+// patchDocument applies JSON Patch operations to values keyed by config key, addressing them as the JSON document
+// of groups the patch formats operate on
+type patchDocument map[string]configValue
+
+// get returns the configValue of a key, the object of a group's values or the object of every group for the root
+func (d patchDocument) get(path []string) (interface{}, bool) {
+	switch len(path) {
+	case 0:
+		groups := make(map[string]interface{})
+		for key := range d {
+			group := configGroup(key)
+			if _, ok := groups[group]; !ok {
+				groups[group], _ = d.get([]string{group})
+			}
+		}
+		return groups, true
+	case 1:
+		fields := make(map[string]interface{})
+		for key, value := range d {
+			if configGroup(key) == path[0] {
+				fields[strings.SplitN(key, ".", 2)[1]] = value
+			}
+		}
+		return fields, len(fields) > 0
+	default:
+		value, ok := d[d.key(path)]
+		return value, ok
+	}
+}
+
+func (d patchDocument) remove(path []string) error {
+	if _, ok := d.get(path); !ok {
+		return ErrPatchConflict
+	}
+	switch len(path) {
+	case 0:
+		for key := range d {
+			delete(d, key)
+		}
+	case 1:
+		deleteGroupValues(d, path[0])
+	default:
+		delete(d, d.key(path))
+	}
+	return nil
+}
+
+// set adds or replaces the value at path, value being what get returns for the same path
+func (d patchDocument) set(path []string, value interface{}) error {
+	switch len(path) {
+	case 0:
+		groups, ok := value.(map[string]interface{})
+		if !ok {
+			return ErrInvalidPatch
+		}
+		for key := range d {
+			delete(d, key)
+		}
+		for group, fields := range groups {
+			if err := d.set([]string{group}, fields); err != nil {
+				return err
+			}
+		}
+	case 1:
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return ErrInvalidPatch
+		}
+		deleteGroupValues(d, path[0])
+		for field, fieldValue := range fields {
+			if err := d.set([]string{path[0], field}, fieldValue); err != nil {
+				return err
+			}
+		}
+	default:
+		configValue, ok := value.(configValue)
+		if !ok {
+			return ErrInvalidPatch
+		}
+		key, err := patchKey(path[0], strings.Join(path[1:], "."))
+		if err != nil {
+			return err
+		}
+		d[key] = configValue
+	}
+	return nil
+}
+
+func (d patchDocument) key(path []string) string {
+	return path[0] + "." + strings.Join(path[1:], ".")
+}
+
+func (d patchDocument) apply(operation jsonPatchOperation) error {
+	path, err := parseJsonPointer(*operation.Path)
+	if err != nil {
+		return err
+	}
+
+	switch operation.Op {
+	case "add", "replace", "test":
+		if len(operation.Value) == 0 {
+			return ErrInvalidPatch
+		}
+		value, err := decodePatchValue(operation.Value, len(path))
+		if err != nil {
+			return err
+		}
+		current, exists := d.get(path)
+		if operation.Op == "test" {
+			if !exists || !reflect.DeepEqual(current, value) {
+				return ErrPatchConflict
+			}
+			return nil
+		}
+		if operation.Op == "replace" && !exists {
+			return ErrPatchConflict
+		}
+		return d.set(path, value)
+	case "remove":
+		return d.remove(path)
+	case "move", "copy":
+		from, err := parseJsonPointer(*operation.From)
+		if err != nil {
+			return err
+		}
+		value, ok := d.get(from)
+		if !ok {
+			return ErrPatchConflict
+		}
+		if operation.Op == "move" {
+			d.remove(from)
+		}
+		return d.set(path, value)
+	default:
+		return ErrInvalidPatch
+	}
+}
+
+// parseJsonPointer splits an RFC 6901 JSON Pointer into its unescaped reference tokens
+func parseJsonPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, ErrInvalidPatch
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// decodePatchValue decodes the value of an operation on a path with depth tokens into what patchDocument.get returns
+func decodePatchValue(raw json.RawMessage, depth int) (interface{}, error) {
+	if depth >= 2 {
+		if isJsonNull(raw) {
+			return nil, ErrInvalidPatch
+		}
+		return patchValue(raw), nil
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &members); err != nil || members == nil {
+		return nil, ErrInvalidPatch
+	}
+	decoded := make(map[string]interface{}, len(members))
+	for name, member := range members {
+		value, err := decodePatchValue(member, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		decoded[name] = value
+	}
+	return decoded, nil
+}
+
+// patchKey returns the config key of a field of group, rejecting keys that can't be stored
+func patchKey(group string, field string) (string, error) {
+	key := group + "." + field
+	if _, _, ok := configPath(key); !ok {
+		return "", ErrInvalidPatch
+	}
+	return key, nil
+}
+
+// patchValue returns a JSON string's value as a string, or the JSON text of any other value tagged with its type
+func patchValue(raw json.RawMessage) configValue {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return configValue{Type: ValueString, Raw: text}
+	}
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, raw) != nil {
+		return configValue{Type: valueType(string(raw)), Raw: string(raw)}
+	}
+	return configValue{Type: valueType(compacted.String()), Raw: compacted.String()}
+}
+
+func isJsonNull(raw json.RawMessage) bool {
+	return string(bytes.TrimSpace(raw)) == "null"
+}
+
+func deleteGroupValues(values map[string]configValue, group string) {
+	for key := range values {
+		if configGroup(key) == group {
+			delete(values, key)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+)
+
+// DefaultProfile is the profile used by the unscoped /config routes
+const DefaultProfile = "default"
+
+var ErrProfileNotFound = errors.New("profile not found")
+var ErrProfileExists = errors.New("profile already exists")
+var ErrInvalidProfile = errors.New("invalid profile name")
+
+var profileNamePattern = regexp.MustCompile("^[A-Za-z0-9_-]{1,64}$")
+
+// Profile is a named configuration of a user
+type Profile struct {
+	Name     string `json:"name"`
+	Revision int64  `json:"revision"`
+}
+
+// validateProfile checks the name of a profile about to be created, the default profile always exists so it can't be
+func validateProfile(profile string) error {
+	if profile == DefaultProfile {
+		return ErrProfileExists
+	} else if !profileNamePattern.MatchString(profile) {
+		return ErrInvalidProfile
+	}
+	return nil
+}
+
+// validateExistingProfile checks the name of a profile about to be renamed or deleted, which the default profile can't
+func validateExistingProfile(profile string) error {
+	if profile == DefaultProfile {
+		return ErrInvalidProfile
+	} else if !profileNamePattern.MatchString(profile) {
+		return ErrProfileNotFound
+	}
+	return nil
+}
+
+// withDefaultProfile sorts profiles by name, adding the default profile when it has no configuration yet
+func withDefaultProfile(profiles []Profile) []Profile {
+	found := false
+	for _, profile := range profiles {
+		found = found || profile.Name == DefaultProfile
+	}
+	if !found {
+		profiles = append(profiles, Profile{Name: DefaultProfile})
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrConfigTooLarge is returned by writes the backend can't store as they would grow the configuration past what it's
+// able to hold, regardless of the quotas. Nothing is written when it's returned.
+var ErrConfigTooLarge = errors.New("configuration is too large to be stored")
+
+// Quotas limit the size of each profile's configuration, a zero quota is unbounded. An entry's size is the length of
+// its key and value. MaxProfiles limits the profiles a user can create besides the default one, which bounds the size
+// of all of a user's configurations together.
+type Quotas struct {
+	MaxKeys       int   `env:"QUOTA_MAX_KEYS" json:"maxKeys"`
+	MaxBytes      int64 `env:"QUOTA_MAX_BYTES" json:"maxBytes"`
+	MaxGroupBytes int64 `env:"QUOTA_MAX_GROUP_BYTES" json:"maxGroupBytes"`
+	MaxProfiles   int   `env:"QUOTA_MAX_PROFILES" json:"maxProfiles"`
+}
+
+func (q Quotas) enabled() bool {
+	return q.MaxKeys > 0 || q.MaxBytes > 0 || q.MaxGroupBytes > 0
+}
+
+// QuotaError is returned by writes that would grow a configuration past one of its quotas, nothing is written when
+// it's returned
+type QuotaError struct {
+	// Quota is the exceeded quota, keys, bytes, groupBytes or profiles
+	Quota string
+	// Group is the group whose size exceeds MaxGroupBytes
+	Group string
+	Limit int64
+	Usage int64
+}
+
+func (e *QuotaError) Error() string {
+	if e.Group != "" {
+		return fmt.Sprintf("group %s exceeds the %s quota: %d of %d", e.Group, e.Quota, e.Usage, e.Limit)
+	} else if e.Quota == "profiles" {
+		return fmt.Sprintf("profiles exceed the %s quota: %d of %d", e.Quota, e.Usage, e.Limit)
+	}
+	return fmt.Sprintf("configuration exceeds the %s quota: %d of %d", e.Quota, e.Usage, e.Limit)
+}
+
+// ConfigUsage is the size of a profile's configuration and the quotas it's held to
+type ConfigUsage struct {
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+	// Groups is the size of each group
+	Groups map[string]int64 `json:"groups"`
+	Quotas Quotas           `json:"quotas"`
+}
+
+func entrySize(key string, value string) int64 {
+	return int64(len(key) + len(value))
+}
+
+// sizedUsage tallies the usage of entries sized by key
+func sizedUsage(sizes map[string]int64, quotas Quotas) *ConfigUsage {
+	usage := &ConfigUsage{Keys: len(sizes), Groups: make(map[string]int64), Quotas: quotas}
+	for key, size := range sizes {
+		usage.Bytes += size
+		usage.Groups[configGroup(key)] += size
+	}
+	return usage
+}
+
+func entrySizes(configuration *Configuration) map[string]int64 {
+	sizes := make(map[string]int64)
+	if configuration != nil {
+		for _, entry := range configuration.Config {
+			sizes[entry.Key] = entrySize(entry.Key, entry.Value)
+		}
+	}
+	return sizes
+}
+
+// checkProfiles returns a *QuotaError when a user already holding profiles named profiles can't create another one
+func (q Quotas) checkProfiles(profiles int) error {
+	if q.MaxProfiles > 0 && profiles >= q.MaxProfiles {
+		return &QuotaError{Quota: "profiles", Limit: int64(q.MaxProfiles), Usage: int64(profiles + 1)}
+	}
+	return nil
+}
+
+// withChanges returns the usage of the configuration once changes recorded on top of it are applied, the sizes of
+// groups left empty are dropped
+func (u *ConfigUsage) withChanges(changes []ConfigChange) *ConfigUsage {
+	after := &ConfigUsage{Keys: u.Keys, Bytes: u.Bytes, Groups: make(map[string]int64, len(u.Groups)), Quotas: u.Quotas}
+	for group, size := range u.Groups {
+		after.Groups[group] = size
+	}
+	for _, change := range changes {
+		var size int64
+		if change.Previous != nil {
+			size -= entrySize(change.Key, *change.Previous)
+			after.Keys--
+		}
+		if change.Value != nil {
+			size += entrySize(change.Key, *change.Value)
+			after.Keys++
+		}
+		group := configGroup(change.Key)
+		after.Bytes += size
+		after.Groups[group] += size
+		if after.Groups[group] == 0 {
+			delete(after.Groups, group)
+		}
+	}
+	return after
+}
+
+// check returns a *QuotaError when a write grows the configuration from usage before to after past a quota. Usage
+// already past a quota that was lowered only has to not grow, so keys can always be deleted or shrunk.
+func (q Quotas) check(before *ConfigUsage, after *ConfigUsage) error {
+	if q.MaxKeys > 0 && after.Keys > q.MaxKeys && after.Keys > before.Keys {
+		return &QuotaError{Quota: "keys", Limit: int64(q.MaxKeys), Usage: int64(after.Keys)}
+	}
+	if q.MaxBytes > 0 && after.Bytes > q.MaxBytes && after.Bytes > before.Bytes {
+		return &QuotaError{Quota: "bytes", Limit: q.MaxBytes, Usage: after.Bytes}
+	}
+	if q.MaxGroupBytes > 0 {
+		for group, size := range after.Groups {
+			if size > q.MaxGroupBytes && size > before.Groups[group] {
+				return &QuotaError{Quota: "groupBytes", Group: group, Limit: q.MaxGroupBytes, Usage: size}
+			}
+		}
+	}
+	return nil
+}
+
+func (w configWriter) FindUsage(ctx context.Context, userId int64, profile string) (*ConfigUsage, error) {
+	configuration, err := w.find(ctx, userId, profile)
+
+	if err != nil || configuration == nil {
+		return nil, err
+	}
+	return sizedUsage(entrySizes(configuration), w.quotas), nil
+}
@@ -1,21 +1,126 @@
 package main
 
-import "context"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
+// ErrPreconditionFailed is returned by writes whose Precondition didn't hold, nothing is written when it's returned
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ConfigRepository stores a configuration per user profile, DefaultProfile is where configs were stored before profiles
+// were introduced and always exists
 type ConfigRepository interface {
-	FindByUserId(ctx context.Context, userId int64) (*Configuration, error)
-	Save(ctx context.Context, userId int64, entry *ConfigEntry) error
-	SaveBatch(ctx context.Context, userId int64, configuration *Configuration) ([]string, error)
-	DeleteKey(ctx context.Context, userId int64, key string) error
+	FindByUserId(ctx context.Context, userId int64, profile string) (*Configuration, error)
+	// FindKey reads a single entry without loading the rest of the configuration, nil when it's missing
+	FindKey(ctx context.Context, userId int64, profile string, key string) (*ConfigEntry, error)
+	// FindGroup reads the entries of a single group without loading the rest of the configuration, at the revision
+	// FindByUserId would read it at. It's nil when the profile has no configuration.
+	FindGroup(ctx context.Context, userId int64, profile string, group string) (*Configuration, error)
+	// FindCurrentRevision returns the revision FindByUserId would read the configuration at without loading it, ok is
+	// false when the user has no configuration
+	FindCurrentRevision(ctx context.Context, userId int64, profile string) (revision int64, ok bool, err error)
+	Save(ctx context.Context, userId int64, profile string, entry *ConfigEntry) error
+	SaveBatch(ctx context.Context, userId int64, profile string, configuration *Configuration) ([]string, error)
+	DeleteKey(ctx context.Context, userId int64, profile string, key string) error
+	// Apply upserts and deletes keys as a single revision, rejected keys are returned and the remaining mutations are
+	// still applied. The returned revision is the one the configuration is at after the write, its changes are empty
+	// when nothing changed and it's nil when the user still has no configuration.
+	Apply(ctx context.Context, userId int64, profile string, mutations []ConfigMutation, precondition Precondition) (*ConfigRevision, []string, error)
+	// FindRevisions returns the user's recorded revisions newest first
+	FindRevisions(ctx context.Context, userId int64, profile string, filter RevisionFilter) ([]ConfigRevision, error)
+	// FindUsage returns the size of the profile's configuration and the quotas writes are held to, nil when the profile
+	// has no configuration
+	FindUsage(ctx context.Context, userId int64, profile string) (*ConfigUsage, error)
+
+	// ListProfiles returns the user's profiles sorted by name, the default profile is always listed
+	ListProfiles(ctx context.Context, userId int64) ([]Profile, error)
+	// CreateProfile creates an empty profile, failing with ErrProfileExists when it already exists
+	CreateProfile(ctx context.Context, userId int64, profile string) error
+	// RenameProfile moves a profile's configuration and history to a new name, failing with ErrProfileNotFound or
+	// ErrProfileExists. The default profile can't be renamed, ErrInvalidProfile is returned for it.
+	RenameProfile(ctx context.Context, userId int64, profile string, name string) error
+	// DeleteProfile deletes a profile's configuration and history, failing with ErrProfileNotFound when it's missing.
+	// The default profile can't be deleted, ErrInvalidProfile is returned for it.
+	DeleteProfile(ctx context.Context, userId int64, profile string) error
+}
+
+// RepositoryOptions are the backend independent settings every ConfigRepository is created with
+type RepositoryOptions struct {
+	MaxConfigValueLength int64         `env:"MAX_CONFIG_VALUE_LENGTH" envDefault:"262144"`
+	HistoryRetention     time.Duration `env:"HISTORY_RETENTION" envDefault:"720h"` // 30 days, 0 keeps history forever
+	// CompressionThreshold is the length from which stored values are compressed, 0 disables compression
+	CompressionThreshold int64 `env:"COMPRESSION_THRESHOLD" envDefault:"4096"`
+	Quotas               Quotas
+	Encryption           EncryptionOptions
 }
 
 type Configuration struct {
 	Config []ConfigEntry `json:"config"`
+	// Revision is the revision the configuration was read at, exposed to clients as the ETag
+	Revision int64 `json:"-"`
 }
 
 type ConfigEntry struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
+	// Type is the type of value Value holds. It's always set when reading, when writing an empty Type is inferred from
+	// Value and any other must match it, see typedConfigValue.
+	Type ValueType `json:"type,omitempty"`
+}
+
+// ConfigMutation upserts Value under Key, or deletes the key when Value is nil. Type is checked like ConfigEntry's.
+type ConfigMutation struct {
+	Key   string    `json:"key"`
+	Value *string   `json:"value"`
+	Type  ValueType `json:"type,omitempty"`
+}
+
+// Precondition is checked atomically with a write, the zero value always holds
+type Precondition struct {
+	// Exists requires the user to have a configuration
+	Exists bool
+	// Revision requires the configuration to be at exactly this revision, it implies Exists
+	Revision *int64
+}
+
+func (p Precondition) holds(exists bool, revision int64) bool {
+	if p.Revision != nil {
+		return exists && *p.Revision == revision
+	}
+	return exists || !p.Exists
+}
+
+func (p Precondition) empty() bool {
+	return !p.Exists && p.Revision == nil
+}
+
+// ConfigChange records a single key modified by a revision, nil values mean the key was absent
+type ConfigChange struct {
+	Key      string  `json:"key"`
+	Value    *string `json:"value"`
+	Previous *string `json:"previous"`
+	// Type and PreviousType are the types of Value and Previous, they're empty in revisions recorded before changes
+	// kept them and are inferred from the text then
+	Type         ValueType `json:"type,omitempty" bson:"type,omitempty"`
+	PreviousType ValueType `json:"previousType,omitempty" bson:"previousType,omitempty"`
+	// Sealed is set on changes recorded with the values of an encrypted key sealed, repositories return them opened
+	Sealed bool `json:"sealed,omitempty" bson:"sealed,omitempty"`
+}
+
+// ConfigRevision is a numbered set of changes applied by a single write, revisions of a user only ever increase
+type ConfigRevision struct {
+	Revision int64          `json:"revision"`
+	Time     time.Time      `json:"time"`
+	Changes  []ConfigChange `json:"changes"`
+}
+
+// RevisionFilter narrows down FindRevisions, zero values are unbounded
+type RevisionFilter struct {
+	After  int64
+	Before int64
+	Limit  int
 }
 
 type SessionRepository interface {
@@ -0,0 +1,1410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const contractMaxConfigValueLength = 1024
+
+var contractEncryptionKey = EncryptionKey{Id: "contract-1", Key: bytes.Repeat([]byte{1}, 32)}
+
+// contractOptions enables quotas so every case's writes go through the quota checks, none of them come near them but
+// contractQuotas. Values from a quarter of the max length are compressed, and those of webhooks and tokens encrypted.
+var contractOptions = RepositoryOptions{
+	MaxConfigValueLength: contractMaxConfigValueLength,
+	CompressionThreshold: contractMaxConfigValueLength / 4,
+	Quotas:               Quotas{MaxKeys: 32, MaxBytes: 8192, MaxGroupBytes: 2048, MaxProfiles: 4},
+	Encryption:           EncryptionOptions{Keys: []EncryptionKey{contractEncryptionKey}, Patterns: []string{"*webhook*", "*token*"}},
+}
+
+// configRepositoryFactory creates an empty repository configured with contractOptions, it's invoked once per
+// contract case so backends are free to share the underlying storage as long as it's been cleared
+type configRepositoryFactory func(t *testing.T) ConfigRepository
+
+// testConfigRepositoryContract asserts the behavior every ConfigRepository backend is expected to share
+func testConfigRepositoryContract(t *testing.T, factory configRepositoryFactory) {
+	cases := []struct {
+		name string
+		test func(t *testing.T, repository ConfigRepository)
+	}{
+		{name: "MissingUser", test: contractMissingUser},
+		{name: "SaveRoundTrip", test: contractSaveRoundTrip},
+		{name: "SaveOverwrites", test: contractSaveOverwrites},
+		{name: "SaveBatchRoundTrip", test: contractSaveBatchRoundTrip},
+		{name: "DottedKeys", test: contractDottedKeys},
+		{name: "FindKey", test: contractFindKey},
+		{name: "OversizeValues", test: contractOversizeValues},
+		{name: "ExactValues", test: contractExactValues},
+		{name: "ReservedCharacters", test: contractReservedCharacters},
+		{name: "DeleteKey", test: contractDeleteKey},
+		{name: "UsersAreIsolated", test: contractUsersAreIsolated},
+		{name: "ApplyMixedMutations", test: contractApplyMixedMutations},
+		{name: "Preconditions", test: contractPreconditions},
+		{name: "CurrentRevision", test: contractCurrentRevision},
+		{name: "Changes", test: contractChanges},
+		{name: "StaleUpdates", test: contractStaleUpdates},
+		{name: "RevisionsRecorded", test: contractRevisionsRecorded},
+		{name: "RevisionFilter", test: contractRevisionFilter},
+		{name: "RestoreRevision", test: contractRestoreRevision},
+		{name: "Profiles", test: contractProfiles},
+		{name: "ProfileRenames", test: contractProfileRenames},
+		{name: "CopyAndDiff", test: contractCopyAndDiff},
+		{name: "TypesKept", test: contractTypesKept},
+		{name: "Groups", test: contractGroups},
+		{name: "MergePatch", test: contractMergePatch},
+		{name: "JsonPatch", test: contractJsonPatch},
+		{name: "Quotas", test: contractQuotas},
+		{name: "CompressedValues", test: contractCompressedValues},
+		{name: "EncryptedValues", test: contractEncryptedValues},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.test(t, factory(t))
+		})
+	}
+}
+
+var contractValues = []ConfigEntry{
+	{Key: "runelite.theme", Value: "dark mode"},
+	{Key: "grounditems.defaultColor", Value: "-16777216"},
+	{Key: "grounditems.hideUnderValue", Value: "1.5"},
+	{Key: "grounditems.showMenuItemQuantities", Value: "true"},
+	{Key: "grounditems.highlightedItems", Value: "[\"Abyssal whip\",\"Dragon bones\"]"},
+	{Key: "killcount.lastBoss", Value: "{\"name\":\"Vorkath\",\"kills\":42,\"pet\":false}"},
+}
+
+func contractMissingUser(t *testing.T, repository ConfigRepository) {
+	configuration, err := repository.FindByUserId(context.Background(), 1, DefaultProfile)
+
+	if err != nil || configuration != nil {
+		t.Errorf("Got configuration %v and error %v for a missing user", configuration, err)
+	}
+}
+
+func contractSaveRoundTrip(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	for i := range contractValues {
+		if err := repository.Save(ctx, 1, DefaultProfile, &contractValues[i]); err != nil {
+			t.Fatalf("Failed to save %s: %s", contractValues[i].Key, err)
+		}
+	}
+	assertConfiguration(t, repository, 1, contractValues)
+}
+
+func contractSaveOverwrites(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	for _, value := range []string{"first", "42", "second"} {
+		if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "group.key", Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{{Key: "group.key", Value: "second"}})
+}
+
+func contractSaveBatchRoundTrip(t *testing.T, repository ConfigRepository) {
+	failedKeys, err := repository.SaveBatch(context.Background(), 1, DefaultProfile, &Configuration{Config: contractValues})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failedKeys) != 0 {
+		t.Errorf("Got failed keys %v but expected none", failedKeys)
+	}
+	assertConfiguration(t, repository, 1, contractValues)
+}
+
+func contractDottedKeys(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "group.a.b", Value: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: []ConfigEntry{
+		{Key: "group.c.d.e", Value: "second"},
+		{Key: "group.a:b", Value: "third"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{
+		{Key: "group.a.b", Value: "first"},
+		{Key: "group.a:b", Value: "third"},
+		{Key: "group.c.d.e", Value: "second"},
+	})
+	if entry, err := repository.FindKey(ctx, 1, DefaultProfile, "group.c.d.e"); err != nil || entry == nil || entry.Key != "group.c.d.e" {
+		t.Errorf("Got entry %v, %v but expected group.c.d.e", entry, err)
+	}
+
+	if err := repository.DeleteKey(ctx, 1, DefaultProfile, "group.a.b"); err != nil {
+		t.Fatal(err)
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{
+		{Key: "group.a:b", Value: "third"},
+		{Key: "group.c.d.e", Value: "second"},
+	})
+
+	revisions, err := repository.FindRevisions(ctx, 1, DefaultProfile, RevisionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) == 0 || len(revisions[0].Changes) != 1 || revisions[0].Changes[0].Key != "group.a.b" {
+		t.Errorf("Got revisions %v but expected the deletion of group.a.b first", revisions)
+	}
+}
+
+func contractFindKey(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if entry, err := repository.FindKey(ctx, 1, DefaultProfile, "runelite.theme"); err != nil || entry != nil {
+		t.Errorf("Got entry %v, %v for a missing user but expected none", entry, err)
+	}
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: append(contractValues, ConfigEntry{Key: "group.a.b", Value: "dotted"})}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range contractValues {
+		entry, err := repository.FindKey(ctx, 1, DefaultProfile, expected.Key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || entry.Key != expected.Key || !equivalentValues(entry.Value, expected.Value) {
+			t.Errorf("Got entry %v but expected %v", entry, expected)
+		}
+	}
+	if entry, err := repository.FindKey(ctx, 1, DefaultProfile, "group.a.b"); err != nil || entry == nil || entry.Value != "dotted" {
+		t.Errorf("Got entry %v, %v for a dotted key but expected its value", entry, err)
+	}
+	for _, key := range []string{"runelite.missing", "missing.key", "runelite", "_id.key", "$set.key"} {
+		if entry, err := repository.FindKey(ctx, 1, DefaultProfile, key); err != nil || entry != nil {
+			t.Errorf("Got entry %v, %v for %s but expected none", entry, err, key)
+		}
+	}
+	if entry, err := repository.FindKey(ctx, 2, DefaultProfile, "runelite.theme"); err != nil || entry != nil {
+		t.Errorf("Got entry %v, %v for another user but expected none", entry, err)
+	}
+}
+
+func contractOversizeValues(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	oversize := strings.Repeat("a", contractMaxConfigValueLength+1)
+
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "group.oversize", Value: oversize}); err == nil {
+		t.Errorf("Saved a value exceeding the max length")
+	}
+	failedKeys, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: []ConfigEntry{
+		{Key: "group.oversize", Value: oversize},
+		{Key: "group.fits", Value: strings.Repeat("a", contractMaxConfigValueLength)},
+	}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failedKeys, []string{"group.oversize"}) {
+		t.Errorf("Got failed keys %v but expected %v", failedKeys, []string{"group.oversize"})
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{{Key: "group.fits", Value: strings.Repeat("a", contractMaxConfigValueLength)}})
+}
+
+func contractExactValues(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	// none of these may come back re-marshalled, guessed into another type or rejected
+	entries := []ConfigEntry{
+		{Key: "group.leadingZero", Value: "007", Type: ValueString},
+		{Key: "group.exponent", Value: "1e3", Type: ValueNumber},
+		{Key: "group.precise", Value: "0.10000000000000000001", Type: ValueNumber},
+		{Key: "group.huge", Value: "123456789012345678901234567890", Type: ValueNumber},
+		{Key: "group.almostBool", Value: "true_ish", Type: ValueString},
+		{Key: "group.quoted", Value: "\"quoted\"", Type: ValueString},
+		{Key: "group.null", Value: "null", Type: ValueString},
+		{Key: "group.object", Value: "{\"b\": 1, \"a\": [2, 1]}", Type: ValueObject},
+		{Key: "group.invalid", Value: "{invalid", Type: ValueString},
+		{Key: "group.empty", Value: "", Type: ValueString},
+	}
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: entries[1:]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.Save(ctx, 1, DefaultProfile, &entries[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	configuration, err := repository.FindByUserId(ctx, 1, DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := sortedEntries(configuration.Config); !reflect.DeepEqual(actual, sortedEntries(entries)) {
+		t.Errorf("Got configuration %v but expected %v", actual, entries)
+	}
+	for _, expected := range entries {
+		if entry, err := repository.FindKey(ctx, 1, DefaultProfile, expected.Key); err != nil || entry == nil || *entry != expected {
+			t.Errorf("Got entry %v, %v but expected %v", entry, err, expected)
+		}
+	}
+	revisions, err := repository.FindRevisions(ctx, 1, DefaultProfile, RevisionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || *revisions[1].Changes[len(revisions[1].Changes)-1].Value != "" || *revisions[0].Changes[0].Value != "007" {
+		t.Errorf("Got revisions %v but expected the values as they were written", revisions)
+	}
+}
+
+func contractReservedCharacters(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	for _, key := range []string{"", "group", "group.", ".key"} {
+		if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: key, Value: "value"}); err == nil {
+			t.Errorf("Saved key %q without a group and field", key)
+		}
+	}
+
+	// keys are stored as they are, whatever the backend reserves for itself
+	entries := []ConfigEntry{
+		{Key: "$set.key", Value: "dollar"},
+		{Key: "_userId.key", Value: "userId"},
+		{Key: "_rev.x", Value: "rev"},
+		{Key: "_keys.x", Value: "keys"},
+		{Key: "group.$inc", Value: "operator"},
+		{Key: "group._id", Value: "id"},
+		{Key: "group.%2E", Value: "escaped"},
+		{Key: "group.100%", Value: "percent"},
+		{Key: "group.a..b", Value: "empty segment"},
+		{Key: "group.a.", Value: "trailing dot"},
+	}
+	failedKeys, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: entries})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failedKeys) != 0 {
+		t.Errorf("Got failed keys %v but expected none", failedKeys)
+	}
+	assertConfiguration(t, repository, 1, entries)
+	for _, expected := range entries {
+		if entry, err := repository.FindKey(ctx, 1, DefaultProfile, expected.Key); err != nil || entry == nil || entry.Key != expected.Key || entry.Value != expected.Value {
+			t.Errorf("Got entry %v, %v but expected %v", entry, err, expected)
+		}
+	}
+	if revision, exists, err := repository.FindCurrentRevision(ctx, 1, DefaultProfile); err != nil || !exists || revision != 1 {
+		t.Errorf("Got revision %d, %v, %v but expected 1", revision, exists, err)
+	}
+
+	for _, entry := range entries {
+		if err := repository.DeleteKey(ctx, 1, DefaultProfile, entry.Key); err != nil {
+			t.Fatalf("Failed to delete %q: %s", entry.Key, err)
+		}
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{})
+}
+
+func contractDeleteKey(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if err := repository.DeleteKey(ctx, 1, DefaultProfile, "group.missing"); err != nil {
+		t.Errorf("Deleting from a missing user failed: %s", err)
+	}
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: contractValues}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"grounditems.defaultColor", "killcount.lastBoss", "group.missing"} {
+		if err := repository.DeleteKey(ctx, 1, DefaultProfile, key); err != nil {
+			t.Fatalf("Failed to delete %s: %s", key, err)
+		}
+	}
+	remaining := make([]ConfigEntry, 0)
+	for _, entry := range contractValues {
+		if entry.Key != "grounditems.defaultColor" && entry.Key != "killcount.lastBoss" {
+			remaining = append(remaining, entry)
+		}
+	}
+	assertConfiguration(t, repository, 1, remaining)
+}
+
+func contractUsersAreIsolated(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "group.key", Value: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.Save(ctx, 2, DefaultProfile, &ConfigEntry{Key: "group.key", Value: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.DeleteKey(ctx, 2, DefaultProfile, "group.key"); err != nil {
+		t.Fatal(err)
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{{Key: "group.key", Value: "first"}})
+}
+
+func contractApplyMixedMutations(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: contractValues}); err != nil {
+		t.Fatal(err)
+	}
+	revision, failedKeys, err := repository.Apply(ctx, 1, DefaultProfile, []ConfigMutation{
+		{Key: "runelite.theme", Value: nil},
+		{Key: "grounditems.defaultColor", Value: stringPtr("255")},
+		{Key: "oversize.key", Value: stringPtr(strings.Repeat("a", contractMaxConfigValueLength+1))},
+		{Key: "killcount.lastBoss", Value: nil},
+	}, Precondition{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failedKeys, []string{"oversize.key"}) {
+		t.Errorf("Got failed keys %v but expected %v", failedKeys, []string{"oversize.key"})
+	}
+	if revision == nil || len(revision.Changes) != 3 {
+		t.Fatalf("Got revision %v but expected a single revision with 3 changes", revision)
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{
+		{Key: "grounditems.defaultColor", Value: "255"},
+		{Key: "grounditems.hideUnderValue", Value: "1.5"},
+		{Key: "grounditems.showMenuItemQuantities", Value: "true"},
+		{Key: "grounditems.highlightedItems", Value: "[\"Abyssal whip\",\"Dragon bones\"]"},
+	})
+}
+
+func contractPreconditions(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	update := []ConfigMutation{{Key: "group.key", Value: stringPtr("second")}}
+	zero := int64(0)
+
+	if _, _, err := repository.Apply(ctx, 1, DefaultProfile, update, Precondition{Revision: &zero}); err != ErrPreconditionFailed {
+		t.Errorf("Got error %v updating a missing user at a revision but expected %v", err, ErrPreconditionFailed)
+	}
+	if _, _, err := repository.Apply(ctx, 1, DefaultProfile, update, Precondition{Exists: true}); err != ErrPreconditionFailed {
+		t.Errorf("Got error %v updating a missing user but expected %v", err, ErrPreconditionFailed)
+	}
+	if configuration, err := repository.FindByUserId(ctx, 1, DefaultProfile); err != nil || configuration != nil {
+		t.Fatalf("Got configuration %v and error %v but expected failed preconditions to not create one", configuration, err)
+	}
+
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "group.key", Value: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	configuration, err := repository.FindByUserId(ctx, 1, DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := configuration.Revision
+
+	revision, _, err := repository.Apply(ctx, 1, DefaultProfile, update, Precondition{Revision: &read})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision == nil || revision.Revision <= read {
+		t.Fatalf("Got revision %v but expected one after %d", revision, read)
+	}
+	if _, _, err = repository.Apply(ctx, 1, DefaultProfile, []ConfigMutation{{Key: "group.key", Value: stringPtr("stale")}}, Precondition{Revision: &read}); err != ErrPreconditionFailed {
+		t.Errorf("Got error %v writing at a stale revision but expected %v", err, ErrPreconditionFailed)
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{{Key: "group.key", Value: "second"}})
+
+	// writes that don't change anything still report the current revision
+	unchanged, _, err := repository.Apply(ctx, 1, DefaultProfile, update, Precondition{Exists: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configuration, err = repository.FindByUserId(ctx, 1, DefaultProfile); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged == nil || len(unchanged.Changes) != 0 || unchanged.Revision != configuration.Revision {
+		t.Errorf("Got revision %v for a no-op write but expected revision %d without changes", unchanged, configuration.Revision)
+	}
+}
+
+func contractCurrentRevision(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if revision, ok, err := repository.FindCurrentRevision(ctx, 1, DefaultProfile); err != nil || ok {
+		t.Fatalf("Got revision %d, %v and error %v for a missing user but expected none", revision, ok, err)
+	}
+	applied, _, err := repository.Apply(ctx, 1, DefaultProfile, []ConfigMutation{{Key: "group.key", Value: stringPtr("value")}}, Precondition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configuration, err := repository.FindByUserId(ctx, 1, DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision, ok, err := repository.FindCurrentRevision(ctx, 1, DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || revision != applied.Revision || revision != configuration.Revision {
+		t.Errorf("Got current revision %d, %v but expected %d", revision, ok, applied.Revision)
+	}
+}
+
+func contractChanges(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: contractValues}); err != nil {
+		t.Fatal(err)
+	}
+	synced, err := FindChanges(ctx, repository, 1, DefaultProfile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !synced.Reset || len(synced.Config) != len(contractValues) {
+		t.Fatalf("Got changes %+v since 0 but expected the full configuration", synced)
+	}
+
+	_, _, err = repository.Apply(ctx, 1, DefaultProfile, []ConfigMutation{
+		{Key: "runelite.theme", Value: stringPtr("light mode")},
+		{Key: "killcount.lastBoss", Value: nil},
+	}, Precondition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, _, err := repository.Apply(ctx, 1, DefaultProfile, []ConfigMutation{{Key: "runelite.theme", Value: stringPtr("dark mode")}}, Precondition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := FindChanges(ctx, repository, 1, DefaultProfile, synced.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &ConfigChanges{
+		Revision: applied.Revision,
+		Config:   []ChangedEntry{{Key: "runelite.theme", Value: "dark mode", Type: ValueString, Revision: applied.Revision}},
+		Deleted:  []ConfigTombstone{{Key: "killcount.lastBoss", Revision: applied.Revision - 1}},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Got changes %+v but expected %+v", changes, expected)
+	}
+
+	if changes, err = FindChanges(ctx, repository, 1, DefaultProfile, applied.Revision); err != nil {
+		t.Fatal(err)
+	}
+	if changes.Reset || len(changes.Config) != 0 || len(changes.Deleted) != 0 || changes.Revision != applied.Revision {
+		t.Errorf("Got changes %+v since the current revision but expected none", changes)
+	}
+}
+
+func contractStaleUpdates(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: contractValues}); err != nil {
+		t.Fatal(err)
+	}
+	synced, _, err := repository.FindCurrentRevision(ctx, 1, DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "runelite.theme", Value: "light mode"}); err != nil {
+		t.Fatal(err)
+	}
+
+	revision, failedKeys, staleKeys, err := ApplyUpdates(ctx, repository, 1, DefaultProfile, []ConfigUpdate{
+		{Key: "runelite.theme", Value: stringPtr("dark mode"), Revision: synced},
+		{Key: "killcount.lastBoss", Value: nil, Revision: synced},
+		{Key: "oversize.key", Value: stringPtr(strings.Repeat("a", contractMaxConfigValueLength+1)), Revision: synced},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(staleKeys, []string{"runelite.theme"}) || !reflect.DeepEqual(failedKeys, []string{"oversize.key"}) {
+		t.Errorf("Got stale keys %v and failed keys %v but expected [runelite.theme] and [oversize.key]", staleKeys, failedKeys)
+	}
+	if revision == nil || len(revision.Changes) != 1 {
+		t.Errorf("Got revision %v but expected a single change", revision)
+	}
+
+	// updates based on the latest revision always apply
+	if _, _, staleKeys, err = ApplyUpdates(ctx, repository, 1, DefaultProfile, []ConfigUpdate{
+		{Key: "runelite.theme", Value: stringPtr("dark mode"), Revision: revision.Revision},
+	}); err != nil || len(staleKeys) != 0 {
+		t.Errorf("Got stale keys %v and error %v but expected the update to apply", staleKeys, err)
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{
+		{Key: "runelite.theme", Value: "dark mode"},
+		{Key: "grounditems.defaultColor", Value: "-16777216"},
+		{Key: "grounditems.hideUnderValue", Value: "1.5"},
+		{Key: "grounditems.showMenuItemQuantities", Value: "true"},
+		{Key: "grounditems.highlightedItems", Value: "[\"Abyssal whip\",\"Dragon bones\"]"},
+	})
+
+	// updates based on revisions further back than the history read for them can't be checked
+	base, _, err := repository.FindCurrentRevision(ctx, 1, DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= staleRevisionLimit; i++ {
+		if err = repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "killcount.kills", Value: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, staleKeys, err = ApplyUpdates(ctx, repository, 1, DefaultProfile, []ConfigUpdate{
+		{Key: "runelite.theme", Value: stringPtr("light mode"), Revision: base},
+		{Key: "grounditems.defaultColor", Value: stringPtr("-1"), Revision: base + 1},
+	}); err != nil || !reflect.DeepEqual(staleKeys, []string{"runelite.theme"}) {
+		t.Errorf("Got stale keys %v and error %v but expected [runelite.theme]", staleKeys, err)
+	}
+
+	// named profiles are never created by updates
+	if _, _, _, err = ApplyUpdates(ctx, repository, 1, "missing", []ConfigUpdate{
+		{Key: "runelite.theme", Value: stringPtr("dark mode")},
+	}); err != ErrProfileNotFound {
+		t.Errorf("Got error %v updating a missing profile but expected %v", err, ErrProfileNotFound)
+	}
+	if _, ok, err := repository.FindCurrentRevision(ctx, 1, "missing"); err != nil || ok {
+		t.Errorf("Updating a missing profile created it")
+	}
+	if err = repository.CreateProfile(ctx, 1, "pvp"); err != nil {
+		t.Fatal(err)
+	}
+	if revision, _, _, err = ApplyUpdates(ctx, repository, 1, "pvp", []ConfigUpdate{
+		{Key: "runelite.theme", Value: stringPtr("dark mode")},
+	}); err != nil || revision == nil || revision.Revision != 1 {
+		t.Errorf("Got revision %v and error %v updating an existing profile but expected revision 1", revision, err)
+	}
+}
+
+func contractRevisionsRecorded(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	for _, value := range []string{"first", "second", "second"} {
+		if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "group.key", Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repository.DeleteKey(ctx, 1, DefaultProfile, "group.key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.DeleteKey(ctx, 1, DefaultProfile, "group.key"); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := repository.FindRevisions(ctx, 1, DefaultProfile, RevisionFilter{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	// saving an unchanged value or deleting a missing key isn't recorded
+	expected := []ConfigChange{
+		{Key: "group.key", Previous: stringPtr("second"), PreviousType: ValueString},
+		{Key: "group.key", Value: stringPtr("second"), Previous: stringPtr("first"), Type: ValueString, PreviousType: ValueString},
+		{Key: "group.key", Value: stringPtr("first"), Type: ValueString},
+	}
+	if len(revisions) != len(expected) {
+		t.Fatalf("Got %d revisions but expected %d", len(revisions), len(expected))
+	}
+	for i, revision := range revisions {
+		if !reflect.DeepEqual(revision.Changes, []ConfigChange{expected[i]}) {
+			t.Errorf("Got changes %v but expected %v", revision.Changes, expected[i])
+		}
+		if i > 0 && revision.Revision >= revisions[i-1].Revision {
+			t.Errorf("Revisions aren't ordered newest first, got %d after %d", revision.Revision, revisions[i-1].Revision)
+		}
+		if revision.Time.IsZero() {
+			t.Errorf("Revision %d has no time", revision.Revision)
+		}
+	}
+	if other, _ := repository.FindRevisions(ctx, 2, DefaultProfile, RevisionFilter{}); len(other) != 0 {
+		t.Errorf("Got revisions %v for another user", other)
+	}
+}
+
+func contractRevisionFilter(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	for _, value := range []string{"1", "2", "3", "4", "5"} {
+		if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "group.key", Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := repository.FindRevisions(ctx, 1, DefaultProfile, RevisionFilter{})
+
+	if err != nil || len(all) != 5 {
+		t.Fatalf("Got revisions %v and error %v but expected 5 revisions", all, err)
+	}
+	tests := []struct {
+		filter   RevisionFilter
+		expected []ConfigRevision
+	}{
+		{filter: RevisionFilter{Limit: 2}, expected: all[:2]},
+		{filter: RevisionFilter{After: all[2].Revision}, expected: all[:2]},
+		{filter: RevisionFilter{Before: all[2].Revision}, expected: all[3:]},
+		{filter: RevisionFilter{After: all[4].Revision, Before: all[0].Revision, Limit: 2}, expected: all[1:3]},
+	}
+	for _, test := range tests {
+		revisions, err := repository.FindRevisions(ctx, 1, DefaultProfile, test.filter)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(revisions, test.expected) {
+			t.Errorf("Got revisions %v for filter %+v but expected %v", revisions, test.filter, test.expected)
+		}
+	}
+}
+
+func contractRestoreRevision(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: contractValues}); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := repository.FindRevisions(ctx, 1, DefaultProfile, RevisionFilter{Limit: 1})
+	if err != nil || len(revisions) != 1 {
+		t.Fatalf("Got revisions %v and error %v but expected a single revision", revisions, err)
+	}
+	synced := revisions[0].Revision
+
+	// a bad sync wiping most of the config
+	_, _, err = repository.Apply(ctx, 1, DefaultProfile, []ConfigMutation{
+		{Key: "runelite.theme", Value: stringPtr("light mode")},
+		{Key: "grounditems.defaultColor", Value: nil},
+		{Key: "grounditems.highlightedItems", Value: nil},
+		{Key: "killcount.lastBoss", Value: nil},
+		{Key: "killcount.lastRaid", Value: stringPtr("Chambers of Xeric")},
+	}, Precondition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = RestoreRevision(ctx, repository, 1, DefaultProfile, synced, "grounditems", Precondition{}); err != nil {
+		t.Fatal(err)
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{
+		{Key: "runelite.theme", Value: "light mode"},
+		{Key: "grounditems.defaultColor", Value: "-16777216"},
+		{Key: "grounditems.hideUnderValue", Value: "1.5"},
+		{Key: "grounditems.showMenuItemQuantities", Value: "true"},
+		{Key: "grounditems.highlightedItems", Value: "[\"Abyssal whip\",\"Dragon bones\"]"},
+		{Key: "killcount.lastRaid", Value: "Chambers of Xeric"},
+	})
+
+	// restores conditioned on a revision the configuration has moved on from aren't applied
+	current, _, err := repository.FindCurrentRevision(ctx, 1, DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := current - 1
+	if _, _, err = RestoreRevision(ctx, repository, 1, DefaultProfile, synced, "", Precondition{Revision: &stale}); err != ErrPreconditionFailed {
+		t.Errorf("Got error %v restoring with a stale precondition but expected %v", err, ErrPreconditionFailed)
+	}
+	restored, _, err := RestoreRevision(ctx, repository, 1, DefaultProfile, synced, "", Precondition{Revision: &current})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored == nil || restored.Revision <= synced {
+		t.Errorf("Got restored revision %v but expected a new revision", restored)
+	}
+	assertConfiguration(t, repository, 1, contractValues)
+
+	if _, _, err = RestoreRevision(ctx, repository, 1, DefaultProfile, synced+1000, "", Precondition{}); err != ErrRevisionNotFound {
+		t.Errorf("Got error %v restoring a missing revision but expected %v", err, ErrRevisionNotFound)
+	}
+
+	// the revision at a point in time is found walking back through more than a page of history, recorded after the
+	// millisecond of the restore
+	time.Sleep(2 * time.Millisecond)
+	for i := 0; i < revisionPageLength+10; i++ {
+		if err = repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "runelite.counter", Value: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if at, err := FindRevisionAt(ctx, repository, 1, DefaultProfile, restored.Time); err != nil || at != restored.Revision {
+		t.Errorf("Got revision %d and error %v at the time of the restore but expected %d", at, err, restored.Revision)
+	}
+	if _, err = FindRevisionAt(ctx, repository, 1, DefaultProfile, restored.Time.Add(-time.Hour*24*365)); err != ErrRevisionNotFound {
+		t.Errorf("Got error %v for a time before the history but expected %v", err, ErrRevisionNotFound)
+	}
+}
+
+func contractProfiles(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if err := repository.CreateProfile(ctx, 1, DefaultProfile); err != ErrProfileExists {
+		t.Errorf("Got error %v creating the default profile but expected %v", err, ErrProfileExists)
+	}
+	if err := repository.CreateProfile(ctx, 1, "not a name"); err != ErrInvalidProfile {
+		t.Errorf("Got error %v creating an invalid profile but expected %v", err, ErrInvalidProfile)
+	}
+	// named profiles only exist once created, writes requiring them fail until then
+	if _, _, err := repository.Apply(ctx, 1, "pvm", []ConfigMutation{{Key: "group.key", Value: stringPtr("value")}}, Precondition{Exists: true}); err != ErrPreconditionFailed {
+		t.Errorf("Got error %v writing to a missing profile but expected %v", err, ErrPreconditionFailed)
+	}
+	if err := repository.CreateProfile(ctx, 1, "pvm"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.CreateProfile(ctx, 1, "pvm"); err != ErrProfileExists {
+		t.Errorf("Got error %v creating an existing profile but expected %v", err, ErrProfileExists)
+	}
+	assertProfileConfiguration(t, repository, 1, "pvm", []ConfigEntry{})
+
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: contractValues}); err != nil {
+		t.Fatal(err)
+	}
+	revision, _, err := repository.Apply(ctx, 1, "pvm", []ConfigMutation{{Key: "runelite.theme", Value: stringPtr("light mode")}}, Precondition{Exists: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision == nil || revision.Revision != 1 {
+		t.Errorf("Got revision %v but expected the first revision of the profile", revision)
+	}
+	assertConfiguration(t, repository, 1, contractValues)
+	assertProfileConfiguration(t, repository, 1, "pvm", []ConfigEntry{{Key: "runelite.theme", Value: "light mode"}})
+
+	if revisions, err := repository.FindRevisions(ctx, 1, "pvm", RevisionFilter{}); err != nil || len(revisions) != 1 {
+		t.Errorf("Got revisions %v, %v but expected only the profile's revision", revisions, err)
+	}
+	if configuration, err := repository.FindByUserId(ctx, 2, "pvm"); err != nil || configuration != nil {
+		t.Errorf("Got configuration %v, %v for another user's profile but expected none", configuration, err)
+	}
+
+	profiles, err := repository.ListProfiles(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(profiles, []Profile{{Name: DefaultProfile, Revision: 1}, {Name: "pvm", Revision: 1}}) {
+		t.Errorf("Got profiles %v", profiles)
+	}
+	if profiles, err = repository.ListProfiles(ctx, 2); err != nil || !reflect.DeepEqual(profiles, []Profile{{Name: DefaultProfile}}) {
+		t.Errorf("Got profiles %v, %v for a user without config but expected the default profile", profiles, err)
+	}
+
+	if err := repository.DeleteProfile(ctx, 1, DefaultProfile); err != ErrInvalidProfile {
+		t.Errorf("Got error %v deleting the default profile but expected %v", err, ErrInvalidProfile)
+	}
+	if err := repository.DeleteProfile(ctx, 1, "pvm"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.DeleteProfile(ctx, 1, "pvm"); err != ErrProfileNotFound {
+		t.Errorf("Got error %v deleting a missing profile but expected %v", err, ErrProfileNotFound)
+	}
+	if configuration, err := repository.FindByUserId(ctx, 1, "pvm"); err != nil || configuration != nil {
+		t.Errorf("Got configuration %v, %v for a deleted profile but expected none", configuration, err)
+	}
+	if revisions, err := repository.FindRevisions(ctx, 1, "pvm", RevisionFilter{}); err != nil || len(revisions) != 0 {
+		t.Errorf("Got revisions %v, %v for a deleted profile but expected none", revisions, err)
+	}
+	assertConfiguration(t, repository, 1, contractValues)
+}
+
+func contractProfileRenames(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	for _, profile := range []string{"pvm", "skilling"} {
+		if err := repository.CreateProfile(ctx, 1, profile); err != nil {
+			t.Fatal(err)
+		}
+		if err := repository.Save(ctx, 1, profile, &ConfigEntry{Key: "group.key", Value: profile}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := repository.RenameProfile(ctx, 1, DefaultProfile, "main"); err != ErrInvalidProfile {
+		t.Errorf("Got error %v renaming the default profile but expected %v", err, ErrInvalidProfile)
+	}
+	if err := repository.RenameProfile(ctx, 1, "pvm", DefaultProfile); err != ErrProfileExists {
+		t.Errorf("Got error %v renaming to the default profile but expected %v", err, ErrProfileExists)
+	}
+	if err := repository.RenameProfile(ctx, 1, "pvm", "skilling"); err != ErrProfileExists {
+		t.Errorf("Got error %v renaming to an existing profile but expected %v", err, ErrProfileExists)
+	}
+	if err := repository.RenameProfile(ctx, 1, "missing", "bossing"); err != ErrProfileNotFound {
+		t.Errorf("Got error %v renaming a missing profile but expected %v", err, ErrProfileNotFound)
+	}
+	if err := repository.RenameProfile(ctx, 1, "pvm", "bossing"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertProfileConfiguration(t, repository, 1, "bossing", []ConfigEntry{{Key: "group.key", Value: "pvm"}})
+	assertProfileConfiguration(t, repository, 1, "skilling", []ConfigEntry{{Key: "group.key", Value: "skilling"}})
+	if configuration, err := repository.FindByUserId(ctx, 1, "pvm"); err != nil || configuration != nil {
+		t.Errorf("Got configuration %v, %v for a renamed profile but expected none", configuration, err)
+	}
+	// the history moves along with the profile
+	if revisions, err := repository.FindRevisions(ctx, 1, "bossing", RevisionFilter{}); err != nil || len(revisions) != 1 {
+		t.Errorf("Got revisions %v, %v for a renamed profile but expected its revision", revisions, err)
+	}
+	if revisions, err := repository.FindRevisions(ctx, 1, "pvm", RevisionFilter{}); err != nil || len(revisions) != 0 {
+		t.Errorf("Got revisions %v, %v under the former name but expected none", revisions, err)
+	}
+}
+
+func contractCopyAndDiff(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: contractValues}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, _, err := repository.FindCurrentRevision(ctx, 1, DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = repository.Apply(ctx, 1, DefaultProfile, []ConfigMutation{
+		{Key: "runelite.theme", Value: stringPtr("light mode")},
+		{Key: "grounditems.defaultColor"},
+		{Key: "xpdrop.fakeXpDropColor", Value: stringPtr("-16711936")},
+	}, Precondition{}); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := DiffConfigs(ctx, repository, 1, ConfigSource{Profile: DefaultProfile, Revision: snapshot}, ConfigSource{Profile: DefaultProfile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &ConfigDiff{
+		Added:   []ConfigEntry{{Key: "xpdrop.fakeXpDropColor", Value: "-16711936", Type: ValueNumber}},
+		Removed: []ConfigEntry{{Key: "grounditems.defaultColor", Value: "-16777216", Type: ValueNumber}},
+		Changed: []ConfigChange{{Key: "runelite.theme", Value: stringPtr("light mode"), Previous: stringPtr("dark mode"), Type: ValueString, PreviousType: ValueString}},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Got diff %+v but expected %+v", diff, expected)
+	}
+
+	// cloning the snapshot's grounditems into a new profile leaves out every other group
+	if _, _, err = CloneProfile(ctx, repository, 1, ConfigSource{Profile: DefaultProfile, Revision: snapshot}, "pvm", []string{"grounditems"}); err != nil {
+		t.Fatal(err)
+	}
+	groundItems := make([]ConfigEntry, 0)
+	for _, entry := range contractValues {
+		if strings.HasPrefix(entry.Key, "grounditems.") {
+			groundItems = append(groundItems, entry)
+		}
+	}
+	assertProfileConfiguration(t, repository, 1, "pvm", groundItems)
+
+	// copying the current config back only removes the deleted key from the copied group
+	if err = repository.Save(ctx, 1, "pvm", &ConfigEntry{Key: "runelite.theme", Value: "pvm mode"}); err != nil {
+		t.Fatal(err)
+	}
+	copied, _, err := CopyConfig(ctx, repository, 1, ConfigSource{Profile: DefaultProfile}, "pvm", []string{"grounditems"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied == nil || len(copied.Changes) != 1 || copied.Changes[0].Key != "grounditems.defaultColor" {
+		t.Errorf("Got copy revision %v but expected only grounditems.defaultColor to be deleted", copied)
+	}
+	if diff, err = DiffConfigs(ctx, repository, 1, ConfigSource{Profile: DefaultProfile}, ConfigSource{Profile: "pvm"}, []string{"grounditems"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added)+len(diff.Removed)+len(diff.Changed) != 0 {
+		t.Errorf("Got diff %+v between copied groups but expected none", diff)
+	}
+
+	if _, _, err = CopyConfig(ctx, repository, 1, ConfigSource{Profile: DefaultProfile, Revision: snapshot + 1000}, "pvm", nil); err != ErrRevisionNotFound {
+		t.Errorf("Got error %v copying a missing revision but expected %v", err, ErrRevisionNotFound)
+	}
+	if _, _, err = CopyConfig(ctx, repository, 1, ConfigSource{Profile: DefaultProfile}, "missing", nil); err != ErrProfileNotFound {
+		t.Errorf("Got error %v copying to a missing profile but expected %v", err, ErrProfileNotFound)
+	}
+	if _, _, err = CloneProfile(ctx, repository, 1, ConfigSource{Profile: "missing"}, "skilling", nil); err != ErrProfileNotFound {
+		t.Errorf("Got error %v cloning a missing profile but expected %v", err, ErrProfileNotFound)
+	}
+	if configuration, err := repository.FindByUserId(ctx, 1, "skilling"); err != nil || configuration != nil {
+		t.Errorf("Got configuration %v, %v after a failed clone but expected none", configuration, err)
+	}
+}
+
+func contractTypesKept(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	assertType := func(profile string, key string, expected ValueType) {
+		t.Helper()
+		entry, err := repository.FindKey(ctx, 1, profile, key)
+		if err != nil || entry == nil || entry.Value != "123" || entry.Type != expected {
+			t.Errorf("Got entry %+v, %v in profile %s but expected 123 typed %s", entry, err, profile, expected)
+		}
+	}
+
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "combat.level", Value: "123"}); err != nil {
+		t.Fatal(err)
+	}
+	// declaring the type of unchanged text is still a change
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "combat.level", Value: "123", Type: ValueString}); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := repository.FindRevisions(ctx, 1, DefaultProfile, RevisionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ConfigChange{Key: "combat.level", Value: stringPtr("123"), Previous: stringPtr("123"), Type: ValueString, PreviousType: ValueNumber}
+	if len(revisions) != 2 || !reflect.DeepEqual(revisions[0].Changes, []ConfigChange{expected}) {
+		t.Fatalf("Got revisions %+v but expected the type change to be recorded", revisions)
+	}
+	typed := revisions[0].Revision
+	assertType(DefaultProfile, "combat.level", ValueString)
+
+	if err = repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "combat.level", Value: "124"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = RestoreRevision(ctx, repository, 1, DefaultProfile, typed, "", Precondition{}); err != nil {
+		t.Fatal(err)
+	}
+	assertType(DefaultProfile, "combat.level", ValueString)
+
+	// copies from earlier revisions are rebuilt from the history
+	if err = repository.DeleteKey(ctx, 1, DefaultProfile, "combat.level"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = CloneProfile(ctx, repository, 1, ConfigSource{Profile: DefaultProfile, Revision: typed}, "pvm", nil); err != nil {
+		t.Fatal(err)
+	}
+	assertType("pvm", "combat.level", ValueString)
+	if _, _, err = CopyConfig(ctx, repository, 1, ConfigSource{Profile: "pvm"}, DefaultProfile, nil); err != nil {
+		t.Fatal(err)
+	}
+	assertType(DefaultProfile, "combat.level", ValueString)
+	diff, err := DiffConfigs(ctx, repository, 1, ConfigSource{Profile: DefaultProfile, Revision: typed - 1}, ConfigSource{Profile: "pvm"}, nil)
+	if err != nil || len(diff.Changed) != 1 || diff.Changed[0].Type != ValueString || diff.Changed[0].PreviousType != ValueNumber {
+		t.Errorf("Got diff %+v, %v but expected the type change", diff, err)
+	}
+
+	// keys left alone by a patch keep their type, moved keys take theirs along and JSON strings set strings
+	if _, _, err = MergePatchConfig(ctx, repository, 1, "pvm", []byte(`{"combat": {"style": "123", "attack": 123}}`), Precondition{}); err != nil {
+		t.Fatal(err)
+	}
+	assertType("pvm", "combat.level", ValueString)
+	assertType("pvm", "combat.style", ValueString)
+	assertType("pvm", "combat.attack", ValueNumber)
+	if _, _, err = JsonPatchConfig(ctx, repository, 1, "pvm", []byte(`[{"op": "move", "from": "/combat/level", "path": "/combat/strength"}]`), Precondition{}); err != nil {
+		t.Fatal(err)
+	}
+	assertType("pvm", "combat.strength", ValueString)
+	if _, _, err = JsonPatchConfig(ctx, repository, 1, "pvm", []byte(`[{"op": "test", "path": "/combat/strength", "value": 123}]`), Precondition{}); err != ErrPatchConflict {
+		t.Errorf("Got error %v testing a string against a number but expected %v", err, ErrPatchConflict)
+	}
+}
+
+func contractGroups(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if groups, err := ListGroups(ctx, repository, 1, DefaultProfile); err != nil || groups != nil {
+		t.Errorf("Got groups %v, %v for a missing user but expected none", groups, err)
+	}
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: contractValues}); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := ListGroups(ctx, repository, 1, DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ConfigGroup{{Name: "grounditems", Keys: 4}, {Name: "killcount", Keys: 1}, {Name: "runelite", Keys: 1}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("Got groups %v but expected %v", groups, expected)
+	}
+
+	configuration, err := repository.FindGroup(ctx, 1, DefaultProfile, "killcount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configuration.Config) != 1 || configuration.Config[0].Key != "killcount.lastBoss" {
+		t.Errorf("Got group %v but expected only killcount.lastBoss", configuration.Config)
+	}
+	current, _, err := repository.FindCurrentRevision(ctx, 1, DefaultProfile)
+	if err != nil || configuration.Revision != current {
+		t.Errorf("Got group at revision %d but expected %d", configuration.Revision, current)
+	}
+	if configuration, err = repository.FindGroup(ctx, 1, DefaultProfile, "missing"); err != nil || configuration == nil || len(configuration.Config) != 0 || configuration.Revision != current {
+		t.Errorf("Got group %v, %v for a missing group but expected it empty at revision %d", configuration, err, current)
+	}
+	if configuration, err = repository.FindGroup(ctx, 2, DefaultProfile, "killcount"); err != nil || configuration != nil {
+		t.Errorf("Got group %v, %v for a missing user but expected none", configuration, err)
+	}
+	if configuration, err = repository.FindGroup(ctx, 1, DefaultProfile, "killcount"); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := configuration.Revision - 1
+	if _, _, err = DeleteGroup(ctx, repository, 1, DefaultProfile, "grounditems", Precondition{Revision: &stale}); err != ErrPreconditionFailed {
+		t.Errorf("Got error %v deleting a group at a stale revision but expected %v", err, ErrPreconditionFailed)
+	}
+	revision, failedKeys, err := DeleteGroup(ctx, repository, 1, DefaultProfile, "grounditems", Precondition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failedKeys) != 0 || revision == nil || len(revision.Changes) != 4 {
+		t.Errorf("Got revision %v and failed keys %v but expected the group's 4 keys deleted in one revision", revision, failedKeys)
+	}
+	remaining := make([]ConfigEntry, 0)
+	for _, entry := range contractValues {
+		if !strings.HasPrefix(entry.Key, "grounditems.") {
+			remaining = append(remaining, entry)
+		}
+	}
+	assertConfiguration(t, repository, 1, remaining)
+
+	if revision, _, err = DeleteGroup(ctx, repository, 1, DefaultProfile, "grounditems", Precondition{}); err != nil || len(revision.Changes) != 0 {
+		t.Errorf("Got revision %v, %v deleting an empty group but expected no changes", revision, err)
+	}
+}
+
+func contractMergePatch(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: contractValues}); err != nil {
+		t.Fatal(err)
+	}
+	patch := `{"grounditems":null,"runelite":{"theme":"light mode","scale":2},"killcount":{"lastBoss":null},"xpdrop":{"fakeXpDropColor":"-16711936"}}`
+	revision, failedKeys, err := MergePatchConfig(ctx, repository, 1, DefaultProfile, []byte(patch), Precondition{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failedKeys) != 0 || revision == nil || len(revision.Changes) != 8 {
+		t.Errorf("Got revision %v and failed keys %v but expected a single revision of 8 changes", revision, failedKeys)
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{
+		{Key: "runelite.theme", Value: "light mode"},
+		{Key: "runelite.scale", Value: "2"},
+		{Key: "xpdrop.fakeXpDropColor", Value: "-16711936"},
+	})
+
+	for _, invalid := range []string{`[]`, `null`, `{"runelite":"theme"}`, `{"runelite":{"":"value"}}`, `{"":{"key":"value"}}`} {
+		if _, _, err = MergePatchConfig(ctx, repository, 1, DefaultProfile, []byte(invalid), Precondition{}); err != ErrInvalidPatch {
+			t.Errorf("Got error %v for merge patch %s but expected %v", err, invalid, ErrInvalidPatch)
+		}
+	}
+	stale := revision.Revision - 1
+	if _, _, err = MergePatchConfig(ctx, repository, 1, DefaultProfile, []byte(`{"runelite":null}`), Precondition{Revision: &stale}); err != ErrPreconditionFailed {
+		t.Errorf("Got error %v for a merge patch at a stale revision but expected %v", err, ErrPreconditionFailed)
+	}
+}
+
+func contractJsonPatch(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: contractValues}); err != nil {
+		t.Fatal(err)
+	}
+	patch := `[
+		{"op":"test","path":"/runelite/theme","value":"dark mode"},
+		{"op":"replace","path":"/runelite/theme","value":"light mode"},
+		{"op":"remove","path":"/grounditems/defaultColor"},
+		{"op":"copy","from":"/killcount/lastBoss","path":"/bosses/last"},
+		{"op":"move","from":"/killcount","path":"/kills"},
+		{"op":"add","path":"/xpdrop","value":{"fakeXpDropColor":"-16711936","enabled":true}}
+	]`
+	if _, _, err := JsonPatchConfig(ctx, repository, 1, DefaultProfile, []byte(patch), Precondition{}); err != nil {
+		t.Fatal(err)
+	}
+	lastBoss := "{\"name\":\"Vorkath\",\"kills\":42,\"pet\":false}"
+	assertConfiguration(t, repository, 1, []ConfigEntry{
+		{Key: "runelite.theme", Value: "light mode"},
+		{Key: "grounditems.hideUnderValue", Value: "1.5"},
+		{Key: "grounditems.showMenuItemQuantities", Value: "true"},
+		{Key: "grounditems.highlightedItems", Value: "[\"Abyssal whip\",\"Dragon bones\"]"},
+		{Key: "bosses.last", Value: lastBoss},
+		{Key: "kills.lastBoss", Value: lastBoss},
+		{Key: "xpdrop.fakeXpDropColor", Value: "-16711936"},
+		{Key: "xpdrop.enabled", Value: "true"},
+	})
+
+	// a failing operation discards the whole patch
+	for _, conflict := range []string{
+		`[{"op":"add","path":"/runelite/scale","value":"2"},{"op":"test","path":"/runelite/theme","value":"dark mode"}]`,
+		`[{"op":"remove","path":"/runelite/missing"}]`,
+		`[{"op":"replace","path":"/missing/key","value":"value"}]`,
+		`[{"op":"move","from":"/missing","path":"/runelite"}]`,
+	} {
+		if _, _, err := JsonPatchConfig(ctx, repository, 1, DefaultProfile, []byte(conflict), Precondition{}); err != ErrPatchConflict {
+			t.Errorf("Got error %v for json patch %s but expected %v", err, conflict, ErrPatchConflict)
+		}
+	}
+	for _, invalid := range []string{
+		`{}`,
+		`[{"op":"add","value":"value"}]`,
+		`[{"op":"add","path":"runelite/theme","value":"value"}]`,
+		`[{"op":"add","path":"/runelite","value":"value"}]`,
+		`[{"op":"add","path":"/runelite/theme"}]`,
+		`[{"op":"increment","path":"/runelite/theme","value":"value"}]`,
+	} {
+		if _, _, err := JsonPatchConfig(ctx, repository, 1, DefaultProfile, []byte(invalid), Precondition{}); err != ErrInvalidPatch {
+			t.Errorf("Got error %v for json patch %s but expected %v", err, invalid, ErrInvalidPatch)
+		}
+	}
+	if entry, err := repository.FindKey(ctx, 1, DefaultProfile, "runelite.scale"); err != nil || entry != nil {
+		t.Errorf("Got entry %v, %v written by a failed patch", entry, err)
+	}
+}
+
+func contractQuotas(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	quotas := contractOptions.Quotas
+
+	if usage, err := repository.FindUsage(ctx, 1, DefaultProfile); err != nil || usage != nil {
+		t.Errorf("Got usage %v, %v for a missing user but expected none", usage, err)
+	}
+	// two groups of 16 keys each 7 bytes long
+	mutations := make([]ConfigMutation, quotas.MaxKeys)
+	for i := range mutations {
+		mutations[i] = ConfigMutation{Key: fmt.Sprintf("g%d.k%02d", i%2, i), Value: stringPtr("v")}
+	}
+	if _, _, err := repository.Apply(ctx, 1, DefaultProfile, mutations, Precondition{}); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := repository.FindUsage(ctx, 1, DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &ConfigUsage{Keys: 32, Bytes: 224, Groups: map[string]int64{"g0": 112, "g1": 112}, Quotas: quotas}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Errorf("Got usage %v but expected %v", usage, expected)
+	}
+
+	_, _, err = repository.Apply(ctx, 1, DefaultProfile, []ConfigMutation{{Key: "g0.k00", Value: stringPtr("w")}, {Key: "g2.extra", Value: stringPtr("v")}}, Precondition{})
+	if quotaErr, ok := err.(*QuotaError); !ok || quotaErr.Quota != "keys" {
+		t.Errorf("Got error %v adding a key past the quota but expected a keys QuotaError", err)
+	}
+	if err = repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "g0.k00", Value: "w"}); err != nil {
+		t.Errorf("Got error %v replacing a key at the quota", err)
+	}
+	if _, _, err = repository.Apply(ctx, 1, DefaultProfile, []ConfigMutation{{Key: "g0.k02"}, {Key: "g2.extra", Value: stringPtr("v")}}, Precondition{}); err != nil {
+		t.Errorf("Got error %v swapping a key at the quota", err)
+	}
+
+	large := strings.Repeat("a", 1000)
+	if _, err = repository.SaveBatch(ctx, 2, DefaultProfile, &Configuration{Config: []ConfigEntry{{Key: "big.a", Value: large}, {Key: "big.b", Value: large}}}); err != nil {
+		t.Fatal(err)
+	}
+	err = repository.Save(ctx, 2, DefaultProfile, &ConfigEntry{Key: "big.c", Value: strings.Repeat("a", 64)})
+	if quotaErr, ok := err.(*QuotaError); !ok || quotaErr.Quota != "groupBytes" || quotaErr.Group != "big" {
+		t.Errorf("Got error %v growing a group past the quota but expected a groupBytes QuotaError", err)
+	}
+	for i := 0; i < 6; i++ {
+		if err = repository.Save(ctx, 2, DefaultProfile, &ConfigEntry{Key: fmt.Sprintf("g%d.a", i), Value: large}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = repository.Save(ctx, 2, DefaultProfile, &ConfigEntry{Key: "g6.a", Value: large})
+	if quotaErr, ok := err.(*QuotaError); !ok || quotaErr.Quota != "bytes" {
+		t.Errorf("Got error %v growing the configuration past the quota but expected a bytes QuotaError", err)
+	}
+	if err = repository.DeleteKey(ctx, 2, DefaultProfile, "big.a"); err != nil {
+		t.Errorf("Got error %v deleting a key", err)
+	}
+	if usage, err = repository.FindUsage(ctx, 2, DefaultProfile); err != nil || usage.Keys != 7 || usage.Bytes != 1005+6*1004 {
+		t.Errorf("Got usage %v, %v but expected the 7 remaining keys", usage, err)
+	}
+	// the usage backends keep track of matches the configuration it's kept for
+	configuration, err := repository.FindByUserId(ctx, 2, DefaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected = sizedUsage(entrySizes(configuration), quotas); !reflect.DeepEqual(usage, expected) {
+		t.Errorf("Got usage %v but expected %v", usage, expected)
+	}
+
+	// concurrent writes can't both take the last keys the quota allows
+	mutations = make([]ConfigMutation, quotas.MaxKeys-2)
+	for i := range mutations {
+		mutations[i] = ConfigMutation{Key: fmt.Sprintf("g.k%02d", i), Value: stringPtr("v")}
+	}
+	if _, _, err = repository.Apply(ctx, 3, DefaultProfile, mutations, Precondition{}); err != nil {
+		t.Fatal(err)
+	}
+	var wait sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			repository.Save(ctx, 3, DefaultProfile, &ConfigEntry{Key: fmt.Sprintf("concurrent.k%d", i), Value: "v"})
+		}(i)
+	}
+	wait.Wait()
+	if usage, err = repository.FindUsage(ctx, 3, DefaultProfile); err != nil || usage.Keys != quotas.MaxKeys {
+		t.Errorf("Got usage %v, %v after concurrent writes but expected %d keys", usage, err, quotas.MaxKeys)
+	}
+
+	for i := 0; i < quotas.MaxProfiles; i++ {
+		if err = repository.CreateProfile(ctx, 4, fmt.Sprintf("profile%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = repository.CreateProfile(ctx, 4, "extra")
+	if quotaErr, ok := err.(*QuotaError); !ok || quotaErr.Quota != "profiles" {
+		t.Errorf("Got error %v creating a profile past the quota but expected a profiles QuotaError", err)
+	}
+	if err = repository.CreateProfile(ctx, 4, "profile0"); err != ErrProfileExists {
+		t.Errorf("Got error %v creating an existing profile at the quota but expected %v", err, ErrProfileExists)
+	}
+	// the default profile doesn't count
+	if err = repository.Save(ctx, 4, DefaultProfile, &ConfigEntry{Key: "group.key", Value: "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = repository.DeleteProfile(ctx, 4, "profile0"); err != nil {
+		t.Fatal(err)
+	}
+	if err = repository.CreateProfile(ctx, 4, "extra"); err != nil {
+		t.Errorf("Got error %v creating a profile in place of a deleted one", err)
+	}
+}
+
+func contractCompressedValues(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	compressed := ConfigEntry{Key: "compressed.object", Value: "{\"items\":[" + strings.Repeat("\"Abyssal whip\",", 60) + "\"Dragon bones\"]}", Type: ValueObject}
+	threshold := ConfigEntry{Key: "compressed.threshold", Value: strings.Repeat("b", int(contractOptions.CompressionThreshold)), Type: ValueString}
+	short := ConfigEntry{Key: "compressed.short", Value: "short", Type: ValueString}
+
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: []ConfigEntry{compressed, threshold, short}}); err != nil {
+		t.Fatal(err)
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{compressed, short, threshold})
+	for _, expected := range []ConfigEntry{compressed, threshold, short} {
+		if entry, err := repository.FindKey(ctx, 1, DefaultProfile, expected.Key); err != nil || entry == nil || *entry != expected {
+			t.Errorf("Got entry %v, %v but expected %v", entry, err, expected)
+		}
+	}
+
+	// the history records the text of the value being replaced, not what it was stored as
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: compressed.Key, Value: "{}"}); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := repository.FindRevisions(ctx, 1, DefaultProfile, RevisionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || len(revisions[0].Changes) != 1 || revisions[0].Changes[0].Previous == nil || *revisions[0].Changes[0].Previous != compressed.Value {
+		t.Errorf("Got revisions %v but expected the replaced value's text", revisions)
+	}
+	assertConfiguration(t, repository, 1, []ConfigEntry{{Key: compressed.Key, Value: "{}"}, short, threshold})
+}
+
+func contractEncryptedValues(t *testing.T, repository ConfigRepository) {
+	ctx := context.Background()
+	entries := []ConfigEntry{
+		{Key: "discord.webhookUrl", Value: "https://discord.com/api/webhooks/1/secret", Type: ValueString},
+		{Key: "raids.apiTOKEN", Value: "123456789", Type: ValueNumber},
+		{Key: "loot.webhooks", Value: "[" + strings.Repeat("\"https://example.com/hook\",", 20) + "\"\"]", Type: ValueArray},
+		{Key: "runelite.theme", Value: "dark mode", Type: ValueString},
+	}
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: entries}); err != nil {
+		t.Fatal(err)
+	}
+	assertConfiguration(t, repository, 1, entries)
+	for _, expected := range entries {
+		if entry, err := repository.FindKey(ctx, 1, DefaultProfile, expected.Key); err != nil || entry == nil || *entry != expected {
+			t.Errorf("Got entry %v, %v but expected %v", entry, err, expected)
+		}
+	}
+
+	if err := repository.Save(ctx, 1, DefaultProfile, &ConfigEntry{Key: "discord.webhookUrl", Value: "https://discord.com/api/webhooks/2/secret"}); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := repository.FindRevisions(ctx, 1, DefaultProfile, RevisionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || len(revisions[0].Changes) != 1 || len(revisions[1].Changes) != len(entries) {
+		t.Fatalf("Got revisions %v but expected both writes", revisions)
+	}
+	change := revisions[0].Changes[0]
+	if change.Sealed || *change.Value != "https://discord.com/api/webhooks/2/secret" || *change.Previous != entries[0].Value {
+		t.Errorf("Got change %v but expected the values as they were written", change)
+	}
+	for _, change := range revisions[1].Changes {
+		if change.Sealed || change.Value == nil || change.Previous != nil {
+			t.Errorf("Got change %v but expected an opened addition", change)
+		}
+	}
+}
+
+// testValueReencryption asserts a repository re-encrypts its values and history once the keys were rotated and the
+// patterns changed, open creates repositories with options over the same storage which starts out empty
+func testValueReencryption(t *testing.T, open func(options RepositoryOptions) ConfigRepository) {
+	ctx := context.Background()
+	entries := []ConfigEntry{
+		{Key: "discord.webhookUrl", Value: "https://discord.com/api/webhooks/1/secret", Type: ValueString},
+		{Key: "loot.webhooks", Value: "[" + strings.Repeat("\"https://example.com/hook\",", 20) + "\"\"]", Type: ValueArray},
+		{Key: "raids.apiToken", Value: "123456789", Type: ValueNumber},
+		{Key: "runelite.notes", Value: "private notes", Type: ValueString},
+	}
+	repository := open(contractOptions)
+	if _, err := repository.SaveBatch(ctx, 1, DefaultProfile, &Configuration{Config: entries}); err != nil {
+		t.Fatal(err)
+	}
+	entries[0].Value = "https://discord.com/api/webhooks/2/secret"
+	if err := repository.Save(ctx, 1, DefaultProfile, &entries[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// webhooks are re-encrypted with the new key, tokens decrypted and notes encrypted
+	rotated := contractOptions
+	rotated.Encryption = EncryptionOptions{
+		Keys:     []EncryptionKey{{Id: "contract-2", Key: bytes.Repeat([]byte{2}, 32)}, contractEncryptionKey},
+		Patterns: []string{"*webhook*", "*notes"},
+	}
+	reencrypter, ok := open(rotated).(ValueReencrypter)
+	if !ok {
+		t.Fatal("Expected the repository to re-encrypt its values")
+	}
+	if rewritten, err := reencrypter.ReencryptValues(ctx); err != nil || rewritten != len(entries)+2 {
+		t.Errorf("Rewrote %d values and revisions, %v but expected %d", rewritten, err, len(entries)+2)
+	}
+	if rewritten, err := reencrypter.ReencryptValues(ctx); err != nil || rewritten != 0 {
+		t.Errorf("Rewrote %d values and revisions, %v but expected them all current", rewritten, err)
+	}
+
+	// the retired key is no longer needed
+	rotated.Encryption.Keys = rotated.Encryption.Keys[:1]
+	repository = open(rotated)
+	assertConfiguration(t, repository, 1, entries)
+	revisions, err := repository.FindRevisions(ctx, 1, DefaultProfile, RevisionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || *revisions[0].Changes[0].Previous != "https://discord.com/api/webhooks/1/secret" {
+		t.Errorf("Got revisions %v but expected them readable with the new key", revisions)
+	}
+}
+
+func stringPtr(value string) *string {
+	return &value
+}
+
+// assertConfiguration compares the user's stored configuration ignoring entry order, json values only have to be
+// equivalent since backends aren't required to keep their original formatting
+func assertConfiguration(t *testing.T, repository ConfigRepository, userId int64, expected []ConfigEntry) {
+	t.Helper()
+	assertProfileConfiguration(t, repository, userId, DefaultProfile, expected)
+}
+
+func assertProfileConfiguration(t *testing.T, repository ConfigRepository, userId int64, profile string, expected []ConfigEntry) {
+	t.Helper()
+	configuration, err := repository.FindByUserId(context.Background(), userId, profile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configuration == nil {
+		t.Fatalf("Got no configuration but expected %v", expected)
+	}
+	actual := sortedEntries(configuration.Config)
+	expected = sortedEntries(expected)
+
+	if len(actual) != len(expected) {
+		t.Fatalf("Got configuration %v but expected %v", actual, expected)
+	}
+	for i := range expected {
+		if actual[i].Key != expected[i].Key || !equivalentValues(actual[i].Value, expected[i].Value) {
+			t.Errorf("Got entry %v but expected %v", actual[i], expected[i])
+		}
+	}
+}
+
+func equivalentValues(actual string, expected string) bool {
+	if actual == expected {
+		return true
+	}
+	var actualJson, expectedJson interface{}
+	if json.Unmarshal([]byte(actual), &actualJson) != nil || json.Unmarshal([]byte(expected), &expectedJson) != nil {
+		return false
+	}
+	return reflect.DeepEqual(actualJson, expectedJson)
+}
+
+func TestMemoryConfigRepositoryContract(t *testing.T) {
+	testConfigRepositoryContract(t, func(t *testing.T) ConfigRepository {
+		return NewMemoryConfigRepository(contractOptions)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"github.com/caarlos0/env/v6"
+	"go.uber.org/zap"
+)
+
+// storeDriver opens a kind of storage that config and/or session repositories are built on top of. Drivers register
+// themselves from the init function of the file implementing them, only the ones selected through CONFIG_STORE and
+// SESSION_STORE are configured and opened.
+type storeDriver interface {
+	// Config returns a pointer to the driver's config block, it's parsed from the environment before Validate is called
+	Config() interface{}
+	Validate() error
+	Open(logger *zap.Logger) error
+	Close() error
+}
+
+type configStoreDriver interface {
+	storeDriver
+	NewConfigRepository(options RepositoryOptions) (ConfigRepository, error)
+}
+
+type sessionStoreDriver interface {
+	storeDriver
+	NewSessionRepository() (SessionRepository, error)
+}
+
+var storeDrivers = make(map[string]func() storeDriver)
+
+func registerStoreDriver(name string, factory func() storeDriver) {
+	if _, ok := storeDrivers[name]; ok {
+		panic("store driver " + name + " registered twice")
+	}
+	storeDrivers[name] = factory
+}
+
+// Stores holds the repositories built from the selected drivers, a driver selected as both the config and session
+// store is only opened once so both repositories share its connection
+type Stores struct {
+	Config  ConfigRepository
+	Session SessionRepository
+	opened  []storeDriver
+}
+
+func OpenStores(cfg *config, logger *zap.Logger) (*Stores, error) {
+	drivers := make(map[string]storeDriver)
+	for _, name := range []string{cfg.ConfigStore, cfg.SessionStore} {
+		if _, ok := drivers[name]; ok {
+			continue
+		}
+		factory, ok := storeDrivers[name]
+		if !ok {
+			return nil, errors.New("unknown store driver " + name)
+		}
+		driver := factory()
+
+		if err := env.Parse(driver.Config()); err != nil {
+			return nil, err
+		}
+		if err := driver.Validate(); err != nil {
+			return nil, errors.New(name + " store: " + err.Error())
+		}
+		drivers[name] = driver
+	}
+	configDriver, ok := drivers[cfg.ConfigStore].(configStoreDriver)
+	if !ok {
+		return nil, errors.New(cfg.ConfigStore + " can't be used as a config store")
+	}
+	sessionDriver, ok := drivers[cfg.SessionStore].(sessionStoreDriver)
+	if !ok {
+		return nil, errors.New(cfg.SessionStore + " can't be used as a session store")
+	}
+
+	stores := &Stores{}
+	for _, name := range []string{cfg.ConfigStore, cfg.SessionStore} {
+		driver := drivers[name]
+		if stores.isOpen(driver) {
+			continue
+		}
+		if err := driver.Open(logger); err != nil {
+			stores.Close()
+			return nil, errors.New(name + " store: " + err.Error())
+		}
+		stores.opened = append(stores.opened, driver)
+	}
+
+	var err error
+	if stores.Config, err = configDriver.NewConfigRepository(cfg.Repository); err != nil {
+		stores.Close()
+		return nil, err
+	}
+	if stores.Session, err = sessionDriver.NewSessionRepository(); err != nil {
+		stores.Close()
+		return nil, err
+	}
+	return stores, nil
+}
+
+func (s *Stores) isOpen(driver storeDriver) bool {
+	for _, opened := range s.opened {
+		if opened == driver {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the opened drivers in reverse order, returning the first error encountered
+func (s *Stores) Close() error {
+	var err error
+	for i := len(s.opened) - 1; i >= 0; i-- {
+		if closeErr := s.opened[i].Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	s.opened = nil
+	return err
+}
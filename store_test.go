@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenStoresMemory(t *testing.T) {
+	t.Setenv("MEMORY_SESSIONS", "f1b7d3c4-uuid:1000")
+	stores, err := OpenStores(&config{ConfigStore: "memory", SessionStore: "memory", Repository: contractOptions}, zap.NewNop())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stores.Close()
+
+	if len(stores.opened) != 1 {
+		t.Errorf("Opened %d drivers but expected the memory driver to be shared", len(stores.opened))
+	}
+	if userId, err := stores.Session.FindUserIdByUuid(context.Background(), "f1b7d3c4-uuid"); err != nil || userId != 1000 {
+		t.Errorf("Got user id %d but expected %d", userId, 1000)
+	}
+}
+
+func TestOpenStoresMixedDrivers(t *testing.T) {
+	t.Setenv("BOLT_PATH", filepath.Join(t.TempDir(), "config.db"))
+	stores, err := OpenStores(&config{ConfigStore: "bolt", SessionStore: "memory", Repository: contractOptions}, zap.NewNop())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stores.Config.(*boltConfigRepository); !ok {
+		t.Errorf("Got config repository %T but expected the bolt repository", stores.Config)
+	}
+	if _, ok := stores.Session.(memorySessionRepository); !ok {
+		t.Errorf("Got session repository %T but expected the memory repository", stores.Session)
+	}
+	if err = stores.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenStoresRejectsInvalidConfig(t *testing.T) {
+	t.Setenv("MONGODB_URI", "")
+	t.Setenv("MEMORY_SESSIONS", "malformed")
+	tests := []struct {
+		cfg   config
+		error string
+	}{
+		{cfg: config{ConfigStore: "cassandra", SessionStore: "memory"}, error: "unknown store driver cassandra"},
+		{cfg: config{ConfigStore: "mongo", SessionStore: "mysql"}, error: "MONGODB_URI is required"},
+		{cfg: config{ConfigStore: "memory", SessionStore: "memory"}, error: "invalid session"},
+	}
+	for _, test := range tests {
+		if _, err := OpenStores(&test.cfg, zap.NewNop()); err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("Got error %v but expected %q", err, test.error)
+		}
+	}
+}
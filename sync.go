@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// ConfigChanges is what changed in a user's configuration since a revision the client synced at
+type ConfigChanges struct {
+	// Revision is the revision the client has converged to once it applied the changes
+	Revision int64 `json:"revision"`
+	// Reset is set when the changes can't be worked out anymore, Config then holds the full configuration and the
+	// client has to drop every key it doesn't list
+	Reset   bool              `json:"reset"`
+	Config  []ChangedEntry    `json:"config"`
+	Deleted []ConfigTombstone `json:"deleted"`
+}
+
+// ChangedEntry is an upserted entry along with the revision it was last changed at
+type ChangedEntry struct {
+	Key      string    `json:"key"`
+	Value    string    `json:"value"`
+	Type     ValueType `json:"type,omitempty"`
+	Revision int64     `json:"revision"`
+}
+
+// ConfigTombstone is a key deleted at Revision
+type ConfigTombstone struct {
+	Key      string `json:"key"`
+	Revision int64  `json:"revision"`
+}
+
+// FindChanges returns the changes made to the user's configuration after revision since. They're worked out from the
+// revision history, when since has already expired from it or is 0 the full configuration is returned instead.
+func FindChanges(ctx context.Context, repository ConfigRepository, userId int64, profile string, since int64) (*ConfigChanges, error) {
+	current, ok, err := repository.FindCurrentRevision(ctx, userId, profile)
+
+	if err != nil {
+		return nil, err
+	}
+	changes := &ConfigChanges{
+		Revision: current,
+		Config:   make([]ChangedEntry, 0),
+		Deleted:  make([]ConfigTombstone, 0),
+	}
+	if ok && since == current {
+		return changes, nil
+	}
+
+	if since > 0 && since < current {
+		// since itself is included to make sure no revision after it has expired
+		revisions, err := repository.FindRevisions(ctx, userId, profile, RevisionFilter{After: since - 1})
+
+		if err != nil {
+			return nil, err
+		}
+		if len(revisions) > 0 && revisions[len(revisions)-1].Revision == since {
+			return collectChanges(changes, revisions[:len(revisions)-1]), nil
+		}
+	}
+
+	configuration, err := repository.FindByUserId(ctx, userId, profile)
+	if err != nil {
+		return nil, err
+	}
+	changes.Reset = true
+	if configuration != nil {
+		changes.Revision = configuration.Revision
+		for _, entry := range configuration.Config {
+			changes.Config = append(changes.Config, ChangedEntry{Key: entry.Key, Value: entry.Value, Type: entry.Type, Revision: configuration.Revision})
+		}
+	}
+	return changes, nil
+}
+
+// collectChanges folds revisions, newest first, into the latest state of every key they touched
+func collectChanges(changes *ConfigChanges, revisions []ConfigRevision) *ConfigChanges {
+	seen := make(map[string]bool)
+	for _, revision := range revisions {
+		// writes racing with the lookup of the current revision may already be in the history
+		if revision.Revision > changes.Revision {
+			changes.Revision = revision.Revision
+		}
+		for _, change := range revision.Changes {
+			if seen[change.Key] {
+				continue
+			}
+			seen[change.Key] = true
+
+			if change.Value == nil {
+				changes.Deleted = append(changes.Deleted, ConfigTombstone{Key: change.Key, Revision: revision.Revision})
+			} else {
+				changes.Config = append(changes.Config, ChangedEntry{Key: change.Key, Value: *change.Value, Type: recordedConfigValue(*change.Value, change.Type).Type, Revision: revision.Revision})
+			}
+		}
+	}
+	return changes
+}
+
+// ConfigUpdate upserts or deletes a key like ConfigMutation, Revision is the revision the client last saw the key at
+type ConfigUpdate struct {
+	Key      string  `json:"key"`
+	Value    *string `json:"value"`
+	Revision int64   `json:"revision"`
+}
+
+const maxUpdateAttempts = 3
+
+// staleRevisionLimit caps the revisions read to check updates for stale keys, updates based on a revision older than
+// the ones read are treated like updates based on an expired one
+const staleRevisionLimit = 500
+
+// errTooManyConflicts is returned by writes that gave up after maxUpdateAttempts as other writes kept getting in between
+var errTooManyConflicts = errors.New("too many concurrent updates")
+
+// ApplyUpdates applies the updates whose key hasn't changed since the revision they're based on, the others are
+// returned as stale keys instead of being written. The check is done against the revision history and the write is
+// conditioned on the revision it was done at, so it's retried when another write gets in between. Like every other write
+// they never create a named profile, ErrProfileNotFound is returned when it doesn't exist.
+func ApplyUpdates(ctx context.Context, repository ConfigRepository, userId int64, profile string, updates []ConfigUpdate) (*ConfigRevision, []string, []string, error) {
+	for attempt := 1; ; attempt++ {
+		current, ok, err := repository.FindCurrentRevision(ctx, userId, profile)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !ok && profile != DefaultProfile {
+			return nil, nil, nil, ErrProfileNotFound
+		}
+		stale, err := findStaleKeys(ctx, repository, userId, profile, updates)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		staleKeys := make([]string, 0)
+		mutations := make([]ConfigMutation, 0, len(updates))
+		for _, update := range updates {
+			if stale[update.Key] {
+				staleKeys = append(staleKeys, update.Key)
+			} else {
+				mutations = append(mutations, ConfigMutation{Key: update.Key, Value: update.Value})
+			}
+		}
+		if len(mutations) == 0 {
+			var revision *ConfigRevision
+			if ok {
+				revision = &ConfigRevision{Revision: current, Changes: make([]ConfigChange, 0)}
+			}
+			return revision, make([]string, 0), staleKeys, nil
+		}
+
+		precondition := Precondition{Exists: profile != DefaultProfile}
+		if ok {
+			precondition.Revision = &current
+		}
+		revision, failedKeys, err := repository.Apply(ctx, userId, profile, mutations, precondition)
+
+		if err == ErrPreconditionFailed && attempt < maxUpdateAttempts {
+			continue
+		}
+		return revision, failedKeys, staleKeys, err
+	}
+}
+
+// findStaleKeys finds the updated keys changed after the revision their update is based on. Keys are also considered
+// stale when the revisions after theirs may have expired from the history or outnumber staleRevisionLimit, since they
+// can't be checked anymore.
+func findStaleKeys(ctx context.Context, repository ConfigRepository, userId int64, profile string, updates []ConfigUpdate) (map[string]bool, error) {
+	stale := make(map[string]bool)
+	if len(updates) == 0 {
+		return stale, nil
+	}
+	oldest := updates[0].Revision
+	for _, update := range updates {
+		if update.Revision < oldest {
+			oldest = update.Revision
+		}
+	}
+	later, err := repository.FindRevisions(ctx, userId, profile, RevisionFilter{After: oldest, Limit: staleRevisionLimit})
+
+	if err != nil || len(later) == 0 {
+		return stale, err
+	}
+
+	// history expires oldest first, so once a revision at or before oldest is kept every later one is kept too. That
+	// doesn't hold when the revisions read were cut short by the limit
+	complete := later[len(later)-1].Revision == oldest+1
+	if !complete && len(later) < staleRevisionLimit {
+		earlier, err := repository.FindRevisions(ctx, userId, profile, RevisionFilter{Before: oldest + 1, Limit: 1})
+		if err != nil {
+			return nil, err
+		}
+		complete = len(earlier) > 0
+	}
+
+	lastChanged := make(map[string]int64)
+	for _, revision := range later {
+		for _, change := range revision.Changes {
+			if _, ok := lastChanged[change.Key]; !ok {
+				lastChanged[change.Key] = revision.Revision
+			}
+		}
+	}
+	for _, update := range updates {
+		kept := complete || later[len(later)-1].Revision <= update.Revision+1
+		stale[update.Key] = !kept || lastChanged[update.Key] > update.Revision
+	}
+	return stale, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var errValueTooLong = errors.New("value exceeds max length")
+var errInvalidValueType = errors.New("value doesn't hold its type")
+
+// ValueType is the kind of value a config value's text holds. Text that is entirely a JSON number, boolean, object or
+// array has that type, anything else is a string, including JSON strings and null.
+type ValueType string
+
+const (
+	ValueString  ValueType = "string"
+	ValueNumber  ValueType = "number"
+	ValueBoolean ValueType = "boolean"
+	ValueObject  ValueType = "object"
+	ValueArray   ValueType = "array"
+)
+
+// configValue is a config value as it's stored, its text exactly as it was written tagged with its type
+type configValue struct {
+	Type ValueType `json:"type"`
+	Raw  string    `json:"raw"`
+}
+
+// parseConfigValue tags text with the type of value it holds, rejecting text longer than maxLength
+func parseConfigValue(text string, maxLength int64) (configValue, error) {
+	if int64(len(text)) > maxLength {
+		return configValue{}, errValueTooLong
+	}
+	return configValue{Type: valueType(text), Raw: text}, nil
+}
+
+// typedConfigValue tags text with declared, which must be the type text holds or string, any text being a string.
+// An empty declared type is inferred like parseConfigValue does.
+func typedConfigValue(text string, declared ValueType, maxLength int64) (configValue, error) {
+	value, err := parseConfigValue(text, maxLength)
+
+	if err != nil || declared == "" || declared == value.Type {
+		return value, err
+	}
+	if declared != ValueString {
+		return configValue{}, errInvalidValueType
+	}
+	value.Type = ValueString
+	return value, nil
+}
+
+// recordedConfigValue tags text with the type it was recorded with in the revision history, inferring it for revisions
+// recorded before changes kept their types
+func recordedConfigValue(text string, recorded ValueType) configValue {
+	if recorded == "" {
+		recorded = valueType(text)
+	}
+	return configValue{Type: recorded, Raw: text}
+}
+
+func valueType(text string) ValueType {
+	if text == "" || !json.Valid([]byte(text)) {
+		return ValueString
+	}
+	switch c := text[0]; {
+	case c == '{':
+		return ValueObject
+	case c == '[':
+		return ValueArray
+	case c == 't' || c == 'f':
+		return ValueBoolean
+	case c == '-' || c >= '0' && c <= '9':
+		return ValueNumber
+	default:
+		return ValueString
+	}
+}
+
+// legacyConfigValue converts a value stored before values kept their text. Text that looked like JSON used to be
+// stored parsed and is read back re-marshalled, the type is the one that text has now.
+func legacyConfigValue(value interface{}) (configValue, error) {
+	serialized, err := serializeGroupValue(value)
+	if err != nil {
+		return configValue{}, err
+	}
+	if _, ok := value.(string); ok {
+		return configValue{Type: ValueString, Raw: serialized}, nil
+	}
+	return configValue{Type: valueType(serialized), Raw: serialized}, nil
+}
+
+// scalar returns the number, boolean or string the value holds, objects and arrays aren't decoded and nil is returned
+func (v configValue) scalar() interface{} {
+	switch v.Type {
+	case ValueString:
+		return v.Raw
+	case ValueNumber, ValueBoolean:
+		var decoded interface{}
+		if json.Unmarshal([]byte(v.Raw), &decoded) != nil {
+			// numbers too large for a float64
+			return nil
+		}
+		return decoded
+	default:
+		return nil
+	}
+}
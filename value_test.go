@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected ValueType
+	}{
+		{text: "", expected: ValueString},
+		{text: "string with spaces", expected: ValueString},
+		{text: "007", expected: ValueString},
+		{text: "true_ish", expected: ValueString},
+		{text: "\"quote\"", expected: ValueString},
+		{text: "null", expected: ValueString},
+		{text: " 1", expected: ValueString},
+		{text: "{invalid", expected: ValueString},
+		{text: "true", expected: ValueBoolean},
+		{text: "false", expected: ValueBoolean},
+		{text: "1e3", expected: ValueNumber},
+		{text: "-0.10000000000000000001", expected: ValueNumber},
+		{text: "{\"b\": 1, \"a\": 2}", expected: ValueObject},
+		{text: "[42]", expected: ValueArray},
+	}
+	for _, test := range tests {
+		value, err := parseConfigValue(test.text, 1024)
+		if err != nil || value.Type != test.expected || value.Raw != test.text {
+			t.Errorf("Got value %v, %v for %q but expected type %s and the text kept", value, err, test.text, test.expected)
+		}
+	}
+}
+
+func TestParseConfigValueExceedMaxLength(t *testing.T) {
+	jsonBomb := strings.Repeat("{\"a\":", 1024) + "[]" + strings.Repeat("}", 1024)
+
+	if _, err := parseConfigValue(jsonBomb, 128); err == nil {
+		t.Errorf("Parsed json bomb string")
+	}
+}
+
+func TestTypedConfigValue(t *testing.T) {
+	tests := []struct {
+		text     string
+		declared ValueType
+		expected ValueType
+		err      error
+	}{
+		{text: "1", declared: "", expected: ValueNumber},
+		{text: "1", declared: ValueNumber, expected: ValueNumber},
+		{text: "1", declared: ValueString, expected: ValueString},
+		{text: "[42]", declared: ValueString, expected: ValueString},
+		{text: "abc", declared: ValueNumber, err: errInvalidValueType},
+		{text: "1", declared: ValueBoolean, err: errInvalidValueType},
+		{text: "{}", declared: "map", err: errInvalidValueType},
+	}
+	for _, test := range tests {
+		value, err := typedConfigValue(test.text, test.declared, 1024)
+		if err != test.err || err == nil && (value.Type != test.expected || value.Raw != test.text) {
+			t.Errorf("Got value %v, %v for %q declared %q but expected type %q, %v", value, err, test.text, test.declared, test.expected, test.err)
+		}
+	}
+}
+
+func TestConfigValueScalar(t *testing.T) {
+	tests := []struct {
+		value    configValue
+		expected interface{}
+	}{
+		{value: configValue{Type: ValueString, Raw: "007"}, expected: "007"},
+		{value: configValue{Type: ValueNumber, Raw: "1e3"}, expected: float64(1000)},
+		{value: configValue{Type: ValueBoolean, Raw: "true"}, expected: true},
+		{value: configValue{Type: ValueNumber, Raw: "1e999"}, expected: nil},
+		{value: configValue{Type: ValueArray, Raw: "[42]"}, expected: nil},
+	}
+	for _, test := range tests {
+		if scalar := test.value.scalar(); scalar != test.expected {
+			t.Errorf("Got scalar %v for %v but expected %v", scalar, test.value, test.expected)
+		}
+	}
+}
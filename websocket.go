@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+const socketWriteTimeout = 10 * time.Second
+const socketPongTimeout = 60 * time.Second
+const socketPingInterval = 30 * time.Second
+
+var upgrader = websocket.Upgrader{
+	// sessions are authenticated by a header browsers can't forge on cross-site requests, so any origin is fine
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// socketRequest is a batch of updates pushed by a client, it's answered by an ack or error message with the same id
+type socketRequest struct {
+	Id      int64          `json:"id"`
+	Updates []ConfigUpdate `json:"updates"`
+}
+
+// socketMessage is sent to clients, either an ack or error answering a request or a change made by another session
+type socketMessage struct {
+	Type       string          `json:"type"`
+	Id         int64           `json:"id,omitempty"`
+	Revision   int64           `json:"revision,omitempty"`
+	FailedKeys []string        `json:"failedKeys,omitempty"`
+	StaleKeys  []string        `json:"staleKeys,omitempty"`
+	Change     *ConfigRevision `json:"change,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// SocketHandler syncs configs over websockets, clients push updates and receive the changes of their other sessions
+type SocketHandler struct {
+	logger          *zap.Logger
+	repository      ConfigRepository
+	broker          ChangeBroker
+	maxMessageBytes int64
+}
+
+func NewSocketHandler(logger *zap.Logger, repository ConfigRepository, broker ChangeBroker, maxMessageBytes int64) *SocketHandler {
+	return &SocketHandler{
+		logger:          logger,
+		repository:      repository,
+		broker:          broker,
+		maxMessageBytes: maxMessageBytes,
+	}
+}
+
+func (s *SocketHandler) HandleSocket(userId int64, writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	profile := profileParam(params)
+	// named profiles are never created implicitly, so sockets can only be opened on existing ones
+	if profile != DefaultProfile {
+		exists := validateExistingProfile(profile) == nil
+		if exists {
+			var err error
+			if _, exists, err = s.repository.FindCurrentRevision(request.Context(), userId, profile); err != nil {
+				http.Error(writer, "Internal server error", http.StatusInternalServerError)
+				s.logger.Error("Failed to find profile", zap.Error(err))
+				return
+			}
+		}
+		if !exists {
+			http.Error(writer, "Profile not found", http.StatusNotFound)
+			return
+		}
+	}
+	conn, err := upgrader.Upgrade(writer, request, nil)
+
+	if err != nil {
+		// the upgrader has already replied with an error
+		s.logger.Debug("Failed to upgrade websocket", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	events, cancel := s.broker.Subscribe(userId)
+	defer cancel()
+
+	origin, _ := request.Context().Value(ctxToken).(string)
+	typed := typedValues(request)
+	// the payload limit of the http server doesn't apply to hijacked connections
+	conn.SetReadLimit(s.maxMessageBytes)
+	conn.SetReadDeadline(time.Now().Add(socketPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(socketPongTimeout))
+	})
+
+	// gorilla connections support a single concurrent reader, so requests are read on their own goroutine and handled
+	// along with the events on this one, which is the only writer
+	requests := make(chan []byte)
+	closed := make(chan struct{})
+	go func() {
+		defer close(requests)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case requests <- data:
+			case <-closed:
+				return
+			}
+		}
+	}()
+	defer close(closed)
+
+	ping := time.NewTicker(socketPingInterval)
+	defer ping.Stop()
+	for {
+		var message *socketMessage
+		select {
+		case data, ok := <-requests:
+			if !ok {
+				return
+			}
+			message = s.handleRequest(request, userId, profile, data)
+		case event, ok := <-events:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "resync required"), time.Now().Add(socketWriteTimeout))
+				return
+			}
+			if event.Profile != profile || event.Origin != "" && event.Origin == origin {
+				continue
+			}
+			revision := event.Revision
+			if !typed {
+				revision.Changes = changesWithoutTypes(revision.Changes)
+			}
+			message = &socketMessage{Type: "change", Revision: revision.Revision, Change: &revision}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteTimeout)); err != nil {
+				return
+			}
+			continue
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+		if err := conn.WriteJSON(message); err != nil {
+			return
+		}
+	}
+}
+
+func (s *SocketHandler) handleRequest(request *http.Request, userId int64, profile string, data []byte) *socketMessage {
+	var socketRequest socketRequest
+
+	if err := json.Unmarshal(data, &socketRequest); err != nil {
+		return &socketMessage{Type: "error", Error: "Invalid message"}
+	}
+	revision, failedKeys, staleKeys, err := ApplyUpdates(request.Context(), s.repository, userId, profile, socketRequest.Updates)
+
+	if err == ErrPreconditionFailed {
+		return &socketMessage{Type: "error", Id: socketRequest.Id, Error: "Too many concurrent updates"}
+	} else if err == ErrProfileNotFound {
+		return &socketMessage{Type: "error", Id: socketRequest.Id, Error: "Profile not found"}
+	} else if quotaErr, ok := err.(*QuotaError); ok {
+		return &socketMessage{Type: "error", Id: socketRequest.Id, Error: "Quota exceeded, " + quotaErr.Error()}
+	} else if err == ErrConfigTooLarge {
+		return &socketMessage{Type: "error", Id: socketRequest.Id, Error: "Configuration too large"}
+	} else if err != nil {
+		s.logger.Error("Failed to apply websocket updates", zap.Error(err))
+		return &socketMessage{Type: "error", Id: socketRequest.Id, Error: "Update failed"}
+	}
+	ack := &socketMessage{Type: "ack", Id: socketRequest.Id, FailedKeys: failedKeys, StaleKeys: staleKeys}
+	if revision != nil {
+		ack.Revision = revision.Revision
+	}
+	return ack
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHandleSocket(t *testing.T) {
+	broker := NewMemoryChangeBroker()
+	repository := NewPublishingConfigRepository(NewMemoryConfigRepository(contractOptions), broker)
+	socketHandler := NewSocketHandler(zap.NewNop(), repository, broker, 4096)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := context.WithValue(request.Context(), ctxToken, request.Header.Get(authHeader))
+		socketHandler.HandleSocket(1000, writer, request.WithContext(ctx), httprouter.Params{})
+	}))
+	defer server.Close()
+
+	dial := func(token string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), http.Header{authHeader: {token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	first := dial("first")
+	defer first.Close()
+	second := dial("second")
+	defer second.Close()
+
+	exchange := func(conn *websocket.Conn, request socketRequest) socketMessage {
+		if err := conn.WriteJSON(request); err != nil {
+			t.Fatal(err)
+		}
+		var message socketMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+
+	ack := exchange(first, socketRequest{Id: 1, Updates: []ConfigUpdate{
+		{Key: "bank.tagTabs", Value: stringPtr("Vorkath")},
+		{Key: "oversize.key", Value: stringPtr(strings.Repeat("a", contractMaxConfigValueLength+1))},
+	}})
+	expected := socketMessage{Type: "ack", Id: 1, Revision: 1, FailedKeys: []string{"oversize.key"}}
+	if !reflect.DeepEqual(ack, expected) {
+		t.Errorf("Got message %+v but expected %+v", ack, expected)
+	}
+
+	var change socketMessage
+	if err := second.ReadJSON(&change); err != nil {
+		t.Fatal(err)
+	}
+	if change.Type != "change" || change.Revision != 1 || len(change.Change.Changes) != 1 || *change.Change.Changes[0].Value != "Vorkath" {
+		t.Errorf("Got message %+v but expected the first session's change", change)
+	}
+
+	// the second session hasn't seen revision 1 yet
+	ack = exchange(second, socketRequest{Id: 7, Updates: []ConfigUpdate{
+		{Key: "bank.tagTabs", Value: stringPtr("Zulrah")},
+		{Key: "bank.memoryTab", Value: stringPtr("true")},
+	}})
+	expected = socketMessage{Type: "ack", Id: 7, Revision: 2, StaleKeys: []string{"bank.tagTabs"}}
+	if !reflect.DeepEqual(ack, expected) {
+		t.Errorf("Got message %+v but expected %+v", ack, expected)
+	}
+
+	var message socketMessage
+	if err := first.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Type != "change" || message.Revision != 2 {
+		t.Errorf("Got message %+v but expected the second session's change", message)
+	}
+	if err := first.WriteMessage(websocket.TextMessage, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.ReadJSON(&message); err != nil || message.Type != "error" {
+		t.Errorf("Got message %+v and error %v but expected an error message", message, err)
+	}
+}
+
+func TestHandleSocketProfiles(t *testing.T) {
+	broker := NewMemoryChangeBroker()
+	repository := NewPublishingConfigRepository(NewMemoryConfigRepository(contractOptions), broker)
+	if err := repository.CreateProfile(context.Background(), 1000, "pvp"); err != nil {
+		t.Fatal(err)
+	}
+	socketHandler := NewSocketHandler(zap.NewNop(), repository, broker, 4096)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		params := httprouter.Params{{Key: "profile", Value: strings.TrimPrefix(request.URL.Path, "/")}}
+		socketHandler.HandleSocket(1000, writer, request, params)
+	}))
+	defer server.Close()
+
+	for _, profile := range []string{"missing", "not%20valid", "default"} {
+		conn, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/"+profile, nil)
+		if err == nil {
+			conn.Close()
+		}
+		if profile == "default" {
+			if err != nil {
+				t.Errorf("Got error %v opening a socket on the default profile", err)
+			}
+			continue
+		}
+		if err == nil || response == nil || response.StatusCode != http.StatusNotFound {
+			t.Errorf("Got response %v opening a socket on profile %s but expected 404", response, profile)
+		}
+	}
+	if profiles, err := repository.ListProfiles(context.Background(), 1000); err != nil || len(profiles) != 2 {
+		t.Errorf("Got profiles %v but expected only default and pvp", profiles)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/pvp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the profile is deleted while the socket is open
+	if err = repository.DeleteProfile(context.Background(), 1000, "pvp"); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.WriteJSON(socketRequest{Id: 1, Updates: []ConfigUpdate{{Key: "bank.tagTabs", Value: stringPtr("Vorkath")}}}); err != nil {
+		t.Fatal(err)
+	}
+	var message socketMessage
+	if err = conn.ReadJSON(&message); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (socketMessage{Type: "error", Id: 1, Error: "Profile not found"}); !reflect.DeepEqual(message, expected) {
+		t.Errorf("Got message %+v but expected %+v", message, expected)
+	}
+}